@@ -0,0 +1,125 @@
+package aws
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// aggregator is a RecordPutter that packs several newline-delimited records
+// into each record it sends, optionally gzipping them
+type aggregator struct {
+	putter  RecordPutter
+	maxSize int
+	gzip    bool
+}
+
+// NewAggregator returns a RecordPutter that packs records into as few
+// newline-delimited records of at most maxSize bytes (before compression) as
+// possible, and sends them through putter.  If gzipRecords is set, each
+// aggregated record is gzipped.  Results are reported against the original
+// records.
+func NewAggregator(putter RecordPutter, maxSize int, gzipRecords bool) RecordPutter {
+	return &aggregator{putter: putter, maxSize: maxSize, gzip: gzipRecords}
+}
+
+func (a *aggregator) PutRecord(record []byte) error {
+	packed, err := a.pack([][]byte{record})
+	if err != nil {
+		return err
+	}
+	return a.putter.PutRecord(packed)
+}
+
+func (a *aggregator) PutRecordBatch(records [][]byte) (*BatchResult, error) {
+	// Group records into aggregates, remembering which records went where
+	groups := [][]int{}
+	current := []int{}
+	currentSize := 0
+	for idx, record := range records {
+		size := len(record)
+		if !endsWithNewline(record) {
+			size += 1
+		}
+
+		if len(current) > 0 && currentSize+size > a.maxSize {
+			groups = append(groups, current)
+			current = []int{}
+			currentSize = 0
+		}
+		current = append(current, idx)
+		currentSize += size
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+
+	aggregated := make([][]byte, len(groups))
+	for i, group := range groups {
+		members := make([][]byte, len(group))
+		for j, idx := range group {
+			members[j] = records[idx]
+		}
+
+		packed, err := a.pack(members)
+		if err != nil {
+			return NewBatchResult(len(records), err), err
+		}
+		aggregated[i] = packed
+	}
+
+	res, err := a.putter.PutRecordBatch(aggregated)
+
+	// Every record shares the outcome of its aggregate
+	result := &BatchResult{}
+	for _, i := range res.Succeeded {
+		result.Succeeded = append(result.Succeeded, groups[i]...)
+	}
+	for _, i := range res.Retried {
+		result.Retried = append(result.Retried, groups[i]...)
+	}
+	for _, f := range res.Failed {
+		for _, idx := range groups[f.Index] {
+			result.Failed = append(result.Failed, RecordFailure{
+				Index: idx, ErrorCode: f.ErrorCode, ErrorMessage: f.ErrorMessage,
+			})
+		}
+	}
+
+	return result, err
+}
+
+// pack joins records into a single newline-delimited record
+func (a *aggregator) pack(records [][]byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	var w interface {
+		Write([]byte) (int, error)
+	} = buf
+	var gz *gzip.Writer
+	if a.gzip {
+		gz = gzip.NewWriter(buf)
+		w = gz
+	}
+
+	for _, record := range records {
+		if _, err := w.Write(record); err != nil {
+			return nil, err
+		}
+		if !endsWithNewline(record) {
+			if _, err := w.Write([]byte{'\n'}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func endsWithNewline(record []byte) bool {
+	return len(record) > 0 && record[len(record)-1] == '\n'
+}
@@ -0,0 +1,70 @@
+package aws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingPutter struct {
+	batches [][][]byte
+	err     error
+}
+
+func (r *recordingPutter) PutRecord(record []byte) error {
+	_, err := r.PutRecordBatch([][]byte{record})
+	return err
+}
+
+func (r *recordingPutter) PutRecordBatch(records [][]byte) (*BatchResult, error) {
+	r.batches = append(r.batches, records)
+	return NewBatchResult(len(records), r.err), r.err
+}
+
+func TestAggregatorPacksRecords(t *testing.T) {
+	putter := &recordingPutter{}
+	a := NewAggregator(putter, 16, false)
+
+	res, err := a.PutRecordBatch([][]byte{
+		[]byte(`{"a":1}`), []byte("{\"b\":2}\n"), []byte(`{"c":3}`),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, res.Succeeded)
+
+	t.Log("Records are newline-delimited and packed up to the max size")
+	assert.Equal(t, 1, len(putter.batches))
+	assert.Equal(t, [][]byte{
+		[]byte("{\"a\":1}\n{\"b\":2}\n"),
+		[]byte("{\"c\":3}\n"),
+	}, putter.batches[0])
+}
+
+func TestAggregatorGzipsRecords(t *testing.T) {
+	putter := &recordingPutter{}
+	a := NewAggregator(putter, 1024, true)
+
+	_, err := a.PutRecordBatch([][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(putter.batches[0]))
+
+	r, err := gzip.NewReader(bytes.NewReader(putter.batches[0][0]))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"a\":1}\n{\"b\":2}\n", string(data))
+}
+
+func TestAggregatorReportsOriginalRecords(t *testing.T) {
+	putter := &recordingPutter{err: errors.New("test error")}
+	a := NewAggregator(putter, 1024, false)
+
+	records := [][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)}
+	res, err := a.PutRecordBatch(records)
+	assert.Error(t, err)
+	assert.Equal(t, 2, res.FailedCount())
+	assert.Equal(t, records, res.FailedRecords(records))
+}
@@ -0,0 +1,210 @@
+package aws
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// BackendConfig holds the settings a backend may need to create its
+// RecordPutters.  Each backend only reads the fields that apply to it.
+type BackendConfig struct {
+	// "aws": how to authenticate, and how to write to each stream.  Streams
+	// are Kinesis Data Streams if Kinesis is set, and Firehose streams
+	// otherwise.
+	Session  SessionConfig
+	Firehose FirehoseConfig
+	Kinesis  *KinesisConfig
+	// "http-mock": the URL batches are POSTed to
+	MockEndpoint string
+	// "file": the directory streams are written to, and how files rotate
+	Dir  string
+	File FileConfig
+	// Settings for third-party backends
+	Options map[string]string
+}
+
+// Backend creates the RecordPutters for every stream of an output.  Backends
+// holding resources also implement io.Closer, and are closed on shutdown.
+type Backend interface {
+	NewRecordPutter(stream string) (RecordPutter, error)
+}
+
+// BackendFactory creates a Backend from an output's config
+type BackendFactory func(conf BackendConfig) (Backend, error)
+
+// BackendFunc adapts a function to the Backend interface
+type BackendFunc func(stream string) (RecordPutter, error)
+
+func (f BackendFunc) NewRecordPutter(stream string) (RecordPutter, error) {
+	return f(stream)
+}
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]BackendFactory{}
+)
+
+// RegisterBackend makes a backend available under name.  Registering the same
+// name twice replaces the earlier backend.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	backends[name] = factory
+}
+
+// Backends returns the names of every registered backend
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend creates the backend registered under name
+func NewBackend(name string, conf BackendConfig) (Backend, error) {
+	backendsLock.RLock()
+	factory, ok := backends[name]
+	backendsLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown backend '%s' (registered backends: %v)", name, Backends())
+	}
+	return factory(conf)
+}
+
+func newAWSBackend(conf BackendConfig) (Backend, error) {
+	// Every stream shares a single session, and so its credentials
+	sess, err := NewSession(conf.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	return BackendFunc(func(stream string) (RecordPutter, error) {
+		if conf.Kinesis != nil {
+			return NewKinesis(sess, stream, *conf.Kinesis), nil
+		}
+		return NewFirehose(sess, stream, conf.Firehose), nil
+	}), nil
+}
+
+func newHTTPMockBackend(conf BackendConfig) (Backend, error) {
+	if conf.MockEndpoint == "" {
+		return nil, fmt.Errorf("the http-mock backend needs an endpoint")
+	}
+
+	return BackendFunc(func(stream string) (RecordPutter, error) {
+		return NewMockRecordPutter(stream, conf.MockEndpoint), nil
+	}), nil
+}
+
+// fileBackend shares one FilePutter per stream, so every writer to a stream
+// appends to the same rotating file
+type fileBackend struct {
+	lock    sync.Mutex
+	dir     string
+	conf    FileConfig
+	putters map[string]*FilePutter
+}
+
+func newFileBackend(conf BackendConfig) (Backend, error) {
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("the file backend needs a directory")
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &fileBackend{dir: conf.Dir, conf: conf.File, putters: map[string]*FilePutter{}}, nil
+}
+
+func (b *fileBackend) NewRecordPutter(stream string) (RecordPutter, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if putter, ok := b.putters[stream]; ok {
+		return putter, nil
+	}
+
+	putter, err := NewFilePutter(b.dir, stream, b.conf)
+	if err != nil {
+		return nil, err
+	}
+	b.putters[stream] = putter
+	return putter, nil
+}
+
+// Close finishes every stream's current file
+func (b *fileBackend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var err error
+	for _, putter := range b.putters {
+		if closeErr := putter.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func newStdoutBackend(conf BackendConfig) (Backend, error) {
+	putter := NewWriterPutter(os.Stdout)
+	return BackendFunc(func(stream string) (RecordPutter, error) {
+		return putter, nil
+	}), nil
+}
+
+func init() {
+	RegisterBackend("aws", newAWSBackend)
+	RegisterBackend("http-mock", newHTTPMockBackend)
+	RegisterBackend("file", newFileBackend)
+	RegisterBackend("stdout", newStdoutBackend)
+}
+
+// writerPutter is a RecordPutter that writes newline-delimited records to an
+// io.Writer
+type writerPutter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterPutter returns a RecordPutter that writes each record to w,
+// followed by a newline if it doesn't already end with one
+func NewWriterPutter(w io.Writer) RecordPutter {
+	return &writerPutter{w: w}
+}
+
+func (p *writerPutter) PutRecord(record []byte) error {
+	_, err := p.PutRecordBatch([][]byte{record})
+	return err
+}
+
+func (p *writerPutter) PutRecordBatch(records [][]byte) (*BatchResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	result := &BatchResult{}
+	var lastErr error
+	for idx, record := range records {
+		if !endsWithNewline(record) {
+			record = append(record[:len(record):len(record)], '\n')
+		}
+
+		if _, err := p.w.Write(record); err != nil {
+			lastErr = err
+			result.failAll([]int{idx}, err)
+		} else {
+			result.Succeeded = append(result.Succeeded, idx)
+		}
+	}
+	return result, lastErr
+}
@@ -0,0 +1,91 @@
+package aws
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinBackendsAreRegistered(t *testing.T) {
+	assert.Equal(t, []string{"aws", "file", "http-mock", "stdout"}, Backends())
+}
+
+func TestUnknownBackend(t *testing.T) {
+	_, err := NewBackend("carrier-pigeon", BackendConfig{})
+	assert.Error(t, err)
+}
+
+func TestRegisterBackend(t *testing.T) {
+	buf := &bytes.Buffer{}
+	RegisterBackend("test-buffer", func(conf BackendConfig) (Backend, error) {
+		return BackendFunc(func(stream string) (RecordPutter, error) {
+			return NewWriterPutter(buf), nil
+		}), nil
+	})
+	defer func() {
+		backendsLock.Lock()
+		delete(backends, "test-buffer")
+		backendsLock.Unlock()
+	}()
+
+	backend, err := NewBackend("test-buffer", BackendConfig{})
+	assert.NoError(t, err)
+	putter, err := backend.NewRecordPutter("test")
+	assert.NoError(t, err)
+
+	res, err := putter.PutRecordBatch([][]byte{[]byte(`{"a":1}`), []byte("{\"b\":2}\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, res.Succeeded)
+	assert.Equal(t, "{\"a\":1}\n{\"b\":2}\n", buf.String())
+}
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-backend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewBackend("file", BackendConfig{})
+	assert.Error(t, err, "expected the file backend to require a directory")
+
+	backend, err := NewBackend("file", BackendConfig{Dir: dir})
+	assert.NoError(t, err)
+	putter, err := backend.NewRecordPutter("test-stream")
+	assert.NoError(t, err)
+
+	_, err = putter.PutRecordBatch([][]byte{[]byte(`{"a":1}`)})
+	assert.NoError(t, err)
+
+	again, err := backend.NewRecordPutter("test-stream")
+	assert.NoError(t, err)
+	assert.True(t, putter == again, "expected a stream's putter to be shared")
+	assert.NoError(t, backend.(io.Closer).Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "test-stream-*.json"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	data, err := ioutil.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"a\":1}\n", string(data))
+}
+
+func TestAWSBackendWritesKinesisStreams(t *testing.T) {
+	backend, err := NewBackend("aws", BackendConfig{Session: SessionConfig{Region: "us-west-1"}})
+	assert.NoError(t, err)
+	putter, err := backend.NewRecordPutter("test")
+	assert.NoError(t, err)
+	assert.IsType(t, &Firehose{}, putter)
+
+	backend, err = NewBackend("aws", BackendConfig{
+		Session: SessionConfig{Region: "us-west-1"},
+		Kinesis: &KinesisConfig{Retry: DefaultRetryPolicy()},
+	})
+	assert.NoError(t, err)
+	putter, err = backend.NewRecordPutter("test")
+	assert.NoError(t, err)
+	assert.IsType(t, &Kinesis{}, putter)
+}
@@ -0,0 +1,192 @@
+package aws
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+)
+
+// FileConfig controls how a FilePutter rotates and compresses its files
+type FileConfig struct {
+	// Rotate once this many bytes (before compression) have been written to
+	// a file.  Zero never rotates on size.
+	MaxFileSize int64
+	// Rotate files once they are this old, whether or not anything is
+	// written to them after that.  Zero never rotates on age.
+	MaxFileAge time.Duration
+	// Gzip every file, like Firehose's GZIP S3 compression
+	Gzip bool
+}
+
+// FilePutter is a RecordPutter that writes records to rotating files in a
+// directory, as the newline-delimited JSON Firehose delivers to S3.  Files are
+// named "<stream>-<YYYY-MM-DD-HH-MM-SS>-<seq>.json", plus ".gz" if gzipped.
+type FilePutter struct {
+	lock   sync.Mutex
+	dir    string
+	stream string
+	conf   FileConfig
+	now    func() time.Time
+
+	file    *os.File
+	writer  io.Writer
+	gz      *gzip.Writer
+	written int64
+	opened  time.Time
+	seq     int
+	// Closes the current file once it reaches MaxFileAge
+	timer *time.Timer
+}
+
+// NewFilePutter returns a FilePutter writing stream's records into dir
+func NewFilePutter(dir, stream string, conf FileConfig) (*FilePutter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FilePutter{dir: dir, stream: stream, conf: conf, now: time.Now}, nil
+}
+
+func (p *FilePutter) PutRecord(record []byte) error {
+	_, err := p.PutRecordBatch([][]byte{record})
+	return err
+}
+
+// PutRecordBatch writes every record to the current file, rotating first if
+// the file is too old or too big.  A batch is never split across files.
+func (p *FilePutter) PutRecordBatch(records [][]byte) (*BatchResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.file != nil && p.shouldRotate() {
+		if err := p.closeFile(); err != nil {
+			return NewBatchResult(len(records), err), err
+		}
+	}
+	if p.file == nil {
+		if err := p.openFile(); err != nil {
+			return NewBatchResult(len(records), err), err
+		}
+	}
+
+	result := &BatchResult{}
+	var lastErr error
+	for idx, record := range records {
+		if !endsWithNewline(record) {
+			record = append(record[:len(record):len(record)], '\n')
+		}
+
+		n, err := p.writer.Write(record)
+		p.written += int64(n)
+		if err != nil {
+			lastErr = err
+			result.failAll([]int{idx}, err)
+		} else {
+			result.Succeeded = append(result.Succeeded, idx)
+		}
+	}
+
+	// Make sure a gzipped file can be read back (up to this batch) before it
+	// is closed
+	if p.gz != nil {
+		if err := p.gz.Flush(); err != nil {
+			return NewBatchResult(len(records), err), err
+		}
+	}
+
+	return result, lastErr
+}
+
+// Rotate closes the current file, so the next batch starts a new one
+func (p *FilePutter) Rotate() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.closeFile()
+}
+
+// Close finishes the current file
+func (p *FilePutter) Close() error {
+	return p.Rotate()
+}
+
+func (p *FilePutter) shouldRotate() bool {
+	if p.conf.MaxFileSize > 0 && p.written >= p.conf.MaxFileSize {
+		return true
+	}
+	if p.conf.MaxFileAge > 0 && p.now().Sub(p.opened) >= p.conf.MaxFileAge {
+		return true
+	}
+	return false
+}
+
+func (p *FilePutter) openFile() error {
+	p.opened = p.now()
+	p.seq++
+
+	name := fmt.Sprintf("%s-%s-%d.json", p.stream, p.opened.UTC().Format("2006-01-02-15-04-05"), p.seq)
+	if p.conf.Gzip {
+		name += ".gz"
+	}
+
+	file, err := os.OpenFile(filepath.Join(p.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	p.file = file
+	p.writer = file
+	p.written = 0
+	if p.conf.Gzip {
+		p.gz = gzip.NewWriter(file)
+		p.writer = p.gz
+	}
+	if p.conf.MaxFileAge > 0 {
+		p.timer = time.AfterFunc(p.conf.MaxFileAge, func() { p.rotateExpired(file) })
+	}
+	return nil
+}
+
+// rotateExpired closes file once it reaches MaxFileAge, if it's still the
+// current file, so that an idle stream's last records aren't left in an open
+// file until the next write
+func (p *FilePutter) rotateExpired(file *os.File) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.file != file {
+		return
+	}
+	if err := p.closeFile(); err != nil {
+		kvlog.ErrorD("file-rotate-failed", logger.M{"stream": p.stream, "msg": err.Error()})
+	}
+}
+
+func (p *FilePutter) closeFile() error {
+	if p.file == nil {
+		return nil
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	var err error
+	if p.gz != nil {
+		err = p.gz.Close()
+	}
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	p.file = nil
+	p.writer = nil
+	p.gz = nil
+	return err
+}
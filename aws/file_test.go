@@ -0,0 +1,148 @@
+package aws
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempFilePutter(t *testing.T, conf FileConfig) (*FilePutter, string) {
+	dir, err := ioutil.TempDir("", "file-putter")
+	assert.NoError(t, err)
+
+	putter, err := NewFilePutter(dir, "stream", conf)
+	assert.NoError(t, err)
+	return putter, dir
+}
+
+func streamFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "stream-*"))
+	assert.NoError(t, err)
+	sort.Strings(files)
+	return files
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestFilePutterWritesNewlineDelimitedRecords(t *testing.T) {
+	putter, dir := tempFilePutter(t, FileConfig{})
+	defer os.RemoveAll(dir)
+
+	res, err := putter.PutRecordBatch([][]byte{[]byte(`{"a":1}`), []byte("{\"b\":2}\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, res.Succeeded)
+	assert.NoError(t, putter.PutRecord([]byte(`{"c":3}`)))
+	assert.NoError(t, putter.Close())
+
+	files := streamFiles(t, dir)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "{\"a\":1}\n{\"b\":2}\n{\"c\":3}\n", readFile(t, files[0]))
+}
+
+func TestFilePutterRotatesOnSize(t *testing.T) {
+	putter, dir := tempFilePutter(t, FileConfig{MaxFileSize: 10})
+	defer os.RemoveAll(dir)
+
+	// Batches are never split, so the first file goes over the limit
+	_, err := putter.PutRecordBatch([][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)})
+	assert.NoError(t, err)
+	_, err = putter.PutRecordBatch([][]byte{[]byte(`{"c":3}`)})
+	assert.NoError(t, err)
+	assert.NoError(t, putter.Close())
+
+	files := streamFiles(t, dir)
+	assert.Len(t, files, 2)
+	assert.Equal(t, "{\"a\":1}\n{\"b\":2}\n", readFile(t, files[0]))
+	assert.Equal(t, "{\"c\":3}\n", readFile(t, files[1]))
+}
+
+func TestFilePutterRotatesOnAge(t *testing.T) {
+	putter, dir := tempFilePutter(t, FileConfig{MaxFileAge: time.Minute})
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC)
+	putter.now = func() time.Time { return now }
+
+	assert.NoError(t, putter.PutRecord([]byte(`{"a":1}`)))
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, putter.PutRecord([]byte(`{"b":2}`)))
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, putter.PutRecord([]byte(`{"c":3}`)))
+	assert.NoError(t, putter.Close())
+
+	files := streamFiles(t, dir)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "stream-2016-05-04-03-02-01-1.json"),
+		filepath.Join(dir, "stream-2016-05-04-03-03-01-2.json"),
+	}, files)
+	assert.Equal(t, "{\"a\":1}\n{\"b\":2}\n", readFile(t, files[0]))
+	assert.Equal(t, "{\"c\":3}\n", readFile(t, files[1]))
+}
+
+func TestFilePutterRotatesIdleFiles(t *testing.T) {
+	putter, dir := tempFilePutter(t, FileConfig{MaxFileAge: 10 * time.Millisecond, Gzip: true})
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, putter.PutRecord([]byte(`{"a":1}`)))
+
+	t.Log("Files are closed once they're old enough, without another write")
+	for i := 0; i < 100 && putter.isOpen(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, putter.isOpen())
+
+	files := streamFiles(t, dir)
+	assert.Len(t, files, 1)
+	file, err := os.Open(files[0])
+	assert.NoError(t, err)
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"a\":1}\n", string(data))
+
+	t.Log("The next write starts a new file")
+	assert.NoError(t, putter.PutRecord([]byte(`{"b":2}`)))
+	assert.NoError(t, putter.Close())
+	assert.Len(t, streamFiles(t, dir), 2)
+}
+
+func (p *FilePutter) isOpen() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.file != nil
+}
+
+func TestFilePutterGzip(t *testing.T) {
+	putter, dir := tempFilePutter(t, FileConfig{Gzip: true})
+	defer os.RemoveAll(dir)
+
+	_, err := putter.PutRecordBatch([][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)})
+	assert.NoError(t, err)
+	assert.NoError(t, putter.Close())
+
+	files := streamFiles(t, dir)
+	assert.Len(t, files, 1)
+	assert.Equal(t, ".gz", filepath.Ext(files[0]))
+
+	file, err := os.Open(files[0])
+	assert.NoError(t, err)
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"a\":1}\n{\"b\":2}\n", string(data))
+}
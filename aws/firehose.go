@@ -1,10 +1,10 @@
 package aws
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	iface "github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
@@ -17,21 +17,106 @@ var kvlog = logger.New("redshift-output")
 // RecordPutter is the interface for sending data to a delivery stream
 type RecordPutter interface {
 	PutRecord(record []byte) error
-	PutRecordBatch(records [][]byte) error
+	// PutRecordBatch always returns a non-nil BatchResult.  The error is non-nil
+	// if any record failed permanently.
+	PutRecordBatch(records [][]byte) (*BatchResult, error)
+}
+
+// RecordFailure describes a record that the stream never accepted
+type RecordFailure struct {
+	// Index of the record in the slice passed to PutRecordBatch
+	Index        int
+	ErrorCode    string
+	ErrorMessage string
+}
+
+// BatchResult reports the outcome of every record passed to PutRecordBatch.
+// All indexes refer to positions in the original records slice.
+type BatchResult struct {
+	// Records accepted by the stream, including those that needed retries
+	Succeeded []int
+	// Records that were rejected at least once before their final outcome
+	Retried []int
+	// Records that were never accepted
+	Failed []RecordFailure
+}
+
+// SentCount returns the number of records accepted by the stream
+func (r *BatchResult) SentCount() int {
+	return len(r.Succeeded)
+}
+
+// FailedCount returns the number of records that failed permanently
+func (r *BatchResult) FailedCount() int {
+	return len(r.Failed)
+}
+
+// FailedRecords returns the data of every failed record, given the slice that
+// was passed to PutRecordBatch
+func (r *BatchResult) FailedRecords(records [][]byte) [][]byte {
+	failed := make([][]byte, 0, len(r.Failed))
+	for _, f := range r.Failed {
+		failed = append(failed, records[f.Index])
+	}
+	return failed
+}
+
+// failAll marks every index in pending as failed with err
+func (r *BatchResult) failAll(pending []int, err error) {
+	code := ""
+	if aerr, ok := err.(awserr.Error); ok {
+		code = aerr.Code()
+	}
+	for _, idx := range pending {
+		r.Failed = append(r.Failed, RecordFailure{
+			Index: idx, ErrorCode: code, ErrorMessage: err.Error(),
+		})
+	}
+}
+
+// NewBatchResult returns a BatchResult where either every record succeeded or,
+// if err is non-nil, every record failed with err
+func NewBatchResult(count int, err error) *BatchResult {
+	all := make([]int, count)
+	for idx := range all {
+		all[idx] = idx
+	}
+
+	if err != nil {
+		res := &BatchResult{}
+		res.failAll(all, err)
+		return res
+	}
+	return &BatchResult{Succeeded: all}
+}
+
+// FirehoseConfig holds the settings for a Firehose stream client
+type FirehoseConfig struct {
+	// Overrides the Firehose endpoint URL, e.g. to use a local
+	// Firehose-compatible server
+	Endpoint string
+	// How rejected records are retried
+	Retry RetryPolicy
+	// What to do with records larger than FirehoseMaxRecordSize
+	Oversize OversizePolicy
 }
 
 // Firehose represents a single aws Firehose stream
 type Firehose struct {
 	client iface.FirehoseAPI
 	stream string
+	retry  RetryPolicy
+	limits Limits
+	sleep  func(time.Duration)
 }
 
-// NewFirehose returns a configured Firehose object
-func NewFirehose(region, stream string) *Firehose {
-	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion(region)))
+// NewFirehose returns a configured Firehose object.  See NewSession.
+func NewFirehose(sess *session.Session, stream string, conf FirehoseConfig) *Firehose {
 	return &Firehose{
-		client: firehose.New(sess),
+		client: firehose.New(sess, serviceConfig(conf.Endpoint)),
 		stream: stream,
+		retry:  conf.Retry,
+		limits: FirehoseLimits(conf.Oversize),
 	}
 }
 
@@ -64,43 +149,38 @@ func (f Firehose) sendRecords(records [][]byte) (*firehose.PutRecordBatchOutput,
 	return f.client.PutRecordBatch(input)
 }
 
-// PutRecordBatch sends an array of records to the Firehose stream
-// as a single batch request
-func (f Firehose) PutRecordBatch(records [][]byte) error {
-	res, err := f.sendRecords(records)
-	if err != nil {
-		return err
-	}
-
-	retries := 0
-	delay := 250
-	for *res.FailedPutCount != 0 {
-		kvlog.WarnD("retry-filed-records", logger.M{
-			"stream": f.stream, "failed-record-count": *res.FailedPutCount, "retries": retries,
-		})
-
-		time.Sleep(time.Duration(delay) * time.Millisecond)
-
-		retryRecords := [][]byte{}
-		for idx, entry := range res.RequestResponses {
-			if entry != nil && entry.ErrorMessage != nil && *entry.ErrorMessage != "" {
-				kvlog.ErrorD("failed-record", logger.M{
-					"stream": f.stream, "msg": &entry.ErrorMessage,
-				})
+// PutRecordBatch sends an array of records to the Firehose stream, split
+// into as many batch requests as Firehose's size limits require.  Rejected
+// records are retried according to the stream's RetryPolicy.
+func (f Firehose) PutRecordBatch(records [][]byte) (*BatchResult, error) {
+	return putWithinLimits(f.stream, f.limits, records, f.putBatch)
+}
 
-				retryRecords = append(retryRecords, records[idx])
-			}
+// putBatch sends records as a single batch request, retrying rejected records
+func (f Firehose) putBatch(records [][]byte, _ []int) (*BatchResult, error) {
+	return putWithRetries(f.stream, f.retry, f.sleep, len(records), func(indexes []int) ([]recordError, error) {
+		batch := make([][]byte, len(indexes))
+		for i, idx := range indexes {
+			batch[i] = records[idx]
 		}
 
-		res, err = f.sendRecords(retryRecords)
+		res, err := f.sendRecords(batch)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if retries > 4 {
-			return fmt.Errorf("Too many retries failed to put records -- stream: %s", f.stream)
+		if aws.Int64Value(res.FailedPutCount) == 0 {
+			return nil, nil
 		}
-		retries += 1
-		delay *= 2
-	}
-	return nil
+
+		outcomes := make([]recordError, len(res.RequestResponses))
+		for i, entry := range res.RequestResponses {
+			if entry != nil {
+				outcomes[i] = recordError{
+					code:    aws.StringValue(entry.ErrorCode),
+					message: aws.StringValue(entry.ErrorMessage),
+				}
+			}
+		}
+		return outcomes, nil
+	})
 }
@@ -3,7 +3,9 @@ package aws
 import (
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -17,6 +19,8 @@ func TestValidPutRecord(t *testing.T) {
 	f := Firehose{
 		client: mockFirehoseAPI,
 		stream: "test",
+		retry:  DefaultRetryPolicy(),
+		sleep:  func(time.Duration) {},
 	}
 
 	data := []byte("test")
@@ -42,6 +46,8 @@ func TestInvalidSend(t *testing.T) {
 	f := Firehose{
 		client: mockFirehoseAPI,
 		stream: "test",
+		retry:  DefaultRetryPolicy(),
+		sleep:  func(time.Duration) {},
 	}
 
 	data := []byte("test")
@@ -67,6 +73,8 @@ func TestValidPutRecordBatch(t *testing.T) {
 	f := Firehose{
 		client: mockFirehoseAPI,
 		stream: "test",
+		retry:  DefaultRetryPolicy(),
+		sleep:  func(time.Duration) {},
 	}
 
 	data := [][]byte{
@@ -87,10 +95,15 @@ func TestValidPutRecordBatch(t *testing.T) {
 	}
 
 	// Return success
-	mockFirehoseAPI.EXPECT().PutRecord(expectedInput).Return(&firehose.PutRecordOutput{}, nil)
+	mockFirehoseAPI.EXPECT().PutRecordBatch(expectedInput).Return(&firehose.PutRecordBatchOutput{
+		FailedPutCount: aws.Int64(0),
+	}, nil)
 
-	err := f.PutRecordBatch(data)
+	res, err := f.PutRecordBatch(data)
 	assert.NoError(t, err, "valid Send() failed")
+	assert.Equal(t, []int{0, 1}, res.Succeeded)
+	assert.Empty(t, res.Retried)
+	assert.Empty(t, res.Failed)
 }
 
 func TestInvalidPutRecordBatch(t *testing.T) {
@@ -101,6 +114,8 @@ func TestInvalidPutRecordBatch(t *testing.T) {
 	f := Firehose{
 		client: mockFirehoseAPI,
 		stream: "test",
+		retry:  DefaultRetryPolicy(),
+		sleep:  func(time.Duration) {},
 	}
 
 	data := [][]byte{
@@ -120,9 +135,70 @@ func TestInvalidPutRecordBatch(t *testing.T) {
 		},
 	}
 
-	// Return error
-	mockFirehoseAPI.EXPECT().PutRecordBatch(expectedInput).Return(nil, errors.New("test error"))
+	// Return error on every attempt
+	mockFirehoseAPI.EXPECT().PutRecordBatch(expectedInput).Return(nil, errors.New("test error")).Times(6)
 
-	err := f.PutRecordBatch(data)
+	res, err := f.PutRecordBatch(data)
 	assert.Error(t, err, "expected invalid Send() to fail")
+	assert.Equal(t, 0, res.SentCount())
+	assert.Equal(t, 2, res.FailedCount())
+	assert.Equal(t, "test error", res.Failed[1].ErrorMessage)
+}
+
+func TestPartiallyFailedPutRecordBatch(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockFirehoseAPI := NewMockFirehoseAPI(mockCtrl)
+
+	f := Firehose{
+		client: mockFirehoseAPI,
+		stream: "test",
+		retry:  DefaultRetryPolicy(),
+		sleep:  func(time.Duration) {},
+	}
+
+	data := [][]byte{
+		[]byte("first"),
+		[]byte("second"),
+		[]byte("third"),
+	}
+
+	firstInput := &firehose.PutRecordBatchInput{
+		DeliveryStreamName: &f.stream,
+		Records: []*firehose.Record{
+			&firehose.Record{Data: data[0]},
+			&firehose.Record{Data: data[1]},
+			&firehose.Record{Data: data[2]},
+		},
+	}
+	retryInput := &firehose.PutRecordBatchInput{
+		DeliveryStreamName: &f.stream,
+		Records: []*firehose.Record{
+			&firehose.Record{Data: data[1]},
+		},
+	}
+
+	// The second record is throttled once, then accepted
+	gomock.InOrder(
+		mockFirehoseAPI.EXPECT().PutRecordBatch(firstInput).Return(&firehose.PutRecordBatchOutput{
+			FailedPutCount: aws.Int64(1),
+			RequestResponses: []*firehose.PutRecordBatchResponseEntry{
+				&firehose.PutRecordBatchResponseEntry{RecordId: aws.String("a")},
+				&firehose.PutRecordBatchResponseEntry{
+					ErrorCode:    aws.String("ServiceUnavailableException"),
+					ErrorMessage: aws.String("Slow down."),
+				},
+				&firehose.PutRecordBatchResponseEntry{RecordId: aws.String("c")},
+			},
+		}, nil),
+		mockFirehoseAPI.EXPECT().PutRecordBatch(retryInput).Return(&firehose.PutRecordBatchOutput{
+			FailedPutCount: aws.Int64(0),
+		}, nil),
+	)
+
+	res, err := f.PutRecordBatch(data)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, res.Succeeded)
+	assert.Equal(t, []int{1}, res.Retried)
+	assert.Empty(t, res.Failed)
 }
@@ -0,0 +1,167 @@
+package aws
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	// Maximum number of records in a single Kinesis PutRecords request
+	KinesisMaxBatchRecords = 500
+	// Maximum total size of a single Kinesis PutRecords request
+	KinesisMaxBatchSize = 5 * 1024 * 1024
+	// Maximum size of a single Kinesis record, including its partition key
+	KinesisMaxRecordSize = 1024 * 1024
+	// Maximum length of a Kinesis partition key, in Unicode characters
+	KinesisMaxPartitionKeySize = 256
+	// Maximum size of a Kinesis partition key, in UTF-8 bytes
+	kinesisMaxPartitionKeyBytes = KinesisMaxPartitionKeySize * utf8.UTFMax
+)
+
+// kinesisAPI is the subset of kinesisiface.KinesisAPI used by Kinesis
+type kinesisAPI interface {
+	PutRecord(*kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error)
+	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+// KinesisConfig holds the settings for a Kinesis stream client
+type KinesisConfig struct {
+	// Overrides the Kinesis endpoint URL, e.g. to use a local
+	// Kinesis-compatible server
+	Endpoint string
+	// How rejected records are retried
+	Retry RetryPolicy
+	// What to do with records larger than KinesisMaxRecordSize
+	Oversize OversizePolicy
+}
+
+// KinesisLimits returns the limits enforced by Kinesis Data Streams.  Room is
+// left in each record for the largest possible partition key.
+func KinesisLimits(oversize OversizePolicy) Limits {
+	return Limits{
+		MaxBatchRecords: KinesisMaxBatchRecords,
+		MaxBatchSize:    KinesisMaxBatchSize - KinesisMaxBatchRecords*kinesisMaxPartitionKeyBytes,
+		MaxRecordSize:   KinesisMaxRecordSize - kinesisMaxPartitionKeyBytes,
+		Oversize:        oversize,
+	}
+}
+
+// Kinesis represents a single aws Kinesis Data Stream
+type Kinesis struct {
+	client kinesisAPI
+	stream string
+	retry  RetryPolicy
+	limits Limits
+	sleep  func(time.Duration)
+}
+
+// NewKinesis returns a configured Kinesis object.  See NewSession.
+func NewKinesis(sess *session.Session, stream string, conf KinesisConfig) *Kinesis {
+	return &Kinesis{
+		client: kinesis.New(sess, serviceConfig(conf.Endpoint)),
+		stream: stream,
+		retry:  conf.Retry,
+		limits: KinesisLimits(conf.Oversize),
+	}
+}
+
+// hashPartitionKey derives a partition key from the record's contents, which
+// spreads records evenly across shards
+func hashPartitionKey(record []byte) string {
+	h := fnv.New64a()
+	h.Write(record)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// partitionKey returns keys[idx], falling back to a hash of the record when
+// no usable key was given
+func partitionKey(record []byte, keys []string, idx int) string {
+	if idx < len(keys) && keys[idx] != "" {
+		key := keys[idx]
+		// Kinesis counts characters rather than bytes, so cut between them
+		chars := 0
+		for i := range key {
+			if chars == KinesisMaxPartitionKeySize {
+				return key[:i]
+			}
+			chars++
+		}
+		return key
+	}
+	return hashPartitionKey(record)
+}
+
+// PutRecord sends a single record to the Kinesis stream, partitioned by its
+// contents
+func (k Kinesis) PutRecord(record []byte) error {
+	input := &kinesis.PutRecordInput{
+		StreamName:   &k.stream,
+		Data:         record,
+		PartitionKey: aws.String(hashPartitionKey(record)),
+	}
+	_, err := k.client.PutRecord(input)
+	return err
+}
+
+// PutRecordBatch sends an array of records to the Kinesis stream, each
+// partitioned by its contents
+func (k Kinesis) PutRecordBatch(records [][]byte) (*BatchResult, error) {
+	return k.PutKeyedRecordBatch(records, nil)
+}
+
+// PutKeyedRecordBatch sends an array of records to the Kinesis stream, where
+// keys[i] is the partition key for records[i].  Records without a key are
+// partitioned by their contents.  Every piece of a split record gets the
+// record's key, so the pieces land on the same shard in order.  Records
+// rejected by Kinesis (e.g. because their shard is throttled) are retried
+// according to the stream's RetryPolicy.
+func (k Kinesis) PutKeyedRecordBatch(records [][]byte, keys []string) (*BatchResult, error) {
+	return putWithinLimits(k.stream, k.limits, records, func(batch [][]byte, indexes []int) (*BatchResult, error) {
+		batchKeys := make([]string, len(batch))
+		for i, idx := range indexes {
+			batchKeys[i] = partitionKey(records[idx], keys, idx)
+		}
+		return k.putBatch(batch, batchKeys)
+	})
+}
+
+// putBatch sends records as a single PutRecords request, retrying rejected records
+func (k Kinesis) putBatch(records [][]byte, keys []string) (*BatchResult, error) {
+	return putWithRetries(k.stream, k.retry, k.sleep, len(records), func(indexes []int) ([]recordError, error) {
+		entries := make([]*kinesis.PutRecordsRequestEntry, len(indexes))
+		for i, idx := range indexes {
+			entries[i] = &kinesis.PutRecordsRequestEntry{
+				Data:         records[idx],
+				PartitionKey: aws.String(keys[idx]),
+			}
+		}
+
+		res, err := k.client.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: &k.stream,
+			Records:    entries,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if aws.Int64Value(res.FailedRecordCount) == 0 {
+			return nil, nil
+		}
+
+		outcomes := make([]recordError, len(res.Records))
+		for i, entry := range res.Records {
+			if entry != nil {
+				outcomes[i] = recordError{
+					code:    aws.StringValue(entry.ErrorCode),
+					message: aws.StringValue(entry.ErrorMessage),
+				}
+			}
+		}
+		return outcomes, nil
+	})
+}
@@ -0,0 +1,107 @@
+package aws
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKinesisAPI answers PutRecords calls with the queued responses
+type fakeKinesisAPI struct {
+	inputs    []*kinesis.PutRecordsInput
+	responses []*kinesis.PutRecordsOutput
+}
+
+func (f *fakeKinesisAPI) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	return &kinesis.PutRecordOutput{}, nil
+}
+
+func (f *fakeKinesisAPI) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	f.inputs = append(f.inputs, input)
+	res := f.responses[0]
+	f.responses = f.responses[1:]
+	return res, nil
+}
+
+func TestKinesisPartitionKeys(t *testing.T) {
+	api := &fakeKinesisAPI{responses: []*kinesis.PutRecordsOutput{
+		{FailedRecordCount: aws.Int64(0)},
+	}}
+	k := Kinesis{client: api, stream: "test", retry: DefaultRetryPolicy(), sleep: noSleep}
+
+	records := [][]byte{[]byte("a"), []byte("b")}
+	res, err := k.PutKeyedRecordBatch(records, []string{"district-1", ""})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, res.Succeeded)
+
+	entries := api.inputs[0].Records
+	assert.Equal(t, "district-1", *entries[0].PartitionKey)
+	assert.Equal(t, hashPartitionKey([]byte("b")), *entries[1].PartitionKey)
+}
+
+func TestKinesisPartitionKeysAreCutBetweenCharacters(t *testing.T) {
+	t.Log("Keys over the limit keep their first 256 characters")
+	key := partitionKey(nil, []string{strings.Repeat("a", 300)}, 0)
+	assert.Equal(t, strings.Repeat("a", 256), key)
+
+	t.Log("Multi-byte characters aren't cut in half")
+	key = partitionKey(nil, []string{strings.Repeat("é", 300)}, 0)
+	assert.Equal(t, strings.Repeat("é", 256), key)
+	assert.True(t, utf8.ValidString(key))
+
+	t.Log("Keys within the limit are kept whole, whatever their size in bytes")
+	key = partitionKey(nil, []string{strings.Repeat("日", 256)}, 0)
+	assert.Equal(t, strings.Repeat("日", 256), key)
+}
+
+func TestKinesisSplitRecordsShareAPartitionKey(t *testing.T) {
+	api := &fakeKinesisAPI{responses: []*kinesis.PutRecordsOutput{
+		{FailedRecordCount: aws.Int64(0)},
+	}}
+	k := Kinesis{client: api, stream: "test", retry: DefaultRetryPolicy(), sleep: noSleep, limits: Limits{
+		MaxRecordSize: 4, Oversize: OversizeSplit,
+	}}
+
+	record := []byte("abc\ndef\n")
+	res, err := k.PutKeyedRecordBatch([][]byte{record}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, res.Succeeded)
+
+	entries := api.inputs[0].Records
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, hashPartitionKey(record), *entries[0].PartitionKey)
+	assert.Equal(t, hashPartitionKey(record), *entries[1].PartitionKey)
+}
+
+func TestKinesisRetriesThrottledShards(t *testing.T) {
+	api := &fakeKinesisAPI{responses: []*kinesis.PutRecordsOutput{
+		{
+			FailedRecordCount: aws.Int64(1),
+			Records: []*kinesis.PutRecordsResultEntry{
+				{SequenceNumber: aws.String("1"), ShardId: aws.String("shard-1")},
+				{
+					ErrorCode:    aws.String("ProvisionedThroughputExceededException"),
+					ErrorMessage: aws.String("Rate exceeded for shard shard-2"),
+				},
+			},
+		},
+		{FailedRecordCount: aws.Int64(0)},
+	}}
+	k := Kinesis{client: api, stream: "test", retry: DefaultRetryPolicy(), sleep: func(time.Duration) {}}
+
+	res, err := k.PutKeyedRecordBatch([][]byte{[]byte("a"), []byte("b")}, []string{"x", "y"})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, res.Succeeded)
+	assert.Equal(t, []int{1}, res.Retried)
+
+	t.Log("Only the throttled record is resent, with its own partition key")
+	assert.Equal(t, 2, len(api.inputs))
+	assert.Equal(t, 1, len(api.inputs[1].Records))
+	assert.Equal(t, "b", string(api.inputs[1].Records[0].Data))
+	assert.Equal(t, "y", *api.inputs[1].Records[0].PartitionKey)
+}
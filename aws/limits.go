@@ -0,0 +1,225 @@
+package aws
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+)
+
+const (
+	// Maximum number of records in a single Firehose PutRecordBatch request
+	FirehoseMaxBatchRecords = 500
+	// Maximum total size of a single Firehose PutRecordBatch request
+	FirehoseMaxBatchSize = 4 * 1024 * 1024
+	// Maximum size of a single Firehose record
+	FirehoseMaxRecordSize = 1000 * 1024
+
+	// ErrCodeRecordTooLarge is the RecordFailure code for oversized records
+	// that were rejected before being sent
+	ErrCodeRecordTooLarge = "RecordTooLarge"
+)
+
+// OversizePolicy is what happens to a record that exceeds the stream's
+// maximum record size
+type OversizePolicy string
+
+const (
+	// Split the record into several records, on newlines where possible.
+	// If any part fails, the whole record is reported as failed, even though
+	// the other parts were delivered: dead-lettering and replaying it sends
+	// those parts again, so they may be duplicated downstream.
+	OversizeSplit OversizePolicy = "split"
+	// Drop everything past the maximum record size
+	OversizeTruncate OversizePolicy = "truncate"
+	// Don't send the record, and report it as failed so that it can be
+	// dead-lettered
+	OversizeDeadLetter OversizePolicy = "dead-letter"
+	// Don't send the record, and report it as failed, for streams that have
+	// nowhere to dead-letter it
+	OversizeDrop OversizePolicy = "drop"
+)
+
+// ParseOversizePolicy validates an OversizePolicy from config
+func ParseOversizePolicy(policy string) (OversizePolicy, error) {
+	switch OversizePolicy(policy) {
+	case OversizeSplit, OversizeTruncate, OversizeDeadLetter:
+		return OversizePolicy(policy), nil
+	}
+	return "", fmt.Errorf(
+		"unknown oversize policy '%s' (expected '%s', '%s' or '%s')",
+		policy, OversizeSplit, OversizeTruncate, OversizeDeadLetter,
+	)
+}
+
+// Limits describes the request size limits of a stream
+type Limits struct {
+	MaxBatchRecords int
+	MaxBatchSize    int
+	MaxRecordSize   int
+	Oversize        OversizePolicy
+}
+
+// FirehoseLimits returns the limits enforced by Firehose
+func FirehoseLimits(oversize OversizePolicy) Limits {
+	return Limits{
+		MaxBatchRecords: FirehoseMaxBatchRecords,
+		MaxBatchSize:    FirehoseMaxBatchSize,
+		MaxRecordSize:   FirehoseMaxRecordSize,
+		Oversize:        oversize,
+	}
+}
+
+// piece is a record (or part of a record) ready to be sent
+type piece struct {
+	index int // index of the original record
+	data  []byte
+}
+
+// splitRecord breaks data into parts no larger than max, cutting after a
+// newline whenever one is available
+func splitRecord(data []byte, max int) [][]byte {
+	parts := [][]byte{}
+	for len(data) > max {
+		cut := bytes.LastIndexByte(data[:max], '\n') + 1
+		if cut <= 0 {
+			cut = max
+		}
+		parts = append(parts, data[:cut])
+		data = data[cut:]
+	}
+	if len(data) > 0 {
+		parts = append(parts, data)
+	}
+	return parts
+}
+
+// limitedBatchPutter sends a single request that respects the stream's limits.
+// indexes[i] is the index of the original record that batch[i] came from.
+type limitedBatchPutter func(batch [][]byte, indexes []int) (*BatchResult, error)
+
+// putWithinLimits sends records in as many requests as needed to respect
+// limits, applying limits.Oversize to records that are too large on their own.
+// Results are reported against the original record indexes; a split record
+// only succeeds if all its parts do (see OversizeSplit).
+func putWithinLimits(
+	stream string, limits Limits, records [][]byte, putBatch limitedBatchPutter,
+) (*BatchResult, error) {
+	result := &BatchResult{}
+
+	pieces := make([]piece, 0, len(records))
+	for idx, record := range records {
+		if limits.MaxRecordSize <= 0 || len(record) <= limits.MaxRecordSize {
+			pieces = append(pieces, piece{index: idx, data: record})
+			continue
+		}
+
+		m := logger.M{"stream": stream, "size": len(record), "max-size": limits.MaxRecordSize}
+		switch limits.Oversize {
+		case OversizeSplit:
+			kvlog.CounterD("oversized-record-split", 1, m)
+			for _, part := range splitRecord(record, limits.MaxRecordSize) {
+				pieces = append(pieces, piece{index: idx, data: part})
+			}
+		case OversizeTruncate:
+			kvlog.CounterD("oversized-record-truncated", 1, m)
+			pieces = append(pieces, piece{index: idx, data: record[:limits.MaxRecordSize]})
+		default:
+			if limits.Oversize == OversizeDrop {
+				kvlog.CounterD("oversized-record-dropped", 1, m)
+			} else {
+				kvlog.CounterD("oversized-record-dead-lettered", 1, m)
+			}
+			result.Failed = append(result.Failed, RecordFailure{
+				Index:     idx,
+				ErrorCode: ErrCodeRecordTooLarge,
+				ErrorMessage: fmt.Sprintf(
+					"record is %d bytes, over the %d byte limit", len(record), limits.MaxRecordSize,
+				),
+			})
+		}
+	}
+
+	// Group the pieces into requests that fit the batch limits
+	requests := [][]piece{}
+	current := []piece{}
+	currentSize := 0
+	for _, p := range pieces {
+		if len(current) > 0 && ((limits.MaxBatchRecords > 0 && len(current) >= limits.MaxBatchRecords) ||
+			(limits.MaxBatchSize > 0 && currentSize+len(p.data) > limits.MaxBatchSize)) {
+			requests = append(requests, current)
+			current = []piece{}
+			currentSize = 0
+		}
+		current = append(current, p)
+		currentSize += len(p.data)
+	}
+	if len(current) > 0 {
+		requests = append(requests, current)
+	}
+
+	if len(requests) > 1 {
+		kvlog.CounterD("batch-split", len(requests)-1, logger.M{"stream": stream})
+	}
+
+	failed := map[int]bool{}
+	for _, f := range result.Failed {
+		failed[f.Index] = true
+	}
+	retried := map[int]bool{}
+	succeeded := map[int]bool{}
+
+	var lastErr error
+	for _, request := range requests {
+		batch := make([][]byte, len(request))
+		indexes := make([]int, len(request))
+		for i, p := range request {
+			batch[i] = p.data
+			indexes[i] = p.index
+		}
+
+		res, err := putBatch(batch, indexes)
+		if err != nil {
+			lastErr = err
+		}
+
+		for _, i := range res.Retried {
+			retried[request[i].index] = true
+		}
+		for _, i := range res.Succeeded {
+			succeeded[request[i].index] = true
+		}
+		for _, f := range res.Failed {
+			idx := request[f.Index].index
+			if !failed[idx] {
+				failed[idx] = true
+				f.Index = idx
+				result.Failed = append(result.Failed, f)
+			}
+		}
+	}
+
+	for idx := range succeeded {
+		if !failed[idx] {
+			result.Succeeded = append(result.Succeeded, idx)
+		} else {
+			// Some parts of a split record were delivered; a replay repeats them
+			kvlog.CounterD("split-record-partly-sent", 1, logger.M{"stream": stream})
+		}
+	}
+	for idx := range retried {
+		result.Retried = append(result.Retried, idx)
+	}
+
+	sort.Ints(result.Succeeded)
+	sort.Ints(result.Retried)
+	sort.Slice(result.Failed, func(i, j int) bool {
+		return result.Failed[i].Index < result.Failed[j].Index
+	})
+
+	if len(result.Failed) > 0 && lastErr == nil {
+		lastErr = fmt.Errorf("%d records failed -- stream: %s", len(result.Failed), stream)
+	}
+	return result, lastErr
+}
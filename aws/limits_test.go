@@ -0,0 +1,136 @@
+package aws
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingPutBatch accepts every batch and remembers what it was sent
+type recordingPutBatch struct {
+	batches [][][]byte
+	err     error
+}
+
+func (r *recordingPutBatch) putBatch(batch [][]byte, indexes []int) (*BatchResult, error) {
+	r.batches = append(r.batches, batch)
+	return NewBatchResult(len(batch), r.err), r.err
+}
+
+func TestSplitRecordPrefersNewlines(t *testing.T) {
+	parts := splitRecord([]byte("aaa\nbb\ncccc\n"), 8)
+	assert.Equal(t, [][]byte{[]byte("aaa\nbb\n"), []byte("cccc\n")}, parts)
+
+	t.Log("Records without newlines are split at the limit")
+	parts = splitRecord([]byte("abcdefghij"), 4)
+	assert.Equal(t, [][]byte{[]byte("abcd"), []byte("efgh"), []byte("ij")}, parts)
+}
+
+func TestPutWithinLimitsSplitsByCount(t *testing.T) {
+	r := &recordingPutBatch{}
+	limits := Limits{MaxBatchRecords: 2, MaxBatchSize: 100, MaxRecordSize: 100}
+
+	records := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	res, err := putWithinLimits("test", limits, records, r.putBatch)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(r.batches))
+	assert.Equal(t, 2, len(r.batches[0]))
+	assert.Equal(t, 1, len(r.batches[1]))
+	assert.Equal(t, []int{0, 1, 2}, res.Succeeded)
+}
+
+func TestPutWithinLimitsSplitsBySize(t *testing.T) {
+	r := &recordingPutBatch{}
+	limits := Limits{MaxBatchRecords: 500, MaxBatchSize: 10, MaxRecordSize: 10}
+
+	records := [][]byte{[]byte("aaaaaa"), []byte("bbbbbb"), []byte("cc")}
+	_, err := putWithinLimits("test", limits, records, r.putBatch)
+	assert.NoError(t, err)
+	assert.Equal(t, [][][]byte{
+		{[]byte("aaaaaa")},
+		{[]byte("bbbbbb"), []byte("cc")},
+	}, r.batches)
+}
+
+func TestPutWithinLimitsOversizePolicies(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 10)
+	records := [][]byte{[]byte("ok"), big}
+
+	t.Log("Oversized records are split")
+	r := &recordingPutBatch{}
+	limits := Limits{MaxBatchRecords: 500, MaxBatchSize: 100, MaxRecordSize: 4, Oversize: OversizeSplit}
+	res, err := putWithinLimits("test", limits, records, r.putBatch)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(r.batches[0]))
+	assert.Equal(t, []int{0, 1}, res.Succeeded)
+
+	t.Log("Oversized records are truncated")
+	r = &recordingPutBatch{}
+	limits.Oversize = OversizeTruncate
+	res, err = putWithinLimits("test", limits, records, r.putBatch)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("ok"), []byte("xxxx")}, r.batches[0])
+	assert.Equal(t, []int{0, 1}, res.Succeeded)
+
+	t.Log("Oversized records are reported as failed")
+	r = &recordingPutBatch{}
+	limits.Oversize = OversizeDeadLetter
+	res, err = putWithinLimits("test", limits, records, r.putBatch)
+	assert.Error(t, err)
+	assert.Equal(t, [][]byte{[]byte("ok")}, r.batches[0])
+	assert.Equal(t, []int{0}, res.Succeeded)
+	assert.Equal(t, 1, res.FailedCount())
+	assert.Equal(t, 1, res.Failed[0].Index)
+	assert.Equal(t, ErrCodeRecordTooLarge, res.Failed[0].ErrorCode)
+
+	t.Log("Dropped records are reported as failed too")
+	r = &recordingPutBatch{}
+	limits.Oversize = OversizeDrop
+	res, err = putWithinLimits("test", limits, records, r.putBatch)
+	assert.Error(t, err)
+	assert.Equal(t, [][]byte{[]byte("ok")}, r.batches[0])
+	assert.Equal(t, 1, res.FailedCount())
+	assert.Equal(t, 1, res.Failed[0].Index)
+}
+
+func TestPutWithinLimitsMapsFailuresToOriginalIndexes(t *testing.T) {
+	limits := Limits{MaxBatchRecords: 1, MaxBatchSize: 100, MaxRecordSize: 100}
+	records := [][]byte{[]byte("a"), []byte("b")}
+
+	calls := 0
+	res, err := putWithinLimits("test", limits, records, func(batch [][]byte, indexes []int) (*BatchResult, error) {
+		calls += 1
+		if calls == 2 {
+			err := errors.New("test error")
+			return NewBatchResult(len(batch), err), err
+		}
+		return NewBatchResult(len(batch), nil), nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []int{0}, res.Succeeded)
+	assert.Equal(t, 1, res.Failed[0].Index)
+	assert.Equal(t, [][]byte{[]byte("b")}, res.FailedRecords(records))
+}
+
+func TestPutWithinLimitsFailsSplitRecordsThatArePartlySent(t *testing.T) {
+	limits := Limits{MaxBatchRecords: 1, MaxBatchSize: 100, MaxRecordSize: 4, Oversize: OversizeSplit}
+	records := [][]byte{[]byte("aaaabbbb")}
+
+	calls := 0
+	res, err := putWithinLimits("test", limits, records, func(batch [][]byte, indexes []int) (*BatchResult, error) {
+		calls += 1
+		if calls == 2 {
+			err := errors.New("test error")
+			return NewBatchResult(len(batch), err), err
+		}
+		return NewBatchResult(len(batch), nil), nil
+	})
+
+	t.Log("The whole record is reported as failed, so a replay resends its first part")
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Empty(t, res.Succeeded)
+	assert.Equal(t, [][]byte{[]byte("aaaabbbb")}, res.FailedRecords(records))
+}
@@ -2,6 +2,7 @@ package aws
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -24,27 +25,48 @@ func NewMockRecordPutter(stream, endpoint string) RecordPutter {
 }
 
 func (m *mockPutter) PutRecord(record []byte) error {
-	return m.PutRecordBatch([][]byte{record})
+	_, err := m.PutRecordBatch([][]byte{record})
+	return err
 }
 
-func (m *mockPutter) PutRecordBatch(records [][]byte) error {
+func (m *mockPutter) PutRecordBatch(records [][]byte) (*BatchResult, error) {
+	err := m.postRecords(records)
+	return NewBatchResult(len(records), err), err
+}
+
+func (m *mockPutter) postRecords(records [][]byte) error {
 	buf := bytes.NewBuffer([]byte{})
 	for idx, rec := range records {
-		var data map[string]interface{}
-		err := json.Unmarshal(rec, &data)
-		if err != nil {
-			return err
+		// Aggregated records can be gzipped and hold several JSON objects
+		if bytes.HasPrefix(rec, []byte{0x1f, 0x8b}) {
+			r, err := gzip.NewReader(bytes.NewReader(rec))
+			if err != nil {
+				return err
+			}
+			rec, err = ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
 		}
 
-		data["_mock.stream"] = m.stream
-		data["_mock.batch"] = idx
+		decoder := json.NewDecoder(bytes.NewReader(rec))
+		for decoder.More() {
+			var data map[string]interface{}
+			err := decoder.Decode(&data)
+			if err != nil {
+				return err
+			}
 
-		mockRec, err := json.Marshal(data)
-		if err != nil {
-			return err
-		}
+			data["_mock.stream"] = m.stream
+			data["_mock.batch"] = idx
 
-		buf.Write(mockRec)
+			mockRec, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+
+			buf.Write(mockRec)
+		}
 	}
 
 	res, err := m.client.Post(m.endpoint, "application/json", buf)
@@ -0,0 +1,216 @@
+package aws
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+)
+
+// DefaultRetryableCodes are the AWS error codes that are retried by default
+var DefaultRetryableCodes = []string{
+	"ServiceUnavailableException",
+	"InternalFailure",
+	"ThrottlingException",
+	"LimitExceededException",
+	"ProvisionedThroughputExceededException",
+	"RequestError",
+}
+
+// RetryPolicy controls how records rejected by a stream are retried
+type RetryPolicy struct {
+	// Total number of attempts for each record, including the first one
+	MaxAttempts int
+	// Delay ceiling for the first retry, doubled for every following retry
+	BaseDelay time.Duration
+	// Upper bound on any single delay (0 for no bound)
+	MaxDelay time.Duration
+	// AWS error codes that are worth retrying.  Records failing with any other
+	// code fail immediately.  Errors that aren't from AWS (e.g. a dropped
+	// connection) are always retried.
+	RetryableCodes []string
+}
+
+// DefaultRetryPolicy returns the policy used unless configured otherwise:
+// 6 attempts with delays starting at 250ms, capped at 5s
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    6,
+		BaseDelay:      250 * time.Millisecond,
+		MaxDelay:       5 * time.Second,
+		RetryableCodes: DefaultRetryableCodes,
+	}
+}
+
+var (
+	jitterLock sync.Mutex
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay returns how long to wait before the given retry (starting at 1), using
+// "full jitter": a random duration between 0 and the exponential backoff
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	ceiling := p.BaseDelay
+	for i := 1; i < retry; i++ {
+		if p.MaxDelay > 0 && ceiling >= p.MaxDelay {
+			break
+		}
+		if ceiling > math.MaxInt64/2 {
+			// Uncapped, and as long as a delay can get
+			break
+		}
+		ceiling *= 2
+	}
+	if p.MaxDelay > 0 && ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return time.Duration(jitter.Int63n(int64(ceiling) + 1))
+}
+
+// IsRetryable returns whether a record that failed with code should be retried
+func (p RetryPolicy) IsRetryable(code string) bool {
+	for _, retryable := range p.RetryableCodes {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryableError returns whether a failed request should be retried
+func (p RetryPolicy) isRetryableError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return p.IsRetryable(aerr.Code())
+	}
+	return true
+}
+
+// recordError is the outcome of a single record in a batch request.  The zero
+// value means the record was accepted.
+type recordError struct {
+	code    string
+	message string
+}
+
+func (e recordError) failed() bool {
+	return e.code != "" || e.message != ""
+}
+
+// batchSender sends the records at indexes as a single request.  The returned
+// slice holds the outcome for each index, in order; a nil slice means every
+// record was accepted.
+type batchSender func(indexes []int) ([]recordError, error)
+
+// putWithRetries sends count records through send, retrying failures according
+// to policy, and reports the outcome of each record
+func putWithRetries(
+	stream string, policy RetryPolicy, sleep func(time.Duration), count int, send batchSender,
+) (*BatchResult, error) {
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	result := &BatchResult{}
+	retried := map[int]bool{}
+	retry := func(indexes []int) {
+		for _, idx := range indexes {
+			if !retried[idx] {
+				retried[idx] = true
+				result.Retried = append(result.Retried, idx)
+			}
+		}
+	}
+
+	// pending holds the indexes of the records still to be sent
+	pending := make([]int, count)
+	for idx := range pending {
+		pending[idx] = idx
+	}
+
+	exhausted := false
+	for attempt := 1; len(pending) > 0; attempt++ {
+		outcomes, err := send(pending)
+		if err != nil {
+			if attempt >= policy.MaxAttempts || !policy.isRetryableError(err) {
+				result.failAll(pending, err)
+				exhausted = attempt >= policy.MaxAttempts
+				break
+			}
+
+			kvlog.WarnD("retry-failed-request", logger.M{
+				"stream": stream, "record-count": len(pending), "attempt": attempt,
+				"msg": err.Error(),
+			})
+			retry(pending)
+			sleep(policy.Delay(attempt))
+			continue
+		}
+
+		failures := []RecordFailure{}
+		for i, idx := range pending {
+			if i >= len(outcomes) || !outcomes[i].failed() {
+				result.Succeeded = append(result.Succeeded, idx)
+				continue
+			}
+
+			kvlog.ErrorD("failed-record", logger.M{
+				"stream": stream, "code": outcomes[i].code, "msg": outcomes[i].message,
+			})
+
+			failure := RecordFailure{
+				Index: idx, ErrorCode: outcomes[i].code, ErrorMessage: outcomes[i].message,
+			}
+			if policy.IsRetryable(failure.ErrorCode) {
+				failures = append(failures, failure)
+			} else {
+				result.Failed = append(result.Failed, failure)
+			}
+		}
+
+		if len(failures) > 0 && attempt >= policy.MaxAttempts {
+			result.Failed = append(result.Failed, failures...)
+			exhausted = true
+			break
+		}
+
+		pending = []int{}
+		for _, failure := range failures {
+			pending = append(pending, failure.Index)
+		}
+
+		if len(pending) > 0 {
+			kvlog.WarnD("retry-failed-records", logger.M{
+				"stream": stream, "failed-record-count": len(pending), "attempt": attempt,
+			})
+			retry(pending)
+			sleep(policy.Delay(attempt))
+		}
+	}
+
+	sort.Ints(result.Succeeded)
+	sort.Ints(result.Retried)
+	sort.Slice(result.Failed, func(i, j int) bool {
+		return result.Failed[i].Index < result.Failed[j].Index
+	})
+
+	if exhausted {
+		return result, fmt.Errorf("Too many retries failed to put records -- stream: %s", stream)
+	} else if len(result.Failed) > 0 {
+		return result, fmt.Errorf(
+			"%d records failed with non-retryable errors -- stream: %s", len(result.Failed), stream,
+		)
+	}
+	return result, nil
+}
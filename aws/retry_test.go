@@ -0,0 +1,103 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+func noSleep(time.Duration) {}
+
+func TestRetryDelayIsCapped(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, policy.Delay(1) <= 100*time.Millisecond)
+		assert.True(t, policy.Delay(2) <= 200*time.Millisecond)
+		assert.True(t, policy.Delay(10) <= 300*time.Millisecond)
+		assert.True(t, policy.Delay(10) >= 0)
+	}
+}
+
+func TestRetryDelayUncapped(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 10 * time.Millisecond}
+
+	longest := time.Duration(0)
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(4)
+		assert.True(t, delay <= 80*time.Millisecond)
+		if delay > longest {
+			longest = delay
+		}
+		assert.True(t, policy.Delay(100) >= 0, "doubling stops before overflowing")
+	}
+	assert.True(t, longest > 10*time.Millisecond, "delays keep doubling with no MaxDelay")
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, RetryableCodes: []string{"ServiceUnavailableException"}}
+
+	attempts := 0
+	res, err := putWithRetries("test", policy, noSleep, 2, func(indexes []int) ([]recordError, error) {
+		attempts += 1
+		outcomes := make([]recordError, len(indexes))
+		for i, idx := range indexes {
+			if idx == 1 {
+				outcomes[i] = recordError{code: "ServiceUnavailableException", message: "Slow down."}
+			}
+		}
+		return outcomes, nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []int{0}, res.Succeeded)
+	assert.Equal(t, []int{1}, res.Retried)
+	assert.Equal(t, []RecordFailure{
+		{Index: 1, ErrorCode: "ServiceUnavailableException", ErrorMessage: "Slow down."},
+	}, res.Failed)
+}
+
+func TestRetrySkipsNonRetryableCodes(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, RetryableCodes: []string{"ServiceUnavailableException"}}
+
+	attempts := 0
+	res, err := putWithRetries("test", policy, noSleep, 1, func(indexes []int) ([]recordError, error) {
+		attempts += 1
+		return []recordError{{code: "InvalidArgumentException", message: "nope"}}, nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.Empty(t, res.Retried)
+	assert.Equal(t, 1, res.FailedCount())
+}
+
+func TestRetryTransportErrors(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, RetryableCodes: []string{"RequestError"}}
+
+	t.Log("Connection errors are retried")
+	attempts := 0
+	res, err := putWithRetries("test", policy, noSleep, 2, func(indexes []int) ([]recordError, error) {
+		attempts += 1
+		if attempts == 1 {
+			return nil, errors.New("connection reset by peer")
+		}
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, []int{0, 1}, res.Succeeded)
+	assert.Equal(t, []int{0, 1}, res.Retried)
+
+	t.Log("AWS errors with codes outside the policy are not retried")
+	attempts = 0
+	res, err = putWithRetries("test", policy, noSleep, 2, func(indexes []int) ([]recordError, error) {
+		attempts += 1
+		return nil, awserr.New("ResourceNotFoundException", "no such stream", nil)
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, 2, res.FailedCount())
+}
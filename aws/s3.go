@@ -0,0 +1,83 @@
+package aws
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Config holds the settings for an S3 bucket client
+type S3Config struct {
+	Bucket string
+	// Prepended to every key
+	Prefix string
+	// Overrides the S3 endpoint URL, e.g. to use a local S3-compatible server
+	// such as MinIO
+	Endpoint string
+	// Address buckets as http://endpoint/bucket instead of
+	// http://bucket.endpoint, as most S3-compatible servers expect
+	ForcePathStyle bool
+}
+
+// s3API is the subset of the S3 client used by S3Store
+type s3API interface {
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	DeleteObject(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+}
+
+// S3Store writes objects to an S3 bucket
+type S3Store struct {
+	client s3API
+	bucket string
+	prefix string
+}
+
+// NewS3Store returns an S3Store for conf.  See NewSession.
+func NewS3Store(sess *session.Session, conf S3Config) (*S3Store, error) {
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("an S3 bucket is required")
+	}
+
+	cfg := serviceConfig(conf.Endpoint)
+	if conf.ForcePathStyle {
+		cfg = cfg.WithS3ForcePathStyle(true)
+	}
+	return &S3Store{
+		client: s3.New(sess, cfg),
+		bucket: conf.Bucket,
+		prefix: strings.Trim(conf.Prefix, "/"),
+	}, nil
+}
+
+func (s *S3Store) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// Put writes body to the object name
+func (s *S3Store) Put(name string, body []byte) error {
+	_, err := s.client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+// Delete removes the object name
+func (s *S3Store) Delete(name string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	return err
+}
+
+// URL returns the s3:// URL of the object name
+func (s *S3Store) URL(name string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(name))
+}
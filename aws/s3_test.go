@@ -0,0 +1,46 @@
+package aws
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 keeps objects in memory, keyed by "bucket/key"
+type fakeS3 struct {
+	objects map[string]string
+}
+
+func (f *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)] = string(body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestS3Store(t *testing.T) {
+	client := &fakeS3{objects: map[string]string{}}
+	store := &S3Store{client: client, bucket: "staging", prefix: "heka/redshift"}
+
+	assert.NoError(t, store.Put("events/1.csv.gz", []byte("data")))
+	assert.Equal(t, map[string]string{"staging/heka/redshift/events/1.csv.gz": "data"}, client.objects)
+	assert.Equal(t, "s3://staging/heka/redshift/events/1.csv.gz", store.URL("events/1.csv.gz"))
+
+	assert.NoError(t, store.Delete("events/1.csv.gz"))
+	assert.Empty(t, client.objects)
+}
+
+func TestNewS3StoreNeedsBucket(t *testing.T) {
+	_, err := NewS3Store(nil, S3Config{})
+	assert.Error(t, err)
+}
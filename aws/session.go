@@ -0,0 +1,81 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// SessionConfig describes how to authenticate with AWS.  Streams created from
+// the same session share its credentials.
+type SessionConfig struct {
+	// AWS region the streams live in
+	Region string
+
+	// Static credentials.  If unset, credentials come from Profile or the
+	// SDK's default chain (env vars, shared credentials file, instance role).
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Named profile from the shared credentials and config files
+	Profile string
+
+	// IAM role to assume with the credentials above, e.g. for streams that
+	// belong to another account
+	AssumeRoleARN         string
+	AssumeRoleSessionName string
+	AssumeRoleExternalID  string
+}
+
+// NewSession returns an AWS session for conf
+func NewSession(conf SessionConfig) (*session.Session, error) {
+	cfg := aws.NewConfig().WithRegion(conf.Region)
+
+	if conf.AccessKeyID != "" || conf.SecretAccessKey != "" {
+		if conf.AccessKeyID == "" || conf.SecretAccessKey == "" {
+			return nil, fmt.Errorf("static credentials need both an access key id and a secret access key")
+		}
+		if conf.Profile != "" {
+			return nil, fmt.Errorf("static credentials and a profile cannot both be set")
+		}
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(
+			conf.AccessKeyID, conf.SecretAccessKey, conf.SessionToken,
+		))
+	}
+
+	opts := session.Options{Config: *cfg, Profile: conf.Profile}
+	if conf.Profile != "" {
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.AssumeRoleARN != "" {
+		creds := stscreds.NewCredentials(sess, conf.AssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if conf.AssumeRoleSessionName != "" {
+				p.RoleSessionName = conf.AssumeRoleSessionName
+			}
+			if conf.AssumeRoleExternalID != "" {
+				p.ExternalID = aws.String(conf.AssumeRoleExternalID)
+			}
+		})
+		sess = sess.Copy(aws.NewConfig().WithCredentials(creds))
+	}
+
+	return sess, nil
+}
+
+// serviceConfig returns the client config overrides for a stream client
+func serviceConfig(endpoint string) *aws.Config {
+	cfg := aws.NewConfig()
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	return cfg
+}
@@ -0,0 +1,20 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSessionValidatesStaticCredentials(t *testing.T) {
+	_, err := NewSession(SessionConfig{Region: "us-west-1", AccessKeyID: "AKID"})
+	assert.Error(t, err, "expected a missing secret access key to fail")
+
+	_, err = NewSession(SessionConfig{
+		Region: "us-west-1", AccessKeyID: "AKID", SecretAccessKey: "secret", Profile: "dev",
+	})
+	assert.Error(t, err, "expected static credentials and a profile to fail")
+
+	_, err = NewSession(SessionConfig{Region: "us-west-1", AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	assert.NoError(t, err)
+}
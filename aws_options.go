@@ -0,0 +1,250 @@
+package heka_clever_plugins
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/Clever/heka-clever-plugins/deadletter"
+)
+
+// AWSConfig holds the connection and retry settings of the outputs that write
+// to AWS streams.  Output configs embed it, so its settings sit at the top
+// level of the output's TOML section.
+type AWSConfig struct {
+	// AWS region the stream lives in
+	Region string `toml:"region"`
+	// Static AWS credentials.  If unset, credentials come from `profile` or
+	// the default chain (env vars, shared credentials file, instance role).
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// Named profile from the shared AWS credentials and config files
+	Profile string `toml:"profile"`
+	// IAM role to assume, e.g. for a stream in another account
+	AssumeRoleARN string `toml:"assume_role_arn"`
+	// Session name used when assuming the role (default "heka")
+	AssumeRoleSessionName string `toml:"assume_role_session_name"`
+	// External ID required by the role's trust policy, if any
+	AssumeRoleExternalID string `toml:"assume_role_external_id"`
+	// Overrides the stream's endpoint URL, e.g. to use a local
+	// Firehose- or Kinesis-compatible server
+	EndpointURL string `toml:"endpoint_url"`
+	// Total number of attempts for records the stream rejects (default 6)
+	RetryMaxAttempts int `toml:"retry_max_attempts"`
+	// Backoff ceiling before the first retry, in milliseconds (default 250).
+	// The ceiling doubles for each following retry, and every delay is picked
+	// at random between 0 and the ceiling.
+	RetryBaseDelay uint32 `toml:"retry_base_delay"`
+	// Upper bound on any single retry delay, in milliseconds (default 5000)
+	RetryMaxDelay uint32 `toml:"retry_max_delay"`
+	// AWS error codes that are retried (defaults to ServiceUnavailableException,
+	// InternalFailure, throttling and connection errors)
+	RetryErrorCodes []string `toml:"retry_error_codes"`
+}
+
+func defaultAWSConfig() AWSConfig {
+	return AWSConfig{
+		AssumeRoleSessionName: "heka",
+		RetryMaxAttempts:      6,
+		RetryBaseDelay:        250,
+		RetryMaxDelay:         5000,
+		RetryErrorCodes:       aws.DefaultRetryableCodes,
+	}
+}
+
+func (c *AWSConfig) sessionConfig() aws.SessionConfig {
+	return aws.SessionConfig{
+		Region:                c.Region,
+		AccessKeyID:           c.AccessKeyID,
+		SecretAccessKey:       c.SecretAccessKey,
+		SessionToken:          c.SessionToken,
+		Profile:               c.Profile,
+		AssumeRoleARN:         c.AssumeRoleARN,
+		AssumeRoleSessionName: c.AssumeRoleSessionName,
+		AssumeRoleExternalID:  c.AssumeRoleExternalID,
+	}
+}
+
+// retryPolicy validates the retry settings
+func (c *AWSConfig) retryPolicy() (aws.RetryPolicy, error) {
+	if c.RetryMaxAttempts < 1 {
+		return aws.RetryPolicy{}, fmt.Errorf("retry_max_attempts must be at least 1")
+	}
+	// A max delay of 0 leaves delays uncapped
+	if c.RetryMaxDelay != 0 && c.RetryMaxDelay < c.RetryBaseDelay {
+		return aws.RetryPolicy{}, fmt.Errorf("retry_max_delay cannot be less than retry_base_delay")
+	}
+
+	return aws.RetryPolicy{
+		MaxAttempts:    c.RetryMaxAttempts,
+		BaseDelay:      time.Duration(c.RetryBaseDelay) * time.Millisecond,
+		MaxDelay:       time.Duration(c.RetryMaxDelay) * time.Millisecond,
+		RetryableCodes: c.RetryErrorCodes,
+	}, nil
+}
+
+// StreamBackendConfig holds the settings of the backend an output's records
+// are written to
+type StreamBackendConfig struct {
+	// Where records are written: "aws" (default), "http-mock" (POSTs to
+	// mock_endpoint), "file" (writes to file_backend_dir), "stdout", or any
+	// backend registered with aws.RegisterBackend
+	Backend string `toml:"backend"`
+	// URL the "http-mock" backend POSTs records to
+	MockEndpoint string `toml:"mock_endpoint"`
+	// Directory the "file" backend writes to
+	FileBackendDir string `toml:"file_backend_dir"`
+	// Rotate "file" backend files at this size (in bytes, 0 disables)
+	FileBackendMaxSize int64 `toml:"file_backend_max_size"`
+	// Rotate "file" backend files at this age, even if nothing more is
+	// written to them (in seconds, 0 disables)
+	FileBackendRotateInterval uint32 `toml:"file_backend_rotate_interval"`
+	// Gzip "file" backend files
+	FileBackendGzip bool `toml:"file_backend_gzip"`
+	// Settings for third-party backends
+	BackendOptions map[string]string `toml:"backend_options"`
+}
+
+func defaultStreamBackendConfig() StreamBackendConfig {
+	return StreamBackendConfig{Backend: "aws"}
+}
+
+// awsBackendConfig returns the backend settings, with sess for the "aws"
+// backend
+func (c *StreamBackendConfig) awsBackendConfig(sess aws.SessionConfig) aws.BackendConfig {
+	return aws.BackendConfig{
+		Session:      sess,
+		MockEndpoint: c.MockEndpoint,
+		Dir:          c.FileBackendDir,
+		File: aws.FileConfig{
+			MaxFileSize: c.FileBackendMaxSize,
+			MaxFileAge:  time.Duration(c.FileBackendRotateInterval) * time.Second,
+			Gzip:        c.FileBackendGzip,
+		},
+		Options: c.BackendOptions,
+	}
+}
+
+// FirehoseDeliveryConfig holds the settings shared by the Firehose outputs:
+// where records are written, how they're encoded, and what happens to those
+// that can't be delivered
+type FirehoseDeliveryConfig struct {
+	AWSConfig
+	StreamBackendConfig
+	// How records are written: "json" (the default), "csv", "tsv" or "avro"
+	RecordFormat string `toml:"record_format"`
+	// Columns written to each record, in order.  Required for "csv" and
+	// "tsv"; for "json", limits records to these keys.
+	RecordColumns []string `toml:"record_columns"`
+	// Avro schema (a JSON .avsc file) of the records, required for "avro"
+	AvroSchemaFile string `toml:"avro_schema_file"`
+	// Directory where records that Firehose permanently rejects are written.
+	// Dead-lettering is disabled if empty.
+	DeadLetterDir string `toml:"dead_letter_dir"`
+	// Size in bytes at which dead-letter files are rotated
+	// (default to 64 * 1024 * 1024 (64mb))
+	DeadLetterMaxFileSize int64 `toml:"dead_letter_max_file_size"`
+	// Interval at which dead-lettered records are replayed into their streams,
+	// in seconds (default 0, i.e. never)
+	DeadLetterReplayInterval uint32 `toml:"dead_letter_replay_interval"`
+	// Replay dead-lettered records when the output starts (default false)
+	DeadLetterReplayOnStart bool `toml:"dead_letter_replay_on_start"`
+	// Records that have failed this many times, counting their first put, are
+	// moved to the dead-letter directory's poison.jsonl instead of being
+	// replayed, as are records that failed with a non-retryable error code
+	// (default 10, 0 replays forever)
+	DeadLetterMaxAttempts int `toml:"dead_letter_max_attempts"`
+	// What to do with records over Firehose's 1000 KiB limit: "split" them
+	// on newlines, "truncate" them or "dead-letter" them (default)
+	OversizeRecordPolicy string `toml:"oversize_record_policy"`
+	// Pack several newline-delimited records into each Firehose record
+	// (default false)
+	AggregateRecords bool `toml:"aggregate_records"`
+	// Maximum size of an aggregated record before compression, in bytes
+	// (default to 1000 * 1024, Firehose's record size limit)
+	AggregateMaxSize int `toml:"aggregate_max_size"`
+	// Gzip each record sent to Firehose (default false)
+	GzipRecords bool `toml:"gzip_records"`
+}
+
+func defaultFirehoseDeliveryConfig() FirehoseDeliveryConfig {
+	return FirehoseDeliveryConfig{
+		AWSConfig:             defaultAWSConfig(),
+		StreamBackendConfig:   defaultStreamBackendConfig(),
+		RecordFormat:          "json",
+		DeadLetterMaxFileSize: 64 * 1024 * 1024,
+		DeadLetterMaxAttempts: 10,
+		OversizeRecordPolicy:  string(aws.OversizeDeadLetter),
+		AggregateMaxSize:      aws.FirehoseMaxRecordSize,
+	}
+}
+
+// firehoseConfig validates the retry, oversize and aggregation settings.
+// Size limits are checked after records are aggregated and gzipped, so those
+// options can't be combined with policies that cut records into pieces: the
+// pieces wouldn't be valid gzip, or would cut aggregated records apart.
+func (c *FirehoseDeliveryConfig) firehoseConfig() (aws.FirehoseConfig, error) {
+	if c.AggregateMaxSize > aws.FirehoseMaxRecordSize {
+		return aws.FirehoseConfig{}, fmt.Errorf("AggregateMaxSize cannot exceed %d bytes", aws.FirehoseMaxRecordSize)
+	}
+
+	retry, err := c.retryPolicy()
+	if err != nil {
+		return aws.FirehoseConfig{}, err
+	}
+
+	oversizePolicy, err := aws.ParseOversizePolicy(c.OversizeRecordPolicy)
+	if err != nil {
+		return aws.FirehoseConfig{}, err
+	}
+	if oversizePolicy == aws.OversizeSplit || oversizePolicy == aws.OversizeTruncate {
+		if c.AggregateRecords {
+			return aws.FirehoseConfig{}, fmt.Errorf(
+				"aggregate_records can't be used with oversize_record_policy '%s'", oversizePolicy,
+			)
+		}
+		if c.GzipRecords {
+			return aws.FirehoseConfig{}, fmt.Errorf(
+				"gzip_records can't be used with oversize_record_policy '%s'", oversizePolicy,
+			)
+		}
+	}
+
+	return aws.FirehoseConfig{
+		Endpoint: c.EndpointURL,
+		Retry:    retry,
+		Oversize: oversizePolicy,
+	}, nil
+}
+
+func (c *FirehoseDeliveryConfig) backendConfig(firehoseConf aws.FirehoseConfig) aws.BackendConfig {
+	conf := c.awsBackendConfig(c.sessionConfig())
+	conf.Firehose = firehoseConf
+	return conf
+}
+
+// deadLetterQueue opens the dead-letter directory, or returns nil if
+// dead-lettering is disabled.  Records that failed with codes retry doesn't
+// retry are moved straight to the poison file.
+func (c *FirehoseDeliveryConfig) deadLetterQueue(retry aws.RetryPolicy) (*deadletter.Queue, error) {
+	if c.DeadLetterDir == "" {
+		return nil, nil
+	}
+	return deadletter.New(c.DeadLetterDir, deadletter.Config{
+		MaxFileSize: c.DeadLetterMaxFileSize,
+		MaxAttempts: c.DeadLetterMaxAttempts,
+		Retryable:   retry.IsRetryable,
+	})
+}
+
+// wrapClient applies the record aggregation and compression options to client
+func (c *FirehoseDeliveryConfig) wrapClient(client aws.RecordPutter) aws.RecordPutter {
+	if c.AggregateRecords {
+		return aws.NewAggregator(client, c.AggregateMaxSize, c.GzipRecords)
+	} else if c.GzipRecords {
+		// An aggregator with no room to aggregate gzips records one by one
+		return aws.NewAggregator(client, 0, true)
+	}
+	return client
+}
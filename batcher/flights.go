@@ -0,0 +1,119 @@
+package batcher
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats reports how much a batcher is being held back by slow flushes
+type Stats struct {
+	// Flushes currently running
+	InFlight int
+	// Batches that had to wait for a flush to finish before being flushed,
+	// and the total time they waited
+	FlushWaits    int64
+	FlushWaitTime time.Duration
+	// Sends that found the batcher's buffer full, and so blocked until the
+	// batcher caught up
+	BlockedSends int64
+}
+
+// flights limits how many Sync.Flush calls run at once.  start is only called
+// from the batcher goroutine.
+type flights struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	max      int
+	ordered  bool
+	inFlight int
+
+	waits    int64
+	waitTime int64
+	running  sync.WaitGroup
+	// Closed once the most recently started flush has completed
+	last chan struct{}
+}
+
+func newFlights() *flights {
+	f := &flights{max: 1, ordered: true, last: make(chan struct{})}
+	f.cond = sync.NewCond(&f.lock)
+	close(f.last)
+	return f
+}
+
+func (f *flights) configure(max int, ordered bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if max < 1 {
+		max = 1
+	}
+	f.max = max
+	f.ordered = ordered
+	f.cond.Broadcast()
+}
+
+// start runs flush once fewer than max flushes are in flight.  With a max of
+// one, flush runs inline, so a slow flush holds back the batcher.  Otherwise
+// it runs in its own goroutine.  With ordered completion, a flush's slot is
+// only freed once every earlier flush has completed, so no batch gets more
+// than max batches ahead of the oldest unfinished one.
+func (f *flights) start(flush func()) {
+	f.lock.Lock()
+	if f.inFlight >= f.max {
+		began := time.Now()
+		for f.inFlight >= f.max {
+			f.cond.Wait()
+		}
+		atomic.AddInt64(&f.waits, 1)
+		atomic.AddInt64(&f.waitTime, int64(time.Since(began)))
+	}
+	f.inFlight++
+	concurrent := f.max > 1
+	ordered := f.ordered
+	f.lock.Unlock()
+
+	prev := f.last
+	done := make(chan struct{})
+	f.last = done
+
+	f.running.Add(1)
+	run := func() {
+		defer f.running.Done()
+
+		flush()
+		if ordered {
+			<-prev
+		}
+
+		f.lock.Lock()
+		f.inFlight--
+		f.cond.Signal()
+		f.lock.Unlock()
+		close(done)
+	}
+
+	if concurrent {
+		go run()
+	} else {
+		run()
+	}
+}
+
+// wait blocks until every flush has completed
+func (f *flights) wait() {
+	f.running.Wait()
+}
+
+func (f *flights) stats() Stats {
+	f.lock.Lock()
+	inFlight := f.inFlight
+	f.lock.Unlock()
+
+	return Stats{
+		InFlight:      inFlight,
+		FlushWaits:    atomic.LoadInt64(&f.waits),
+		FlushWaitTime: time.Duration(atomic.LoadInt64(&f.waitTime)),
+	}
+}
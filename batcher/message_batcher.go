@@ -1,119 +1,423 @@
 package batcher
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrClosed is returned when using a batcher after it has been closed
+var ErrClosed = errors.New("batcher is closed")
+
 type Sync interface {
-	Flush(batch [][]byte)
+	// Flush is passed each batch along with the queue cursor of every message
+	// in it (cursors[i] belongs to batch[i])
+	Flush(batch [][]byte, cursors []string)
 }
 
-type Batcher interface {
-	// Interval at which accumulated messages should be bulk put to
+// Options configures a batcher
+type Options struct {
+	// Maximum time a message waits in a batch before it is bulk put to
 	// firehose (default 1 second).
-	FlushInterval(dur time.Duration)
+	FlushInterval time.Duration
 	// Number of messages that triggers a push to firehose
-	// default to 10
-	FlushCount(count int)
+	// default to 10.  Counts below 1 flush every message.
+	FlushCount int
 	// Size of batch that triggers a push to firehose
-	// default to 1mb (1024 * 1024)
+	// default to 1mb (1024 * 1024).  Sizes below 1 flush every message.
+	FlushSize int
+	// Minimum age of the oldest message in a batch before it's sent, even
+	// when the batch is full (default 0).  This caps how often a batcher
+	// flushes; while a full batch waits, new messages queue up in front of
+	// the batcher.
+	FlushMinAge time.Duration
+	// Number of batches that may be flushed at once (default 1).  With
+	// ordered completion (the default), a batch only frees its slot once
+	// every earlier batch has been flushed.
+	FlushConcurrency int
+	FlushOrdered     bool
+}
+
+// withMinimums raises a FlushCount or FlushSize below 1 to 1.  An empty
+// batch would otherwise be full, and never sent or added to.
+func (opts Options) withMinimums() Options {
+	if opts.FlushCount < 1 {
+		opts.FlushCount = 1
+	}
+	if opts.FlushSize < 1 {
+		opts.FlushSize = 1
+	}
+	return opts
+}
+
+// DefaultOptions returns the options used by New
+func DefaultOptions() Options {
+	return Options{
+		FlushInterval:    time.Second,
+		FlushCount:       10,
+		FlushSize:        1024 * 1024,
+		FlushConcurrency: 1,
+		FlushOrdered:     true,
+	}
+}
+
+// Batcher's setters are safe to call while the batcher is running.  Changes
+// are applied by the batcher goroutine, and take effect before they return.
+type Batcher interface {
+	FlushInterval(dur time.Duration)
+	FlushCount(count int)
 	FlushSize(size int)
+	FlushMinAge(dur time.Duration)
+	FlushConcurrency(count int, ordered bool)
+	// Reconfigure replaces every option at once
+	Reconfigure(opts Options)
 
 	// Messages for length 0 are ignored
 	Send(msg []byte) error
+	// Same as Send, but cursor is handed to Sync.Flush along with the message
+	SendWithCursor(msg []byte, cursor string) error
 	Flush()
+	// Close flushes every message already sent, waits for every Sync.Flush to
+	// return, and stops the batcher.  If ctx expires first, Close returns its
+	// error and the final flush finishes in the background.  Sends still
+	// waiting on the batcher return ErrClosed once Close is called.
+	Close(ctx context.Context) error
+	// Stats reports back-pressure from slow flushes
+	Stats() Stats
+}
+
+type message struct {
+	data     []byte
+	cursor   string
+	received time.Time
 }
 
 type batcher struct {
-	flushInterval time.Duration
-	flushCount    int
-	flushSize     int
+	// Only read and written by the batcher goroutine once it has started
+	opts Options
 
+	clock     Clock
 	sync      Sync
-	msgChan   chan<- []byte
+	flights   *flights
+	msgChan   chan<- message
 	flushChan chan<- struct{}
+	optsChan  chan<- func(*Options)
+	closeChan chan<- struct{}
+	doneChan  <-chan struct{}
+
+	// Closed once Close is called, so that sends waiting on the batcher
+	// goroutine give up
+	closing   chan struct{}
+	closeOnce sync.Once
+	// Held (for reading) while sending to the batcher goroutine, so it can't
+	// be stopped with a send in progress
+	closeLock sync.RWMutex
+
+	blockedSends int64
 }
 
 func New(sync Sync) *batcher {
-	msgChan := make(chan []byte, 100)
+	return NewWithOptions(sync, DefaultOptions())
+}
+
+func NewWithOptions(sync Sync, opts Options) *batcher {
+	return newBatcher(sync, opts, realClock{})
+}
+
+func newBatcher(sync Sync, opts Options, clock Clock) *batcher {
+	msgChan := make(chan message, 100)
 	flushChan := make(chan struct{})
+	optsChan := make(chan func(*Options))
+	closeChan := make(chan struct{})
+	doneChan := make(chan struct{})
 
 	b := &batcher{
-		flushCount:    10,
-		flushInterval: time.Second,
-		flushSize:     1024 * 1024,
+		opts: opts.withMinimums(),
 
+		clock:     clock,
 		sync:      sync,
+		flights:   newFlights(),
 		msgChan:   msgChan,
 		flushChan: flushChan,
+		optsChan:  optsChan,
+		closeChan: closeChan,
+		doneChan:  doneChan,
+		closing:   make(chan struct{}),
 	}
+	b.flights.configure(opts.FlushConcurrency, opts.FlushOrdered)
 
-	go b.startBatcher(msgChan, flushChan)
+	go b.startBatcher(msgChan, flushChan, optsChan, closeChan, doneChan)
 
 	return b
 }
 
 func (b *batcher) FlushInterval(dur time.Duration) {
-	b.flushInterval = dur
+	b.update(func(opts *Options) { opts.FlushInterval = dur })
 }
 
 func (b *batcher) FlushCount(count int) {
-	b.flushCount = count
+	b.update(func(opts *Options) { opts.FlushCount = count })
 }
 
 func (b *batcher) FlushSize(size int) {
-	b.flushSize = size
+	b.update(func(opts *Options) { opts.FlushSize = size })
+}
+
+func (b *batcher) FlushMinAge(dur time.Duration) {
+	b.update(func(opts *Options) { opts.FlushMinAge = dur })
+}
+
+func (b *batcher) FlushConcurrency(count int, ordered bool) {
+	b.update(func(opts *Options) {
+		opts.FlushConcurrency = count
+		opts.FlushOrdered = ordered
+	})
+}
+
+func (b *batcher) Reconfigure(opts Options) {
+	b.update(func(current *Options) { *current = opts })
+}
+
+// update hands change to the batcher goroutine, and waits for it to be applied
+func (b *batcher) update(change func(*Options)) {
+	b.closeLock.RLock()
+	defer b.closeLock.RUnlock()
+
+	select {
+	case b.optsChan <- change:
+	case <-b.closing:
+	}
+}
+
+func (b *batcher) Stats() Stats {
+	stats := b.flights.stats()
+	stats.BlockedSends = atomic.LoadInt64(&b.blockedSends)
+	return stats
 }
 
 func (b *batcher) Send(msg []byte) error {
+	return b.SendWithCursor(msg, "")
+}
+
+func (b *batcher) SendWithCursor(msg []byte, cursor string) error {
 	if len(msg) <= 0 {
 		return fmt.Errorf("Empty messages can't be sent")
 	}
 
-	b.msgChan <- msg
-	return nil
+	b.closeLock.RLock()
+	defer b.closeLock.RUnlock()
+	if b.isClosing() {
+		return ErrClosed
+	}
+
+	if len(b.msgChan) == cap(b.msgChan) {
+		atomic.AddInt64(&b.blockedSends, 1)
+	}
+	select {
+	case b.msgChan <- message{data: msg, cursor: cursor}:
+		return nil
+	case <-b.closing:
+		return ErrClosed
+	}
 }
 
 func (b *batcher) Flush() {
-	b.flushChan <- struct{}{}
+	b.closeLock.RLock()
+	defer b.closeLock.RUnlock()
+
+	select {
+	case b.flushChan <- struct{}{}:
+	case <-b.closing:
+	}
+}
+
+func (b *batcher) isClosing() bool {
+	select {
+	case <-b.closing:
+		return true
+	default:
+		return false
+	}
 }
 
-func (b *batcher) batchSize(batch [][]byte) int {
-	total := 0
-	for _, msg := range batch {
-		total += len(msg)
+func (b *batcher) Close(ctx context.Context) error {
+	first := false
+	b.closeOnce.Do(func() {
+		first = true
+		close(b.closing)
+
+		// Sends in progress give up or complete now that closing is closed.
+		// Once they're done, whatever is buffered is all the batcher
+		// goroutine has left to flush.
+		go func() {
+			b.closeLock.Lock()
+			defer b.closeLock.Unlock()
+			close(b.closeChan)
+		}()
+	})
+	if !first {
+		return ErrClosed
 	}
 
-	return total
+	select {
+	case <-b.doneChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pending is the batch being built by the batcher goroutine
+type pending struct {
+	data    [][]byte
+	cursors []string
+	size    int
+	// When the oldest message in the batch arrived
+	started time.Time
 }
 
-func (b *batcher) sendBatch(batch [][]byte) [][]byte {
-	if len(batch) > 0 {
-		b.sync.Flush(batch)
+func (p *pending) add(msg message) {
+	if len(p.data) == 0 {
+		p.started = msg.received
+	}
+	p.data = append(p.data, msg.data)
+	p.cursors = append(p.cursors, msg.cursor)
+	p.size += len(msg.data)
+}
+
+func (b *batcher) full(batch *pending) bool {
+	return b.opts.FlushCount <= len(batch.data) || b.opts.FlushSize <= batch.size
+}
+
+// fits reports whether msg can join batch without going over flushSize
+func (b *batcher) fits(batch *pending, msg message) bool {
+	return len(batch.data) == 0 || batch.size+len(msg.data) <= b.opts.FlushSize
+}
+
+func (b *batcher) sendBatch(batch *pending) {
+	if len(batch.data) > 0 {
+		data, cursors := batch.data, batch.cursors
+		b.flights.start(func() { b.sync.Flush(data, cursors) })
+	}
+	*batch = pending{}
+}
+
+// deadline returns when batch must next be looked at: once it's old enough to
+// send if it's full, or once its oldest message reaches the flush interval
+func (b *batcher) deadline(batch *pending, held bool) time.Time {
+	if held || b.full(batch) {
+		return batch.started.Add(b.opts.FlushMinAge)
+	}
+
+	maxAge := b.opts.FlushInterval
+	if maxAge < b.opts.FlushMinAge {
+		maxAge = b.opts.FlushMinAge
 	}
-	return [][]byte{}
+	return batch.started.Add(maxAge)
 }
 
-func (b *batcher) startBatcher(msgChan <-chan []byte, flushChan <-chan struct{}) {
-	batch := [][]byte{}
+func (b *batcher) startBatcher(
+	msgChan <-chan message, flushChan <-chan struct{}, optsChan <-chan func(*Options),
+	closeChan <-chan struct{}, doneChan chan<- struct{},
+) {
+	defer close(doneChan)
+
+	batch := &pending{}
+	// A message that didn't fit in the current batch, waiting for it to be sent
+	var held *message
+
+	var timer Timer
+	var timerDeadline time.Time
+	stopTimer := func() {
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+	}
+	defer stopTimer()
+
+	sendAndRefill := func() {
+		b.sendBatch(batch)
+		if held != nil {
+			batch.add(*held)
+			held = nil
+		}
+	}
 
 	for {
-		select {
-		case <-time.After(b.flushInterval):
-			batch = b.sendBatch(batch)
-		case <-flushChan:
-			batch = b.sendBatch(batch)
-		case msg := <-msgChan:
-			size := b.batchSize(batch)
-			if b.flushSize < size+len(msg) {
-				batch = b.sendBatch(batch)
+		// Send the batch once it's due, otherwise wake up when it will be
+		var timerChan <-chan time.Time
+		if len(batch.data) > 0 {
+			deadline := b.deadline(batch, held != nil)
+			if !b.clock.Now().Before(deadline) {
+				sendAndRefill()
+				continue
+			}
+
+			if timer == nil || !deadline.Equal(timerDeadline) {
+				stopTimer()
+				timer = b.clock.NewTimer(deadline.Sub(b.clock.Now()))
+				timerDeadline = deadline
 			}
+			timerChan = timer.C()
+		} else {
+			stopTimer()
+		}
 
-			batch = append(batch, msg)
+		// Leave messages buffered while a full batch waits out its minimum age
+		intake := msgChan
+		if held != nil || b.full(batch) {
+			intake = nil
+		}
+
+		select {
+		case <-closeChan:
+			// No more sends can start, so whatever is buffered is all there
+			// is.  Send it as quickly as possible, regardless of batch age.
+			addNow := func(msg message) {
+				if !b.fits(batch, msg) {
+					b.sendBatch(batch)
+				}
+				batch.add(msg)
+				if b.full(batch) {
+					b.sendBatch(batch)
+				}
+			}
 
-			if b.flushCount <= len(batch) || b.flushSize <= b.batchSize(batch) {
-				batch = b.sendBatch(batch)
+			if b.full(batch) {
+				b.sendBatch(batch)
+			}
+			if held != nil {
+				addNow(*held)
+			}
+			for {
+				select {
+				case msg := <-msgChan:
+					addNow(msg)
+				default:
+					b.sendBatch(batch)
+					b.flights.wait()
+					return
+				}
+			}
+		case <-timerChan:
+			timer = nil
+		case <-flushChan:
+			sendAndRefill()
+		case change := <-optsChan:
+			// The batch is checked against the new options on the next loop
+			change(&b.opts)
+			b.opts = b.opts.withMinimums()
+			b.flights.configure(b.opts.FlushConcurrency, b.opts.FlushOrdered)
+		case msg := <-intake:
+			msg.received = b.clock.Now()
+			if b.fits(batch, msg) {
+				batch.add(msg)
+			} else {
+				held = &msg
 			}
 		}
 	}
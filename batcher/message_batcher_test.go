@@ -1,7 +1,10 @@
 package batcher
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,17 +16,20 @@ type batch [][]byte
 type mockSync struct {
 	flushChan chan struct{}
 	batches   []batch
+	cursors   [][]string
 }
 
 func NewMockSync() *mockSync {
 	return &mockSync{
 		flushChan: make(chan struct{}, 1),
 		batches:   []batch{},
+		cursors:   [][]string{},
 	}
 }
 
-func (m *mockSync) Flush(b [][]byte) {
+func (m *mockSync) Flush(b [][]byte, cursors []string) {
 	m.batches = append(m.batches, batch(b))
+	m.cursors = append(m.cursors, cursors)
 	m.flushChan <- struct{}{}
 }
 
@@ -184,3 +190,436 @@ func TestSendingEmpty(t *testing.T) {
 	err = batcher.Send([]byte{})
 	assert.Error(err)
 }
+
+func TestSendingWithCursor(t *testing.T) {
+	var err error
+	assert := assert.New(t)
+
+	sync := NewMockSync()
+	batcher := New(sync)
+	batcher.FlushInterval(time.Hour)
+	batcher.FlushCount(2)
+
+	t.Log("Cursors are flushed along with their messages")
+	assert.NoError(batcher.SendWithCursor([]byte("hihi"), "0:10"))
+	assert.NoError(batcher.Send([]byte("heyhey")))
+
+	err = sync.waitForFlush(time.Millisecond * 10)
+	assert.NoError(err)
+
+	assert.Equal(1, len(sync.cursors))
+	assert.Equal([]string{"0:10", ""}, sync.cursors[0])
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+
+	sync := NewMockSync()
+	batcher := New(sync)
+	batcher.FlushInterval(time.Hour)
+	batcher.FlushCount(2000000)
+
+	t.Log("Closing flushes pending messages and waits for the flush")
+	assert.NoError(batcher.Send([]byte("hihi")))
+	assert.NoError(batcher.Send([]byte("heyhey")))
+	assert.NoError(batcher.Close(context.Background()))
+
+	assert.Equal(1, len(sync.batches))
+	assert.Equal([][]byte{[]byte("hihi"), []byte("heyhey")}, [][]byte(sync.batches[0]))
+
+	t.Log("A closed batcher refuses messages")
+	assert.Equal(ErrClosed, batcher.Send([]byte("hmmhmm")))
+	assert.Equal(ErrClosed, batcher.Close(context.Background()))
+	batcher.Flush() // Doesn't block
+}
+
+type blockingSync struct {
+	release chan struct{}
+}
+
+func (s *blockingSync) Flush(b [][]byte, cursors []string) {
+	<-s.release
+}
+
+func TestCloseTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	sync := &blockingSync{release: make(chan struct{})}
+	batcher := New(sync)
+	batcher.FlushInterval(time.Hour)
+
+	t.Log("Close gives up when its context expires before the flush returns")
+	assert.NoError(batcher.Send([]byte("hihi")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, batcher.Close(ctx))
+
+	close(sync.release)
+}
+
+func TestCloseWithBlockedSend(t *testing.T) {
+	assert := assert.New(t)
+
+	sync := &blockingSync{release: make(chan struct{})}
+	batcher := New(sync)
+	batcher.FlushCount(1)
+
+	t.Log("A send blocked behind a slow flush and a full buffer doesn't hold up Close")
+	assert.NoError(batcher.Send([]byte("first")))
+	blocked := make(chan error)
+	go func() {
+		var err error
+		for i := 0; i <= cap(batcher.msgChan)+1 && err == nil; i++ {
+			err = batcher.Send([]byte("more"))
+		}
+		blocked <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, batcher.Close(ctx))
+
+	select {
+	case err := <-blocked:
+		assert.Equal(ErrClosed, err)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("The blocked send never returned")
+	}
+	batcher.Flush() // Doesn't block
+
+	close(sync.release)
+}
+
+// gatedSync blocks each flush until its batch's first message is released
+type gatedSync struct {
+	lock    sync.Mutex
+	started chan string
+	gates   map[string]chan struct{}
+}
+
+func newGatedSync(msgs ...string) *gatedSync {
+	s := &gatedSync{started: make(chan string, len(msgs)), gates: map[string]chan struct{}{}}
+	for _, msg := range msgs {
+		s.gates[msg] = make(chan struct{})
+	}
+	return s
+}
+
+func (s *gatedSync) Flush(b [][]byte, cursors []string) {
+	s.lock.Lock()
+	gate := s.gates[string(b[0])]
+	s.lock.Unlock()
+
+	s.started <- string(b[0])
+	<-gate
+}
+
+func (s *gatedSync) waitForStart(t *testing.T) string {
+	select {
+	case msg := <-s.started:
+		return msg
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("The flush never started")
+		return ""
+	}
+}
+
+func waitForInFlight(b Batcher, count int) Stats {
+	deadline := time.Now().Add(100 * time.Millisecond)
+	stats := b.Stats()
+	for stats.InFlight != count && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		stats = b.Stats()
+	}
+	return stats
+}
+
+func TestConcurrentFlushes(t *testing.T) {
+	assert := assert.New(t)
+
+	sync := newGatedSync("one", "two", "three")
+	batcher := New(sync)
+	batcher.FlushInterval(time.Hour)
+	batcher.FlushCount(1)
+	batcher.FlushConcurrency(2, false)
+
+	t.Log("Two batches are flushed at once")
+	assert.NoError(batcher.Send([]byte("one")))
+	assert.NoError(batcher.Send([]byte("two")))
+	assert.NoError(batcher.Send([]byte("three")))
+	started := []string{sync.waitForStart(t), sync.waitForStart(t)}
+	sort.Strings(started)
+	assert.Equal([]string{"one", "two"}, started)
+	assert.Equal(2, waitForInFlight(batcher, 2).InFlight)
+
+	t.Log("The third batch waits for a free slot")
+	close(sync.gates["two"])
+	assert.Equal("three", sync.waitForStart(t))
+	assert.Equal(int64(1), batcher.Stats().FlushWaits)
+
+	close(sync.gates["one"])
+	close(sync.gates["three"])
+	assert.NoError(batcher.Close(context.Background()))
+	assert.Equal(0, batcher.Stats().InFlight)
+}
+
+func TestOrderedConcurrentFlushes(t *testing.T) {
+	assert := assert.New(t)
+
+	sync := newGatedSync("one", "two", "three")
+	batcher := New(sync)
+	batcher.FlushInterval(time.Hour)
+	batcher.FlushCount(1)
+	batcher.FlushConcurrency(2, true)
+
+	assert.NoError(batcher.Send([]byte("one")))
+	assert.NoError(batcher.Send([]byte("two")))
+	assert.NoError(batcher.Send([]byte("three")))
+	started := []string{sync.waitForStart(t), sync.waitForStart(t)}
+	sort.Strings(started)
+	assert.Equal([]string{"one", "two"}, started)
+
+	t.Log("A later batch finishing first doesn't free its slot")
+	close(sync.gates["two"])
+	select {
+	case <-sync.started:
+		t.Fatal("The third batch shouldn't start before the first completes")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(2, batcher.Stats().InFlight)
+
+	close(sync.gates["one"])
+	assert.Equal("three", sync.waitForStart(t))
+
+	close(sync.gates["three"])
+	assert.NoError(batcher.Close(context.Background()))
+}
+
+// fakeClock only moves when advanced, firing any timers that come due
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c        chan time.Time
+	deadline time.Time
+	stopped  bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	timer := &fakeTimer{c: make(chan time.Time, 1), deadline: c.now.Add(d)}
+	c.timers = append(c.timers, timer)
+	return &fakeClockTimer{clock: c, timer: timer}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	active := []*fakeTimer{}
+	for _, timer := range c.timers {
+		if timer.stopped {
+			continue
+		}
+		if timer.deadline.After(c.now) {
+			active = append(active, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = active
+}
+
+// waitForTimer waits for the batcher to arm a timer for deadline, which
+// shows it has taken in every message it needs to
+func (c *fakeClock) waitForTimer(deadline time.Time) error {
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; time.Sleep(time.Millisecond) {
+		c.lock.Lock()
+		for _, timer := range c.timers {
+			if !timer.stopped && timer.deadline.Equal(deadline) {
+				c.lock.Unlock()
+				return nil
+			}
+		}
+		c.lock.Unlock()
+	}
+	return fmt.Errorf("No timer was set for %s", deadline)
+}
+
+type fakeClockTimer struct {
+	clock *fakeClock
+	timer *fakeTimer
+}
+
+func (t *fakeClockTimer) C() <-chan time.Time {
+	return t.timer.c
+}
+
+func (t *fakeClockTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	wasActive := !t.timer.stopped
+	t.timer.stopped = true
+	return wasActive
+}
+
+func TestMaxAgeOfOldestMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeClock()
+	sync := NewMockSync()
+	batcher := newBatcher(sync, DefaultOptions(), clock)
+	batcher.FlushInterval(10 * time.Second)
+	batcher.FlushCount(2000000)
+	start := clock.Now()
+
+	t.Log("A steady trickle of messages doesn't postpone the flush")
+	assert.NoError(batcher.Send([]byte("hihi")))
+	assert.NoError(clock.waitForTimer(start.Add(10 * time.Second)))
+	for i := 0; i < 3; i++ {
+		clock.Advance(3 * time.Second)
+		assert.NoError(batcher.Send([]byte("heyhey")))
+		assert.Error(sync.waitForFlush(time.Millisecond * 10))
+	}
+
+	clock.Advance(time.Second)
+	assert.NoError(sync.waitForFlush(time.Millisecond * 100))
+	assert.Equal(1, len(sync.batches))
+	assert.Equal(4, len(sync.batches[0]))
+
+	t.Log("The next batch's deadline starts from its own oldest message")
+	clock.Advance(5 * time.Second)
+	assert.NoError(batcher.Send([]byte("hmmhmm")))
+	assert.NoError(clock.waitForTimer(start.Add(25 * time.Second)))
+
+	assert.NoError(batcher.Close(context.Background()))
+}
+
+func TestMinBatchAge(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeClock()
+	sync := NewMockSync()
+	batcher := newBatcher(sync, DefaultOptions(), clock)
+	batcher.FlushInterval(10 * time.Second)
+	batcher.FlushMinAge(5 * time.Second)
+	batcher.FlushCount(2)
+	start := clock.Now()
+
+	t.Log("A full batch waits until it's old enough")
+	assert.NoError(batcher.Send([]byte("hihi")))
+	assert.NoError(batcher.Send([]byte("heyhey")))
+	assert.NoError(batcher.Send([]byte("hmmhmm"))) // Waits for the next batch
+	assert.NoError(clock.waitForTimer(start.Add(5 * time.Second)))
+	assert.Error(sync.waitForFlush(time.Millisecond * 10))
+
+	clock.Advance(5 * time.Second)
+	assert.NoError(sync.waitForFlush(time.Millisecond * 100))
+	assert.Equal([][]byte{[]byte("hihi"), []byte("heyhey")}, [][]byte(sync.batches[0]))
+
+	t.Log("A partial batch still goes out after the flush interval")
+	assert.NoError(clock.waitForTimer(start.Add(15 * time.Second)))
+	clock.Advance(10 * time.Second)
+	assert.NoError(sync.waitForFlush(time.Millisecond * 100))
+	assert.Equal([][]byte{[]byte("hmmhmm")}, [][]byte(sync.batches[1]))
+
+	assert.NoError(batcher.Close(context.Background()))
+}
+
+func TestNewWithOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	sync := NewMockSync()
+	opts := DefaultOptions()
+	opts.FlushInterval = time.Hour
+	opts.FlushCount = 2
+	batcher := NewWithOptions(sync, opts)
+
+	t.Log("Options given at construction are used from the first message")
+	assert.NoError(batcher.Send([]byte("hihi")))
+	assert.NoError(batcher.Send([]byte("heyhey")))
+	assert.NoError(sync.waitForFlush(time.Millisecond * 10))
+	assert.Equal(2, len(sync.batches[0]))
+
+	assert.NoError(batcher.Close(context.Background()))
+}
+
+func TestZeroLimitsFlushEveryMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, opts := range []Options{{FlushCount: 0, FlushSize: 1024}, {FlushCount: 10, FlushSize: 0}} {
+		sync := NewMockSync()
+		opts.FlushInterval = time.Hour
+		opts.FlushConcurrency = 1
+		batcher := NewWithOptions(sync, opts)
+
+		t.Logf("FlushCount %d and FlushSize %d send each message on its own", opts.FlushCount, opts.FlushSize)
+		assert.NoError(batcher.Send([]byte("hihi")))
+		assert.NoError(sync.waitForFlush(time.Millisecond * 100))
+		assert.NoError(batcher.Send([]byte("heyhey")))
+		assert.NoError(sync.waitForFlush(time.Millisecond * 100))
+		assert.Equal([]batch{{[]byte("hihi")}, {[]byte("heyhey")}}, sync.batches)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		assert.NoError(batcher.Close(ctx))
+		cancel()
+	}
+
+	t.Log("So do limits set to 0 on a running batcher")
+	sync := NewMockSync()
+	batcher := New(sync)
+	batcher.FlushInterval(time.Hour)
+	batcher.FlushCount(0)
+	assert.NoError(batcher.Send([]byte("hihi")))
+	assert.NoError(sync.waitForFlush(time.Millisecond * 100))
+	assert.NoError(batcher.Close(context.Background()))
+}
+
+func TestLiveReconfiguration(t *testing.T) {
+	assert := assert.New(t)
+
+	sync := NewMockSync()
+	batcher := New(sync)
+	batcher.FlushInterval(time.Hour)
+	batcher.FlushCount(10)
+
+	assert.NoError(batcher.Send([]byte("hihi")))
+	assert.NoError(batcher.Send([]byte("heyhey")))
+	assert.NoError(batcher.Send([]byte("hmmhmm")))
+	assert.Error(sync.waitForFlush(time.Millisecond * 10))
+
+	t.Log("Lowering the flush count sends a batch that is now full")
+	batcher.FlushCount(3)
+	assert.NoError(sync.waitForFlush(time.Millisecond * 10))
+	assert.Equal(3, len(sync.batches[0]))
+
+	t.Log("Reconfigure replaces every option")
+	opts := DefaultOptions()
+	opts.FlushInterval = time.Millisecond
+	batcher.Reconfigure(opts)
+	assert.NoError(batcher.Send([]byte("hihi")))
+	assert.NoError(sync.waitForFlush(time.Millisecond * 100))
+	assert.Equal(1, len(sync.batches[1]))
+
+	assert.NoError(batcher.Close(context.Background()))
+	batcher.FlushCount(1) // Ignored once closed
+}
@@ -0,0 +1,177 @@
+package heka_clever_plugins
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maxHeldCursors is how many undelivered messages a cursorTracker holds the
+// queue cursor for by default
+const maxHeldCursors = 10000
+
+// cursorTracker advances the Heka queue cursor only once every message that
+// arrived before it has been flushed, even when messages are flushed out of
+// order by different batchers.  Runs of flushed messages are only tracked by
+// their newest cursor, so that messages held behind an undelivered one don't
+// pile up.
+type cursorTracker struct {
+	lock     sync.Mutex
+	pending  *list.List // of *trackedCursor, in arrival order
+	byCursor map[string]*list.Element
+	update   func(cursor string)
+	// Number of held messages, and how many may be held at once
+	held    int
+	maxHeld int
+}
+
+type trackedCursor struct {
+	cursor      string
+	outstanding int
+	held        bool
+}
+
+func (t *trackedCursor) done() bool {
+	return t.outstanding <= 0 && !t.held
+}
+
+func newCursorTracker(update func(cursor string)) *cursorTracker {
+	return &cursorTracker{
+		pending:  list.New(),
+		byCursor: map[string]*list.Element{},
+		update:   update,
+		maxHeld:  maxHeldCursors,
+	}
+}
+
+// Track records a message that has been handed to a batcher.  Empty cursors
+// (i.e. disk buffering is off) are ignored.
+func (c *cursorTracker) Track(cursor string) {
+	if cursor == "" {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.byCursor[cursor]; ok {
+		elem.Value.(*trackedCursor).outstanding += 1
+		return
+	}
+	c.byCursor[cursor] = c.pending.PushBack(&trackedCursor{cursor: cursor, outstanding: 1})
+}
+
+// Done marks messages as flushed, and updates the queue cursor to the newest
+// message whose predecessors have all been flushed
+func (c *cursorTracker) Done(cursors []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, cursor := range cursors {
+		if elem, ok := c.byCursor[cursor]; ok {
+			elem.Value.(*trackedCursor).outstanding -= 1
+			c.collapse(elem)
+		}
+	}
+	c.advance()
+}
+
+// Hold marks messages that were neither sent nor dead-lettered.  They hold
+// back the queue cursor, so that they're read again after a restart, until
+// more than maxHeld messages are held.  The oldest are then released as if
+// they had been flushed.  Hold returns the number of messages released.
+func (c *cursorTracker) Hold(cursors []string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, cursor := range cursors {
+		if elem, ok := c.byCursor[cursor]; ok {
+			tracked := elem.Value.(*trackedCursor)
+			tracked.outstanding -= 1
+			if !tracked.held {
+				tracked.held = true
+				c.held += 1
+			}
+		}
+	}
+
+	released := 0
+	for elem := c.pending.Front(); elem != nil && c.held > c.maxHeld; {
+		next := elem.Next()
+		if tracked := elem.Value.(*trackedCursor); tracked.held {
+			tracked.held = false
+			c.held -= 1
+			released += 1
+			c.collapse(elem)
+		}
+		elem = next
+	}
+	c.advance()
+	return released
+}
+
+// Drop marks a message that won't be handed to a batcher as done, so it
+// doesn't hold back the queue cursor and isn't read again after a restart
+func (c *cursorTracker) Drop(cursor string) {
+	if cursor == "" {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Other copies of the message may still be waiting to be flushed
+	if _, ok := c.byCursor[cursor]; !ok {
+		c.byCursor[cursor] = c.pending.PushBack(&trackedCursor{cursor: cursor})
+		c.collapse(c.byCursor[cursor])
+	}
+	c.advance()
+}
+
+// collapse stops tracking flushed messages that a newer flushed message
+// directly follows, since the queue cursor only ever moves to the newer one.
+// c.lock must be held.
+func (c *cursorTracker) collapse(elem *list.Element) {
+	if !elem.Value.(*trackedCursor).done() {
+		return
+	}
+	if prev := elem.Prev(); prev != nil && prev.Value.(*trackedCursor).done() {
+		c.remove(prev)
+	}
+	if next := elem.Next(); next != nil && next.Value.(*trackedCursor).done() {
+		c.remove(elem)
+	}
+}
+
+// remove stops tracking elem.  c.lock must be held.
+func (c *cursorTracker) remove(elem *list.Element) {
+	c.pending.Remove(elem)
+	delete(c.byCursor, elem.Value.(*trackedCursor).cursor)
+}
+
+// advance removes the leading messages that have been flushed, and updates
+// the queue cursor to the newest of them.  c.lock must be held.
+func (c *cursorTracker) advance() {
+	latest := ""
+	for elem := c.pending.Front(); elem != nil; elem = c.pending.Front() {
+		tracked := elem.Value.(*trackedCursor)
+		if !tracked.done() {
+			break
+		}
+
+		latest = tracked.cursor
+		c.remove(elem)
+	}
+
+	if latest != "" {
+		c.update(latest)
+	}
+}
+
+// Len returns the number of messages tracked: those waiting to be flushed or
+// held, and the newest of each run of flushed messages behind them
+func (c *cursorTracker) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.pending.Len()
+}
@@ -0,0 +1,100 @@
+package heka_clever_plugins
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorTrackerWaitsForEarlierMessages(t *testing.T) {
+	updates := []string{}
+	tracker := newCursorTracker(func(cursor string) {
+		updates = append(updates, cursor)
+	})
+
+	tracker.Track("0:1") // series a
+	tracker.Track("0:2") // series b
+	tracker.Track("0:3") // series a
+
+	t.Log("Cursor doesn't move while an earlier message is unflushed")
+	tracker.Done([]string{"0:2"})
+	assert.Empty(t, updates)
+
+	t.Log("Cursor jumps to the newest message with no unflushed predecessors")
+	tracker.Done([]string{"0:1", "0:3"})
+	assert.Equal(t, []string{"0:3"}, updates)
+	assert.Equal(t, 0, tracker.Len())
+}
+
+func TestCursorTrackerIgnoresEmptyCursors(t *testing.T) {
+	updates := []string{}
+	tracker := newCursorTracker(func(cursor string) {
+		updates = append(updates, cursor)
+	})
+
+	tracker.Track("")
+	tracker.Done([]string{""})
+	assert.Empty(t, updates)
+	assert.Equal(t, 0, tracker.Len())
+}
+
+func TestCursorTrackerDrop(t *testing.T) {
+	updates := []string{}
+	tracker := newCursorTracker(func(cursor string) {
+		updates = append(updates, cursor)
+	})
+
+	t.Log("Dropping the only pending message moves the cursor past it")
+	tracker.Drop("0:1")
+	assert.Equal(t, []string{"0:1"}, updates)
+
+	t.Log("A dropped message waits for earlier messages to be flushed")
+	tracker.Track("0:2")
+	tracker.Drop("0:3")
+	assert.Equal(t, []string{"0:1"}, updates)
+	tracker.Done([]string{"0:2"})
+	assert.Equal(t, []string{"0:1", "0:3"}, updates)
+	assert.Equal(t, 0, tracker.Len())
+
+	t.Log("Dropping a message doesn't release copies still being flushed")
+	tracker.Track("0:4")
+	tracker.Drop("0:4")
+	assert.Equal(t, []string{"0:1", "0:3"}, updates)
+	tracker.Done([]string{"0:4"})
+	assert.Equal(t, []string{"0:1", "0:3", "0:4"}, updates)
+
+	tracker.Drop("")
+	assert.Equal(t, 0, tracker.Len())
+}
+
+func TestCursorTrackerHold(t *testing.T) {
+	updates := []string{}
+	tracker := newCursorTracker(func(cursor string) {
+		updates = append(updates, cursor)
+	})
+	tracker.maxHeld = 2
+
+	t.Log("Held messages hold back the cursor")
+	tracker.Track("0:1")
+	tracker.Track("0:2")
+	assert.Equal(t, 0, tracker.Hold([]string{"0:1"}))
+	tracker.Done([]string{"0:2"})
+	assert.Empty(t, updates)
+
+	t.Log("Only the newest of the flushed messages behind them is tracked")
+	for i := 3; i < 1000; i++ {
+		cursor := fmt.Sprintf("0:%d", i)
+		tracker.Track(cursor)
+		tracker.Done([]string{cursor})
+	}
+	assert.Empty(t, updates)
+	assert.Equal(t, 2, tracker.Len())
+
+	t.Log("Messages held over maxHeld release the oldest")
+	tracker.Track("1:1")
+	tracker.Track("1:2")
+	assert.Equal(t, 1, tracker.Hold([]string{"1:1", "1:2"}))
+	assert.Equal(t, []string{"0:999"}, updates)
+	assert.Equal(t, 2, tracker.Len())
+}
@@ -0,0 +1,79 @@
+package heka_clever_plugins
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/Clever/heka-clever-plugins/deadletter"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// replayDeadLetters replays dead-lettered records once on startup (if
+// configured) and then every interval seconds until stop is closed.  The number
+// of records delivered is added to replayedCount.  done is closed once the last
+// replay has returned.
+func replayDeadLetters(
+	queue *deadletter.Queue, putters deadletter.PutterFunc, onStart bool, interval uint32,
+	replayedCount *int64, or pipeline.OutputRunner, stop <-chan struct{}, done chan<- struct{},
+) {
+	defer close(done)
+
+	replay := func() {
+		count, err := queue.Replay(putters)
+		atomic.AddInt64(replayedCount, int64(count))
+		if err != nil {
+			or.LogError(err)
+		}
+	}
+
+	if onStart {
+		replay()
+	}
+
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			replay()
+		}
+	}
+}
+
+// waitAll waits for every channel in done that isn't nil to be closed, and
+// returns false if timeout expires first
+func waitAll(timeout time.Duration, done ...<-chan struct{}) bool {
+	deadline := time.After(timeout)
+	for _, ch := range done {
+		if ch == nil {
+			continue
+		}
+		select {
+		case <-ch:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// closeSinks closes an output's dead-letter queue (if any) and backend (if it
+// needs closing).  Nothing may write to either once it's called.
+func closeSinks(queue *deadletter.Queue, backend aws.Backend) {
+	if queue != nil {
+		queue.Close()
+	}
+	if closer, ok := backend.(io.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,476 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+)
+
+var kvlog = logger.New("dead-letter")
+
+const (
+	filePrefix = "deadletter-"
+	fileSuffix = ".jsonl"
+
+	// PoisonFile holds records that won't be replayed again
+	PoisonFile = "poison.jsonl"
+
+	// Firehose accepts at most 500 records per PutRecordBatch
+	replayBatchSize = 500
+)
+
+// Entry is a single record that could not be delivered to its stream
+type Entry struct {
+	Stream    string    `json:"stream"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      []byte    `json:"data"`
+	// Number of times the record failed: its first put, then each replay
+	Attempts int `json:"attempts"`
+}
+
+// Config controls how a Queue rotates files and which records it replays
+type Config struct {
+	// Size in bytes at which files are rotated (0 never rotates)
+	MaxFileSize int64
+	// Records that have failed this many times are moved to the poison file
+	// instead of being replayed (0 replays them forever)
+	MaxAttempts int
+	// Reports whether records failing with an error code are worth replaying,
+	// e.g. aws.RetryPolicy.IsRetryable.  Records that failed without a code
+	// (e.g. a dropped connection) are always replayed, as is everything if
+	// Retryable is nil.
+	Retryable func(code string) bool
+}
+
+// PutterFunc returns the RecordPutter used to replay records into stream
+type PutterFunc func(stream string) (aws.RecordPutter, error)
+
+// Queue appends undeliverable records to rotating newline-delimited JSON files
+// in a local directory, and replays them into their streams later
+type Queue struct {
+	dir  string
+	conf Config
+
+	lock     sync.Mutex
+	file     *os.File
+	fileSize int64
+	fileSeq  int
+}
+
+// New returns a Queue writing to dir, which is created if it doesn't exist
+func New(dir string, conf Config) (*Queue, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("dead-letter directory cannot be empty string")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Queue{dir: dir, conf: conf}, nil
+}
+
+// Append writes entries to the current dead-letter file
+func (q *Queue) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+
+		if q.file == nil {
+			if err := q.openFile(); err != nil {
+				return err
+			}
+		}
+
+		n, err := q.file.Write(line)
+		q.fileSize += int64(n)
+		if err != nil {
+			return err
+		}
+
+		if q.conf.MaxFileSize > 0 && q.fileSize >= q.conf.MaxFileSize {
+			if err := q.closeFile(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if q.file == nil {
+		return nil
+	}
+	return q.file.Sync()
+}
+
+// AppendFailed writes every record that res reports as failed
+func (q *Queue) AppendFailed(stream string, records [][]byte, res *aws.BatchResult) error {
+	attempts := make([]int, len(records))
+	return q.requeue(stream, records, attempts, res)
+}
+
+// requeue writes every record that res reports as failed, after the number of
+// attempts it previously failed.  Records that won't be replayed go to the
+// poison file instead.
+func (q *Queue) requeue(stream string, records [][]byte, attempts []int, res *aws.BatchResult) error {
+	now := time.Now().UTC()
+
+	entries := make([]Entry, 0, res.FailedCount())
+	for _, failure := range res.Failed {
+		entries = append(entries, Entry{
+			Stream:    stream,
+			ErrorCode: failure.ErrorCode,
+			Error:     failure.ErrorMessage,
+			Timestamp: now,
+			Data:      records[failure.Index],
+			Attempts:  attempts[failure.Index] + 1,
+		})
+	}
+
+	entries, err := q.poison(entries)
+	if err != nil {
+		return err
+	}
+	return q.Append(entries)
+}
+
+// replayable returns whether entry is worth replaying
+func (q *Queue) replayable(entry Entry) bool {
+	if q.conf.MaxAttempts > 0 && entry.Attempts >= q.conf.MaxAttempts {
+		return false
+	}
+	return entry.ErrorCode == "" || q.conf.Retryable == nil || q.conf.Retryable(entry.ErrorCode)
+}
+
+// poison moves the entries that won't be replayed to the poison file, and
+// returns the rest
+func (q *Queue) poison(entries []Entry) ([]Entry, error) {
+	keep := []Entry{}
+	poisoned := []Entry{}
+	for _, entry := range entries {
+		if q.replayable(entry) {
+			keep = append(keep, entry)
+		} else {
+			poisoned = append(poisoned, entry)
+		}
+	}
+	if len(poisoned) == 0 {
+		return keep, nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	path := filepath.Join(q.dir, PoisonFile)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range poisoned {
+		kvlog.ErrorD("poisoned-record", logger.M{
+			"stream": entry.Stream, "code": entry.ErrorCode, "attempts": entry.Attempts,
+			"msg": entry.Error,
+		})
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return keep, file.Close()
+}
+
+// Rotate closes the current file so the next Append starts a new one
+func (q *Queue) Rotate() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.closeFile()
+}
+
+// Close closes the current file
+func (q *Queue) Close() error {
+	return q.Rotate()
+}
+
+// Replay sends every rotated dead-letter file back into its streams.  Records
+// that fail again are appended to a new dead-letter file; each replayed file is
+// removed once it has been processed.  Records that aren't worth replaying
+// (see Config) are moved to the poison file instead of being sent.  A file
+// that can't be fully replayed is rewritten with only the records left, so
+// delivered records aren't sent again, and is logged and skipped.  Returns
+// the number of records delivered, and the first error.
+func (q *Queue) Replay(putters PutterFunc) (int, error) {
+	q.lock.Lock()
+	err := q.closeFile()
+	q.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	files, err := q.rotatedFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	var firstErr error
+	for _, path := range files {
+		count, err := q.replayFile(path, putters)
+		replayed += count
+		if err != nil {
+			kvlog.ErrorD("replay-file-failed", logger.M{"file": path, "msg": err.Error()})
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return replayed, firstErr
+}
+
+// replayFile sends the records of a single file, grouped by stream
+func (q *Queue) replayFile(path string, putters PutterFunc) (int, error) {
+	entries, err := readEntries(path)
+	if err != nil {
+		return 0, err
+	}
+	count := len(entries)
+	entries, err = q.poison(entries)
+	if err != nil {
+		return 0, err
+	}
+
+	streams := []string{}
+	byStream := map[string][]Entry{}
+	for _, entry := range entries {
+		if _, ok := byStream[entry.Stream]; !ok {
+			streams = append(streams, entry.Stream)
+		}
+		byStream[entry.Stream] = append(byStream[entry.Stream], entry)
+	}
+
+	// Records neither delivered nor requeued, which stay in the file
+	left := []Entry{}
+	replayed := 0
+	var replayErr error
+	for _, stream := range streams {
+		streamEntries := byStream[stream]
+		if replayErr != nil {
+			left = append(left, streamEntries...)
+			continue
+		}
+
+		// Other streams can still be replayed without this one
+		putter, err := putters(stream)
+		if err != nil {
+			kvlog.ErrorD("replay-stream-failed", logger.M{"stream": stream, "msg": err.Error()})
+			left = append(left, streamEntries...)
+			continue
+		}
+
+		for start := 0; start < len(streamEntries); start += replayBatchSize {
+			end := start + replayBatchSize
+			if end > len(streamEntries) {
+				end = len(streamEntries)
+			}
+			batchEntries := streamEntries[start:end]
+			batch := make([][]byte, len(batchEntries))
+			batchAttempts := make([]int, len(batchEntries))
+			for i, entry := range batchEntries {
+				batch[i] = entry.Data
+				batchAttempts[i] = entry.Attempts
+			}
+
+			res, err := putter.PutRecordBatch(batch)
+			replayed += res.SentCount()
+			if err != nil {
+				kvlog.ErrorD("replay-failed-records", logger.M{
+					"stream": stream, "failed-record-count": res.FailedCount(),
+					"msg": err.Error(),
+				})
+			}
+
+			// Records that still can't be delivered go back on the queue.  If
+			// that fails, they stay in this file along with everything not yet
+			// sent.
+			if err := q.requeue(stream, batch, batchAttempts, res); err != nil {
+				replayErr = err
+				for _, failure := range res.Failed {
+					left = append(left, batchEntries[failure.Index])
+				}
+				left = append(left, streamEntries[end:]...)
+				break
+			}
+		}
+	}
+
+	kvlog.InfoD("replayed-file", logger.M{
+		"file": path, "record-count": count, "replayed-count": replayed,
+		"left-count": len(left),
+	})
+
+	if len(left) == 0 {
+		err = os.Remove(path)
+	} else {
+		err = writeEntries(path, left)
+		if err == nil && replayErr == nil {
+			err = fmt.Errorf("%d dead-letter records left in %s", len(left), path)
+		}
+	}
+	if replayErr != nil {
+		return replayed, replayErr
+	}
+	return replayed, err
+}
+
+// rotatedFiles returns every dead-letter file except the one being written to,
+// oldest first
+func (q *Queue) rotatedFiles() ([]string, error) {
+	infos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q.lock.Lock()
+	current := ""
+	if q.file != nil {
+		current = q.file.Name()
+	}
+	q.lock.Unlock()
+
+	files := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+
+		path := filepath.Join(q.dir, name)
+		if path != current {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// openFile starts a new dead-letter file.  Callers must hold q.lock.
+func (q *Queue) openFile() error {
+	q.fileSeq += 1
+	name := fmt.Sprintf("%s%020d-%06d%s", filePrefix, time.Now().UnixNano(), q.fileSeq, fileSuffix)
+
+	file, err := os.OpenFile(filepath.Join(q.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.file = file
+	q.fileSize = 0
+	return nil
+}
+
+// closeFile closes the current dead-letter file, if any.  Callers must hold q.lock.
+func (q *Queue) closeFile() error {
+	if q.file == nil {
+		return nil
+	}
+
+	err := q.file.Close()
+	q.file = nil
+	q.fileSize = 0
+	return err
+}
+
+// writeEntries replaces the file at path with entries
+func writeEntries(path string, entries []Entry) error {
+	// Written next to the file, under a name replays skip, then moved over it
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := writer.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func readEntries(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(file)
+	// Firehose records can be up to 1000 KiB, which base64 encodes to ~1.4mb
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("invalid dead-letter entry in %s: %s", path, err.Error())
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,299 @@
+package deadletter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockPutter struct {
+	batches [][][]byte
+	err     error
+}
+
+func (m *mockPutter) PutRecord(record []byte) error {
+	_, err := m.PutRecordBatch([][]byte{record})
+	return err
+}
+
+func (m *mockPutter) PutRecordBatch(records [][]byte) (*aws.BatchResult, error) {
+	m.batches = append(m.batches, records)
+	return aws.NewBatchResult(len(records), m.err), m.err
+}
+
+func tempQueue(t *testing.T, maxFileSize int64) (*Queue, string) {
+	return tempQueueWithConfig(t, Config{MaxFileSize: maxFileSize})
+}
+
+func tempQueueWithConfig(t *testing.T, conf Config) (*Queue, string) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.NoError(t, err)
+
+	q, err := New(dir, conf)
+	assert.NoError(t, err)
+	return q, dir
+}
+
+func TestAppendFailedWritesMetadata(t *testing.T) {
+	q, dir := tempQueue(t, 0)
+	defer os.RemoveAll(dir)
+
+	records := [][]byte{[]byte("ok"), []byte("rejected")}
+	res := &aws.BatchResult{
+		Succeeded: []int{0},
+		Failed: []aws.RecordFailure{
+			{Index: 1, ErrorCode: "ServiceUnavailableException", ErrorMessage: "Slow down."},
+		},
+	}
+	assert.NoError(t, q.AppendFailed("test-stream", records, res))
+	assert.NoError(t, q.Close())
+
+	files, err := q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	entries, err := readEntries(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "test-stream", entries[0].Stream)
+	assert.Equal(t, "ServiceUnavailableException", entries[0].ErrorCode)
+	assert.Equal(t, "Slow down.", entries[0].Error)
+	assert.Equal(t, "rejected", string(entries[0].Data))
+	assert.Equal(t, 1, entries[0].Attempts)
+	assert.False(t, entries[0].Timestamp.IsZero())
+}
+
+func TestAppendRotatesBySize(t *testing.T) {
+	q, dir := tempQueue(t, 1)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, q.Append([]Entry{
+		{Stream: "a", Data: []byte("one")},
+		{Stream: "a", Data: []byte("two")},
+		{Stream: "a", Data: []byte("three")},
+	}))
+
+	files, err := q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(files))
+}
+
+func TestReplaySendsRecordsByStream(t *testing.T) {
+	q, dir := tempQueue(t, 0)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, q.Append([]Entry{
+		{Stream: "a", Data: []byte("one")},
+		{Stream: "b", Data: []byte("two")},
+		{Stream: "a", Data: []byte("three")},
+	}))
+
+	putters := map[string]*mockPutter{"a": &mockPutter{}, "b": &mockPutter{}}
+	replayed, err := q.Replay(func(stream string) (aws.RecordPutter, error) {
+		return putters[stream], nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, replayed)
+
+	assert.Equal(t, [][][]byte{{[]byte("one"), []byte("three")}}, putters["a"].batches)
+	assert.Equal(t, [][][]byte{{[]byte("two")}}, putters["b"].batches)
+
+	t.Log("Replayed files are removed")
+	files, err := q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestReplayRequeuesFailedRecords(t *testing.T) {
+	q, dir := tempQueue(t, 0)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, q.Append([]Entry{{Stream: "a", Data: []byte("one")}}))
+
+	putter := &mockPutter{err: errors.New("still down")}
+	replayed, err := q.Replay(func(stream string) (aws.RecordPutter, error) { return putter, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+	assert.NoError(t, q.Close())
+
+	files, err := q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	entries, err := readEntries(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "one", string(entries[0].Data))
+	assert.Equal(t, "still down", entries[0].Error)
+	assert.Equal(t, 1, entries[0].Attempts)
+}
+
+// poisoned returns the entries in the poison file
+func poisoned(t *testing.T, dir string) []Entry {
+	entries, err := readEntries(filepath.Join(dir, PoisonFile))
+	assert.NoError(t, err)
+	return entries
+}
+
+func TestReplayPoisonsNonRetryableRecords(t *testing.T) {
+	q, dir := tempQueueWithConfig(t, Config{Retryable: aws.DefaultRetryPolicy().IsRetryable})
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, q.Append([]Entry{
+		{Stream: "a", ErrorCode: aws.ErrCodeRecordTooLarge, Data: []byte("too large"), Attempts: 1},
+		{Stream: "a", ErrorCode: "ServiceUnavailableException", Data: []byte("one"), Attempts: 1},
+	}))
+
+	putter := &mockPutter{}
+	replayed, err := q.Replay(func(stream string) (aws.RecordPutter, error) { return putter, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, [][][]byte{{[]byte("one")}}, putter.batches, "the too large record isn't sent")
+
+	t.Log("The too large record is moved to the poison file, not re-queued")
+	files, err := q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	entries := poisoned(t, dir)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "too large", string(entries[0].Data))
+
+	t.Log("Records first failing with non-retryable codes go straight to the poison file")
+	res := &aws.BatchResult{Failed: []aws.RecordFailure{{Index: 0, ErrorCode: "InvalidArgumentException"}}}
+	assert.NoError(t, q.AppendFailed("a", [][]byte{[]byte("invalid")}, res))
+	assert.NoError(t, q.Close())
+	files, err = q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	assert.Equal(t, 2, len(poisoned(t, dir)))
+}
+
+func TestReplayStopsAfterMaxAttempts(t *testing.T) {
+	q, dir := tempQueueWithConfig(t, Config{MaxAttempts: 3})
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, q.Append([]Entry{{Stream: "a", Data: []byte("one"), Attempts: 1}}))
+
+	putter := &mockPutter{err: errors.New("still down")}
+	putters := func(stream string) (aws.RecordPutter, error) { return putter, nil }
+	for i := 0; i < 3; i++ {
+		_, err := q.Replay(putters)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, len(putter.batches), "the record is replayed until it has failed 3 times")
+
+	files, err := q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	entries := poisoned(t, dir)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, 3, entries[0].Attempts)
+}
+
+// funcPutter hands each batch to put
+type funcPutter struct {
+	put func(records [][]byte) (*aws.BatchResult, error)
+}
+
+func (f *funcPutter) PutRecord(record []byte) error {
+	_, err := f.PutRecordBatch([][]byte{record})
+	return err
+}
+
+func (f *funcPutter) PutRecordBatch(records [][]byte) (*aws.BatchResult, error) {
+	return f.put(records)
+}
+
+func TestReplayKeepsOnlyUnsentRecords(t *testing.T) {
+	q, dir := tempQueue(t, 0)
+	defer os.RemoveAll(dir)
+
+	entries := []Entry{}
+	for i := 0; i <= replayBatchSize; i++ {
+		entries = append(entries, Entry{Stream: "a", Data: []byte(fmt.Sprintf("a%d", i)), Attempts: 1})
+	}
+	entries = append(entries, Entry{Stream: "b", Data: []byte("b0"), Attempts: 1})
+	assert.NoError(t, q.Append(entries))
+
+	t.Log("The second batch fails, and so does requeueing it")
+	sent := map[string]int{}
+	putter := &funcPutter{put: func(records [][]byte) (*aws.BatchResult, error) {
+		if len(records) == replayBatchSize {
+			for _, record := range records {
+				sent[string(record)] += 1
+			}
+			return aws.NewBatchResult(len(records), nil), nil
+		}
+
+		// A dead-letter file that can't be written to
+		broken, err := os.Create(filepath.Join(dir, "broken"))
+		assert.NoError(t, err)
+		broken.Close()
+		q.file = broken
+
+		err = errors.New("still down")
+		return aws.NewBatchResult(len(records), err), err
+	}}
+	replayed, err := q.Replay(func(stream string) (aws.RecordPutter, error) {
+		if stream == "b" {
+			return nil, errors.New("no such stream")
+		}
+		return putter, nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, replayBatchSize, replayed)
+	q.file = nil
+
+	t.Log("Only the records that weren't delivered are left in the file")
+	files, err := q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	left, err := readEntries(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{entries[replayBatchSize], entries[replayBatchSize+1]}, left)
+
+	t.Log("The next replay sends the rest, and nothing twice")
+	replayed, err = q.Replay(func(stream string) (aws.RecordPutter, error) {
+		return &funcPutter{put: func(records [][]byte) (*aws.BatchResult, error) {
+			for _, record := range records {
+				sent[string(record)] += 1
+			}
+			return aws.NewBatchResult(len(records), nil), nil
+		}}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, len(entries), len(sent))
+	for record, count := range sent {
+		assert.Equal(t, 1, count, record)
+	}
+	files, err = q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestReplaySkipsUnreadableFiles(t *testing.T) {
+	q, dir := tempQueue(t, 0)
+	defer os.RemoveAll(dir)
+
+	bad := filepath.Join(dir, filePrefix+"0"+fileSuffix)
+	assert.NoError(t, ioutil.WriteFile(bad, []byte("not json\n"), 0644))
+	assert.NoError(t, q.Append([]Entry{{Stream: "a", Data: []byte("one")}}))
+
+	putter := &mockPutter{}
+	replayed, err := q.Replay(func(stream string) (aws.RecordPutter, error) { return putter, nil })
+	assert.Error(t, err)
+	assert.Equal(t, 1, replayed, "newer files are replayed")
+
+	files, err := q.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{bad}, files)
+}
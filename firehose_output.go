@@ -1,59 +1,94 @@
 package heka_clever_plugins
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/Clever/heka-clever-plugins/deadletter"
+	"github.com/Clever/heka-clever-plugins/serializer"
 
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
-type MsgPack struct {
-	record      []byte
-	queueCursor string
-}
-
 type FirehoseOutput struct {
-	recvRecordCount    int64
-	sentRecordCount    int64
-	droppedRecordCount int64
-	batchedRecords     [][]byte
-	queueCursor        string
-	batchChan          chan MsgPack
-	stopChan           chan bool
-	client             aws.RecordPutter
-	conf               *FirehoseOutputConfig
-	or                 pipeline.OutputRunner
-	reportLock         sync.Mutex
-	flushTicker        *time.Ticker
+	recvRecordCount       int64
+	sentRecordCount       int64
+	droppedRecordCount    int64
+	deadLetterRecordCount int64
+	replayedRecordCount   int64
+	releasedCursorCount   int64
+	batchChan             chan MsgPack
+	stopChan              chan bool
+	senderDone            chan struct{}
+	client                aws.RecordPutter
+	backend               aws.Backend
+	serializer            *serializer.Serializer
+	encoder               serializer.Encoder
+	deadLetters           *deadletter.Queue
+	cursors               *cursorTracker
+	replayStopChan        chan struct{}
+	replayDone            chan struct{}
+	conf                  *FirehoseOutputConfig
+	or                    pipeline.OutputRunner
+	reportLock            sync.Mutex
+	flushTicker           *time.Ticker
 }
 
 type FirehoseOutputConfig struct {
 	// Kineses stream name to put data to
 	Stream string `toml:"stream"`
-	// AWS region the stream lives in
-	Region string `toml:"region"`
-	// Optional column to use as the message timestamp
+	// AWS, backend, record format and dead-letter settings
+	FirehoseDeliveryConfig
+	// Columns the message timestamp is written to (default ["timestamp"])
+	TimestampColumns []string `toml:"timestamp_columns"`
+	// Deprecated: an extra column the message timestamp is written to.  Add
+	// it to timestamp_columns instead.
 	TimestampColumn string `toml:"timestamp_column"`
+	// How the message timestamp is written: "rfc3339", "epoch_s", "epoch_ms",
+	// "epoch_ns", or a Go time layout (default "2006-01-02 15:04:05.000")
+	TimestampLayout string `toml:"timestamp_layout"`
+	// IANA time zone the message timestamp is written in, e.g.
+	// "America/Los_Angeles" or "Local" (default "UTC")
+	TimestampTimezone string `toml:"timestamp_timezone"`
+	// Include the base Heka fields (uuid, type, logger, severity, payload,
+	// envversion, pid and hostname) in records (default true)
+	IncludeBaseFields bool `toml:"include_base_fields"`
+	// Column names for fields, keyed by field name (base fields by their
+	// column name, e.g. "hostname")
+	RenameFields map[string]string `toml:"rename_fields"`
+	// Write every value of a field with several values as an array, instead
+	// of only its first value (default false)
+	MultiValueArrays bool `toml:"multi_value_arrays"`
+	// What to do with bytes fields: "skip" them (the default), or write them
+	// as "base64" strings
+	BytesFields string `toml:"bytes_fields"`
 	// Interval at which accumulated messages should be bulk put to
 	// firehose, in milliseconds (default 1000, i.e. 1 second).
 	FlushInterval uint32 `toml:"flush_interval"`
 	// Number of messages that triggers a put to firehose
 	// (default to 1, maximum is 500)
 	FlushCount int `toml:"flush_count"`
+	// How long to wait on shutdown for the last batch to be sent, in
+	// milliseconds (default 30000, i.e. 30 seconds)
+	ShutdownTimeout uint32 `toml:"shutdown_timeout"`
 }
 
 func (f *FirehoseOutput) ConfigStruct() interface{} {
 	return &FirehoseOutputConfig{
-		FlushInterval: 1000,
-		FlushCount:    1,
+		FirehoseDeliveryConfig: defaultFirehoseDeliveryConfig(),
+		FlushInterval:          1000,
+		FlushCount:             1,
+		ShutdownTimeout:        30000,
+		TimestampColumns:       []string{"timestamp"},
+		TimestampLayout:        serializer.DefaultTimestampLayout,
+		TimestampTimezone:      "UTC",
+		IncludeBaseFields:      true,
+		BytesFields:            string(serializer.BytesSkip),
 	}
 }
 
@@ -65,29 +100,72 @@ func (f *FirehoseOutput) Init(config interface{}) error {
 	}
 
 	f.batchChan = make(chan MsgPack, 100)
-	f.batchedRecords = make([][]byte, 0, f.conf.FlushCount)
 
 	if f.conf.Stream == "" {
 		return fmt.Errorf("Unspecificed stream name")
 	}
 
-	if os.Getenv("HEKA_TESTING") == "" {
-		f.client = aws.NewFirehose(f.conf.Region, f.conf.Stream)
-	} else {
-		endpoint := os.Getenv("MOCK_FIREHOSE_ENDPOINT")
-		if endpoint == "" {
-			return fmt.Errorf("env-var MOCK_FIREHOSE_ENDPOINT not found for heka-testing")
-		}
-		fmt.Println("Mocking out firehose output: " + endpoint)
-		f.client = aws.NewMockRecordPutter(f.conf.Stream, endpoint)
+	var err error
+	f.serializer, err = newSerializer(
+		f.conf.IncludeBaseFields, f.conf.RenameFields, f.conf.MultiValueArrays, f.conf.BytesFields,
+		append(append([]string{}, f.conf.TimestampColumns...), f.conf.TimestampColumn), f.conf.TimestampLayout,
+		f.conf.TimestampTimezone, nil,
+	)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	// records ending in newlines will ensure the json objects written to
+	// firehose appear one per line
+	f.encoder, err = newEncoder(
+		f.conf.RecordFormat, f.conf.RecordColumns, f.conf.AvroSchemaFile, true,
+		f.conf.AggregateRecords, f.conf.OversizeRecordPolicy,
+	)
+	if err != nil {
+		return err
+	}
+
+	firehoseConf, err := f.conf.firehoseConfig()
+	if err != nil {
+		return err
+	}
+
+	f.backend, err = aws.NewBackend(f.conf.Backend, f.conf.backendConfig(firehoseConf))
+	if err != nil {
+		return err
+	}
+
+	client, err := f.createClient(f.conf.Stream)
+	if err != nil {
+		return err
+	}
+	f.client = client
+
+	f.deadLetters, err = f.conf.deadLetterQueue(firehoseConf.Retry)
+	return err
+}
+
+func (f *FirehoseOutput) createClient(stream string) (aws.RecordPutter, error) {
+	client, err := f.backend.NewRecordPutter(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.conf.wrapClient(client), nil
+}
+
+// deadLetterPutter returns the client used to replay dead-lettered records
+func (f *FirehoseOutput) deadLetterPutter(stream string) (aws.RecordPutter, error) {
+	if stream == f.conf.Stream {
+		return f.client, nil
+	}
+	return f.createClient(stream)
 }
 
 func (f *FirehoseOutput) Prepare(or pipeline.OutputRunner, h pipeline.PluginHelper) error {
 	f.or = or
 	f.stopChan = or.StopChan()
+	f.cursors = newCursorTracker(or.UpdateCursor)
 
 	// Setup the batch ticker
 	if f.conf.FlushInterval > 0 {
@@ -103,118 +181,108 @@ func (f *FirehoseOutput) Prepare(or pipeline.OutputRunner, h pipeline.PluginHelp
 		f.flushTicker = &ticker
 	}
 
-	go f.batchSender()
-	return nil
-}
-
-func (f *FirehoseOutput) parseFields(pack *pipeline.PipelinePack) map[string]interface{} {
-	m := pack.Message
-	object := make(map[string]interface{})
-
-	// Handle standard heka fields
-	object["uuid"] = m.GetUuidString()
-	object["timestamp"] = time.Unix(0, m.GetTimestamp()).Format("2006-01-02 15:04:05.000")
-	object["type"] = m.GetType()
-	object["logger"] = m.GetLogger()
-	object["severity"] = m.GetSeverity()
-	object["payload"] = m.GetPayload()
-	object["envversion"] = m.GetEnvVersion()
-	object["pid"] = m.GetPid()
-	object["hostname"] = m.GetHostname()
-
-	// store each dynamic field as a top level entry
-	for _, field := range m.Fields {
-		// ignore byte fields and empty fields
-		if field.Name != nil && field.GetValueType() != message.Field_BYTES {
-			object[*field.Name] = field.GetValue()
-		}
+	if f.deadLetters != nil {
+		f.replayStopChan = make(chan struct{})
+		f.replayDone = make(chan struct{})
+		go replayDeadLetters(
+			f.deadLetters, f.deadLetterPutter, f.conf.DeadLetterReplayOnStart,
+			f.conf.DeadLetterReplayInterval, &f.replayedRecordCount, or, f.replayStopChan,
+			f.replayDone,
+		)
 	}
-	return object
+
+	f.senderDone = make(chan struct{})
+	go runBatchSender(
+		f.batchChan, f.stopChan, f.flushTicker.C, f.conf.FlushCount, f.sendBatch, f.senderDone,
+	)
+	return nil
 }
 
 func (f *FirehoseOutput) ProcessMessage(pack *pipeline.PipelinePack) error {
 	atomic.AddInt64(&f.recvRecordCount, 1)
-	timestamp := time.Unix(0, pack.Message.GetTimestamp()).Format("2006-01-02 15:04:05.000")
-	object := f.parseFields(pack)
+	object := f.serializer.Object(pack.Message)
 
 	if len(object) == 0 {
 		atomic.AddInt64(&f.droppedRecordCount, 1)
 		return errors.New("No fields found in message")
 	}
 
-	if f.conf.TimestampColumn != "" {
-		// add Heka message's timestamp to column named in timestampColumn
-		object[f.conf.TimestampColumn] = timestamp
-	}
-
-	record, err := json.Marshal(object)
+	record, err := f.encoder.Encode(object)
 	if err != nil {
 		atomic.AddInt64(&f.droppedRecordCount, 1)
 		return err
 	}
-	// records ending in newlines will ensure the json objects written to
-	// firehose appear one per line
-	record = append(record, '\n')
 
 	// Send data to the batcher
 	f.batchChan <- MsgPack{record: record, queueCursor: pack.QueueCursor}
 	return nil
 }
 
-// batchSender is a go routine that gets sent:
-//   - messages to be batched
-//   - a stop signal
-//   - a flush signal
-func (f *FirehoseOutput) batchSender() {
-	ok := true
-	for ok {
-		select {
-		case <-f.stopChan:
-			ok = false
-			f.sendBatch()
-		case <-f.flushTicker.C:
-			f.sendBatch()
-		case pack := <-f.batchChan:
-			if len(pack.record) > 0 {
-				f.batchedRecords = append(f.batchedRecords, pack.record)
-				f.queueCursor = pack.queueCursor
-			}
-			if len(f.batchedRecords) >= f.conf.FlushCount {
-				f.sendBatch()
-			}
-		}
+// sendBatch puts a batch of records to Firehose
+func (f *FirehoseOutput) sendBatch(batch *recordBatch) {
+	res, err := f.client.PutRecordBatch(batch.records)
+
+	atomic.AddInt64(&f.sentRecordCount, int64(res.SentCount()))
+	atomic.AddInt64(&f.droppedRecordCount, int64(res.FailedCount()))
+	if err != nil {
+		f.or.LogError(err)
 	}
-}
 
-// sendBatch is called everytime the batchedRecords queue is full or
-// the timer has expired
-func (f *FirehoseOutput) sendBatch() {
-	count := int64(len(f.batchedRecords))
-	if count <= 0 {
+	// As in the KV Firehose output, the queue cursor only moves past the
+	// batch once every record has been sent or dead-lettered.  Otherwise it's
+	// held, so that the messages are read from Heka's queue again after a
+	// restart, up to a limit on how many batches are held.
+	f.cursors.Track(batch.queueCursor)
+	if res.FailedCount() > 0 && !f.deadLetter(batch.records, res) {
+		f.or.LogError(fmt.Errorf(
+			"holding the queue cursor for %d records that weren't delivered to '%s'",
+			res.FailedCount(), f.conf.Stream,
+		))
+		if released := f.cursors.Hold([]string{batch.queueCursor}); released > 0 {
+			atomic.AddInt64(&f.releasedCursorCount, int64(released))
+			f.or.LogError(fmt.Errorf(
+				"released the queue cursor for the %d oldest held batches, which won't be read again after a restart",
+				released,
+			))
+		}
 		return
 	}
+	f.cursors.Done([]string{batch.queueCursor})
+}
 
-	err := f.client.PutRecordBatch(f.batchedRecords)
-
-	// Update the cursor (these messages are either lost forever or sent)
-	// and reset the queue
-	f.or.UpdateCursor(f.queueCursor)
-	f.batchedRecords = f.batchedRecords[0:0]
+// deadLetter spills the records Firehose gave up on so that they can be
+// replayed later, and returns whether they were written
+func (f *FirehoseOutput) deadLetter(records [][]byte, res *aws.BatchResult) bool {
+	if f.deadLetters == nil {
+		return false
+	}
 
-	if err != nil {
-		// TODO: PutRecordBatch should return the number of successful records
-		//       so that the correct amount can be set here
-		atomic.AddInt64(&f.droppedRecordCount, count)
-		f.or.LogError(err)
-	} else {
-		atomic.AddInt64(&f.sentRecordCount, count)
+	if err := f.deadLetters.AppendFailed(f.conf.Stream, records, res); err != nil {
+		f.or.LogError(fmt.Errorf("can't write dead-letter records: %s", err.Error()))
+		return false
 	}
+	atomic.AddInt64(&f.deadLetterRecordCount, int64(res.FailedCount()))
+	return true
 }
 
 func (f *FirehoseOutput) CleanUp() {
 	if f.flushTicker != nil {
 		f.flushTicker.Stop()
 	}
+	if f.replayStopChan != nil {
+		close(f.replayStopChan)
+	}
+
+	// The final batch and any replay still running write to the backend and
+	// dead-letter queue, so those are left open if either outlasts the timeout
+	timeout := time.Duration(f.conf.ShutdownTimeout) * time.Millisecond
+	if !waitAll(timeout, f.senderDone, f.replayDone) {
+		f.or.LogError(fmt.Errorf(
+			"still sending after %s on shutdown, leaving the backend and dead-letter queue open", timeout,
+		))
+		return
+	}
+	closeSinks(f.deadLetters, f.backend)
 }
 
 func (f *FirehoseOutput) ReportMsg(msg *message.Message) error {
@@ -227,6 +295,12 @@ func (f *FirehoseOutput) ReportMsg(msg *message.Message) error {
 		atomic.LoadInt64(&f.droppedRecordCount), "count")
 	message.NewInt64Field(msg, "recvRecordCount",
 		atomic.LoadInt64(&f.recvRecordCount), "count")
+	message.NewInt64Field(msg, "deadLetterRecordCount",
+		atomic.LoadInt64(&f.deadLetterRecordCount), "count")
+	message.NewInt64Field(msg, "replayedRecordCount",
+		atomic.LoadInt64(&f.replayedRecordCount), "count")
+	message.NewInt64Field(msg, "releasedCursorCount",
+		atomic.LoadInt64(&f.releasedCursorCount), "count")
 	return nil
 }
 
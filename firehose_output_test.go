@@ -0,0 +1,83 @@
+package heka_clever_plugins
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/Clever/heka-clever-plugins/deadletter"
+	"github.com/stretchr/testify/assert"
+)
+
+// failNextPutter fails every record of the next fail batches it's sent
+type failNextPutter struct {
+	fail int
+}
+
+func (p *failNextPutter) PutRecord(record []byte) error {
+	_, err := p.PutRecordBatch([][]byte{record})
+	return err
+}
+
+func (p *failNextPutter) PutRecordBatch(records [][]byte) (*aws.BatchResult, error) {
+	if p.fail > 0 {
+		p.fail -= 1
+		return (&failingPutter{}).PutRecordBatch(records)
+	}
+	return aws.NewBatchResult(len(records), nil), nil
+}
+
+func newTestFirehoseOutput(t *testing.T, putter aws.RecordPutter) (*FirehoseOutput, *cursorRunner) {
+	output := &FirehoseOutput{}
+	conf := output.ConfigStruct().(*FirehoseOutputConfig)
+	conf.Stream = "test"
+	conf.Backend = "stdout"
+	conf.FlushInterval = 0
+	assert.NoError(t, output.Init(conf))
+	output.client = putter
+
+	or := &cursorRunner{stop: make(chan bool)}
+	output.or = or
+	output.cursors = newCursorTracker(or.UpdateCursor)
+	return output, or
+}
+
+func TestFirehoseHoldsCursorForUndeliveredRecords(t *testing.T) {
+	output, or := newTestFirehoseOutput(t, &failNextPutter{fail: 1})
+
+	t.Log("A batch that can't be sent or dead-lettered holds the cursor")
+	output.sendBatch(&recordBatch{records: [][]byte{[]byte(`{"a":1}`)}, queueCursor: "0:1"})
+	assert.Empty(t, or.cursors)
+	assert.Equal(t, int64(1), output.droppedRecordCount)
+	assert.NotEmpty(t, or.errors)
+
+	t.Log("Later batches don't move the cursor past it")
+	output.sendBatch(&recordBatch{records: [][]byte{[]byte(`{"a":2}`)}, queueCursor: "0:2"})
+	assert.Empty(t, or.cursors)
+	assert.Equal(t, int64(1), output.sentRecordCount)
+}
+
+func TestFirehoseHoldsCursorWhenDeadLetteringFails(t *testing.T) {
+	output, or := newTestFirehoseOutput(t, &failNextPutter{fail: 2})
+	dir, err := ioutil.TempDir("", "firehose-dead-letter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output.deadLetters, err = deadletter.New(dir, deadletter.Config{})
+	assert.NoError(t, err)
+
+	t.Log("Dead-lettered records move the cursor")
+	output.sendBatch(&recordBatch{records: [][]byte{[]byte(`{"a":1}`)}, queueCursor: "0:1"})
+	assert.Equal(t, []string{"0:1"}, or.cursors)
+	assert.Equal(t, int64(1), output.deadLetterRecordCount)
+
+	t.Log("Records that can't be written to the dead-letter queue hold it")
+	assert.NoError(t, output.deadLetters.Close())
+	assert.NoError(t, os.RemoveAll(dir))
+	assert.NoError(t, ioutil.WriteFile(dir, []byte("not a directory"), 0644))
+	output.sendBatch(&recordBatch{records: [][]byte{[]byte(`{"a":2}`)}, queueCursor: "0:2"})
+	output.sendBatch(&recordBatch{records: [][]byte{[]byte(`{"a":3}`)}, queueCursor: "0:3"})
+	assert.Equal(t, []string{"0:1"}, or.cursors)
+	assert.Equal(t, int64(1), output.deadLetterRecordCount)
+	assert.Equal(t, int64(1), output.sentRecordCount)
+}
@@ -0,0 +1,257 @@
+package heka_clever_plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/Clever/heka-clever-plugins/serializer"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+type KinesisOutput struct {
+	recvRecordCount    int64
+	sentRecordCount    int64
+	droppedRecordCount int64
+	batchChan          chan MsgPack
+	stopChan           chan bool
+	senderDone         chan struct{}
+	client             kinesisPutter
+	backend            aws.Backend
+	serializer         *serializer.Serializer
+	conf               *KinesisOutputConfig
+	or                 pipeline.OutputRunner
+	reportLock         sync.Mutex
+	flushTicker        *time.Ticker
+}
+
+// kinesisPutter sends records with their partition keys, e.g. *aws.Kinesis
+type kinesisPutter interface {
+	PutKeyedRecordBatch(records [][]byte, keys []string) (*aws.BatchResult, error)
+}
+
+// unkeyedPutter sends records to a backend without partition keys, e.g. the
+// "file" backend
+type unkeyedPutter struct {
+	aws.RecordPutter
+}
+
+func (p unkeyedPutter) PutKeyedRecordBatch(records [][]byte, keys []string) (*aws.BatchResult, error) {
+	return p.PutRecordBatch(records)
+}
+
+type KinesisOutputConfig struct {
+	// Kinesis stream name to put data to
+	Stream string `toml:"stream"`
+	// AWS credentials, endpoint and retry settings
+	AWSConfig
+	// Where records are written.  Backends other than "aws" get records
+	// without their partition keys.
+	StreamBackendConfig
+	// Message field whose value is used as the partition key.  Messages
+	// without it are partitioned by their contents.
+	PartitionKeyField string `toml:"partition_key_field"`
+	// Optional column to use as the message timestamp
+	TimestampColumn string `toml:"timestamp_column"`
+	// IANA time zone timestamps are written in, e.g. "America/Los_Angeles",
+	// or "Local" for the host's (default "UTC")
+	TimestampTimezone string `toml:"timestamp_timezone"`
+	// Interval at which accumulated messages should be bulk put to
+	// kinesis, in milliseconds (default 1000, i.e. 1 second).
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Number of messages that triggers a put to kinesis
+	// (default to 1, maximum is 500)
+	FlushCount int `toml:"flush_count"`
+	// How long to wait on shutdown for the last batch to be sent, in
+	// milliseconds (default 30000, i.e. 30 seconds)
+	ShutdownTimeout uint32 `toml:"shutdown_timeout"`
+	// What to do with records over Kinesis's 1 MiB limit: "split" them on
+	// newlines, "truncate" them or "drop" them (default).  Dropped records
+	// are counted in droppedRecordCount.
+	OversizeRecordPolicy string `toml:"oversize_record_policy"`
+}
+
+func (k *KinesisOutput) ConfigStruct() interface{} {
+	return &KinesisOutputConfig{
+		AWSConfig:            defaultAWSConfig(),
+		StreamBackendConfig:  defaultStreamBackendConfig(),
+		FlushInterval:        1000,
+		FlushCount:           1,
+		ShutdownTimeout:      30000,
+		TimestampTimezone:    "UTC",
+		OversizeRecordPolicy: string(aws.OversizeDrop),
+	}
+}
+
+// parseKinesisOversizePolicy validates a Kinesis output's oversize policy.
+// Kinesis outputs have no dead-letter queue, so records can be dropped but
+// not dead-lettered.
+func parseKinesisOversizePolicy(policy string) (aws.OversizePolicy, error) {
+	switch aws.OversizePolicy(policy) {
+	case aws.OversizeSplit, aws.OversizeTruncate, aws.OversizeDrop:
+		return aws.OversizePolicy(policy), nil
+	}
+	return "", fmt.Errorf(
+		"unknown oversize policy '%s' (expected '%s', '%s' or '%s')",
+		policy, aws.OversizeSplit, aws.OversizeTruncate, aws.OversizeDrop,
+	)
+}
+
+func (k *KinesisOutput) Init(config interface{}) error {
+	k.conf = config.(*KinesisOutputConfig)
+
+	if k.conf.FlushCount > aws.KinesisMaxBatchRecords {
+		return fmt.Errorf("FlushCount cannot exceed %d messages", aws.KinesisMaxBatchRecords)
+	}
+
+	k.batchChan = make(chan MsgPack, 100)
+
+	if k.conf.Stream == "" {
+		return fmt.Errorf("Unspecificed stream name")
+	}
+
+	var err error
+	k.serializer, err = newSerializer(
+		true, nil, false, string(serializer.BytesSkip), []string{"timestamp", k.conf.TimestampColumn},
+		serializer.DefaultTimestampLayout, k.conf.TimestampTimezone, nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	retry, err := k.conf.retryPolicy()
+	if err != nil {
+		return err
+	}
+	oversize, err := parseKinesisOversizePolicy(k.conf.OversizeRecordPolicy)
+	if err != nil {
+		return err
+	}
+
+	backendConf := k.conf.awsBackendConfig(k.conf.sessionConfig())
+	backendConf.Kinesis = &aws.KinesisConfig{
+		Endpoint: k.conf.EndpointURL,
+		Retry:    retry,
+		Oversize: oversize,
+	}
+	k.backend, err = aws.NewBackend(k.conf.Backend, backendConf)
+	if err != nil {
+		return err
+	}
+
+	putter, err := k.backend.NewRecordPutter(k.conf.Stream)
+	if err != nil {
+		return err
+	}
+	if keyed, ok := putter.(kinesisPutter); ok {
+		k.client = keyed
+	} else {
+		k.client = unkeyedPutter{putter}
+	}
+	return nil
+}
+
+func (k *KinesisOutput) Prepare(or pipeline.OutputRunner, h pipeline.PluginHelper) error {
+	k.or = or
+	k.stopChan = or.StopChan()
+
+	// Setup the batch ticker
+	if k.conf.FlushInterval > 0 {
+		k.flushTicker = time.NewTicker(time.Duration(k.conf.FlushInterval) * time.Millisecond)
+	} else {
+		// Create an empty Ticker so that the ticker channel can still be
+		// checked
+		ticker := time.Ticker{}
+		k.flushTicker = &ticker
+	}
+
+	k.senderDone = make(chan struct{})
+	go runBatchSender(
+		k.batchChan, k.stopChan, k.flushTicker.C, k.conf.FlushCount, k.sendBatch, k.senderDone,
+	)
+	return nil
+}
+
+func (k *KinesisOutput) ProcessMessage(pack *pipeline.PipelinePack) error {
+	atomic.AddInt64(&k.recvRecordCount, 1)
+	object := k.serializer.Object(pack.Message)
+
+	if len(object) == 0 {
+		atomic.AddInt64(&k.droppedRecordCount, 1)
+		return errors.New("No fields found in message")
+	}
+
+	partitionKey := ""
+	if k.conf.PartitionKeyField != "" {
+		if val, ok := pack.Message.GetFieldValue(k.conf.PartitionKeyField); ok {
+			partitionKey = fmt.Sprintf("%v", val)
+		}
+	}
+
+	record, err := json.Marshal(object)
+	if err != nil {
+		atomic.AddInt64(&k.droppedRecordCount, 1)
+		return err
+	}
+	record = append(record, '\n')
+
+	// Send data to the batcher
+	k.batchChan <- MsgPack{
+		record: record, partitionKey: partitionKey, queueCursor: pack.QueueCursor,
+	}
+	return nil
+}
+
+// sendBatch puts a batch of records to Kinesis
+func (k *KinesisOutput) sendBatch(batch *recordBatch) {
+	res, err := k.client.PutKeyedRecordBatch(batch.records, batch.keys)
+
+	atomic.AddInt64(&k.sentRecordCount, int64(res.SentCount()))
+	atomic.AddInt64(&k.droppedRecordCount, int64(res.FailedCount()))
+	if err != nil {
+		k.or.LogError(err)
+	}
+
+	// Update the cursor (these messages are either sent or lost forever)
+	k.or.UpdateCursor(batch.queueCursor)
+}
+
+func (k *KinesisOutput) CleanUp() {
+	if k.flushTicker != nil {
+		k.flushTicker.Stop()
+	}
+
+	// The final batch writes to the backend, so it's left open if the batch
+	// outlasts the timeout
+	timeout := time.Duration(k.conf.ShutdownTimeout) * time.Millisecond
+	if !waitAll(timeout, k.senderDone) {
+		k.or.LogError(fmt.Errorf("still sending after %s on shutdown, leaving the backend open", timeout))
+		return
+	}
+	closeSinks(nil, k.backend)
+}
+
+func (k *KinesisOutput) ReportMsg(msg *message.Message) error {
+	k.reportLock.Lock()
+	defer k.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "sentRecordCount",
+		atomic.LoadInt64(&k.sentRecordCount), "count")
+	message.NewInt64Field(msg, "droppedRecordCount",
+		atomic.LoadInt64(&k.droppedRecordCount), "count")
+	message.NewInt64Field(msg, "recvRecordCount",
+		atomic.LoadInt64(&k.recvRecordCount), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("KinesisOutput", func() interface{} {
+		return new(KinesisOutput)
+	})
+}
@@ -0,0 +1,212 @@
+package heka_clever_plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKinesisPutter collects the records and keys sent to it, and fails the
+// records at the indexes in fail
+type fakeKinesisPutter struct {
+	lock    sync.Mutex
+	records []string
+	keys    []string
+	fail    map[int]bool
+}
+
+func (p *fakeKinesisPutter) PutKeyedRecordBatch(records [][]byte, keys []string) (*aws.BatchResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	res := &aws.BatchResult{}
+	for i, record := range records {
+		if p.fail[i] {
+			res.Failed = append(res.Failed, aws.RecordFailure{Index: i, ErrorCode: "InternalFailure"})
+			continue
+		}
+		p.records = append(p.records, string(record))
+		p.keys = append(p.keys, keys[i])
+		res.Succeeded = append(res.Succeeded, i)
+	}
+	if len(res.Failed) > 0 {
+		return res, errors.New("records failed")
+	}
+	return res, nil
+}
+
+// cursorRunner is an OutputRunner that collects cursor updates and logged
+// errors
+type cursorRunner struct {
+	errorLogRunner
+	stop    chan bool
+	cursors []string
+}
+
+func (r *cursorRunner) StopChan() chan bool {
+	return r.stop
+}
+
+func (r *cursorRunner) UpdateCursor(cursor string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.cursors = append(r.cursors, cursor)
+}
+
+func newTestKinesisOutput(t *testing.T, putter kinesisPutter) (*KinesisOutput, *cursorRunner) {
+	output := &KinesisOutput{}
+	conf := output.ConfigStruct().(*KinesisOutputConfig)
+	conf.Stream = "test"
+	conf.Region = "us-west-1"
+	conf.PartitionKeyField = "district"
+	conf.FlushInterval = 0
+	conf.FlushCount = 2
+	assert.NoError(t, output.Init(conf))
+	output.client = putter
+	// Unbuffered, so every message processed is batched before the test stops
+	// the output
+	output.batchChan = make(chan MsgPack)
+
+	or := &cursorRunner{stop: make(chan bool)}
+	assert.NoError(t, output.Prepare(or, nil))
+	return output, or
+}
+
+func newKinesisTestPack(cursor string, fields map[string]string) *pipeline.PipelinePack {
+	m := &message.Message{}
+	for name, value := range fields {
+		field, _ := message.NewField(name, value, "")
+		m.AddField(field)
+	}
+	return &pipeline.PipelinePack{Message: m, QueueCursor: cursor}
+}
+
+// recordFields returns the value of field in each JSON record
+func recordFields(t *testing.T, records []string, field string) []interface{} {
+	values := make([]interface{}, len(records))
+	for i, record := range records {
+		object := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(record), &object))
+		values[i] = object[field]
+	}
+	return values
+}
+
+func TestKinesisOutputSendsKeyedBatches(t *testing.T) {
+	putter := &fakeKinesisPutter{}
+	output, or := newTestKinesisOutput(t, putter)
+
+	assert.NoError(t, output.ProcessMessage(newKinesisTestPack("0:1", map[string]string{"district": "d1"})))
+	assert.NoError(t, output.ProcessMessage(newKinesisTestPack("0:2", map[string]string{"a": "b"})))
+	assert.NoError(t, output.ProcessMessage(newKinesisTestPack("0:3", map[string]string{"district": "d2"})))
+	close(or.stop)
+	output.CleanUp()
+
+	t.Log("Records are sent with their message's partition key, if any")
+	assert.Equal(t, []interface{}{"d1", nil, "d2"}, recordFields(t, putter.records, "district"))
+	assert.Equal(t, []string{"d1", "", "d2"}, putter.keys)
+
+	t.Log("The cursor moves past each batch, including the one flushed on stop")
+	assert.Equal(t, []string{"0:2", "0:3"}, or.cursors)
+	assert.Equal(t, int64(3), output.sentRecordCount)
+	assert.Equal(t, int64(0), output.droppedRecordCount)
+	assert.Empty(t, or.errors)
+}
+
+func TestKinesisOutputCountsFailedRecordsAsDropped(t *testing.T) {
+	putter := &fakeKinesisPutter{fail: map[int]bool{1: true}}
+	output, or := newTestKinesisOutput(t, putter)
+
+	assert.NoError(t, output.ProcessMessage(newKinesisTestPack("0:1", map[string]string{"a": "1"})))
+	assert.NoError(t, output.ProcessMessage(newKinesisTestPack("0:2", map[string]string{"a": "2"})))
+	close(or.stop)
+	output.CleanUp()
+
+	assert.Equal(t, []interface{}{"1"}, recordFields(t, putter.records, "a"))
+	assert.Equal(t, int64(1), output.sentRecordCount)
+	assert.Equal(t, int64(1), output.droppedRecordCount)
+	assert.Len(t, or.errors, 1)
+	assert.Equal(t, []string{"0:2"}, or.cursors)
+}
+
+func TestKinesisOutputWritesToBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinesis-file-backend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output := &KinesisOutput{}
+	conf := output.ConfigStruct().(*KinesisOutputConfig)
+	conf.Stream = "test"
+	conf.Backend = "file"
+	conf.FileBackendDir = dir
+	conf.FlushInterval = 0
+	assert.NoError(t, output.Init(conf))
+	output.batchChan = make(chan MsgPack)
+
+	or := &cursorRunner{stop: make(chan bool)}
+	assert.NoError(t, output.Prepare(or, nil))
+	assert.NoError(t, output.ProcessMessage(newKinesisTestPack("0:1", map[string]string{"a": "1"})))
+	close(or.stop)
+	output.CleanUp()
+
+	t.Log("Records are written by the backend, which is closed on shutdown")
+	files, err := filepath.Glob(filepath.Join(dir, "test-*"))
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		contents, err := ioutil.ReadFile(files[0])
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{"1"}, recordFields(t, []string{string(contents)}, "a"))
+	}
+	assert.Equal(t, []string{"0:1"}, or.cursors)
+}
+
+// blockingKinesisPutter blocks every put until unblock is closed
+type blockingKinesisPutter struct {
+	unblock chan struct{}
+}
+
+func (p *blockingKinesisPutter) PutKeyedRecordBatch(records [][]byte, keys []string) (*aws.BatchResult, error) {
+	<-p.unblock
+	return aws.NewBatchResult(len(records), nil), nil
+}
+
+func TestKinesisOutputCleanUpTimesOut(t *testing.T) {
+	putter := &blockingKinesisPutter{unblock: make(chan struct{})}
+	defer close(putter.unblock)
+	output, or := newTestKinesisOutput(t, putter)
+	output.conf.ShutdownTimeout = 10
+
+	assert.NoError(t, output.ProcessMessage(newKinesisTestPack("0:1", map[string]string{"a": "1"})))
+	close(or.stop)
+
+	t.Log("CleanUp gives up on a batch that outlasts shutdown_timeout")
+	start := time.Now()
+	output.CleanUp()
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Len(t, or.errors, 1)
+}
+
+func TestParseKinesisOversizePolicy(t *testing.T) {
+	policy, err := parseKinesisOversizePolicy("drop")
+	assert.NoError(t, err)
+	assert.Equal(t, aws.OversizeDrop, policy)
+
+	policy, err = parseKinesisOversizePolicy("split")
+	assert.NoError(t, err)
+	assert.Equal(t, aws.OversizeSplit, policy)
+
+	t.Log("Kinesis outputs have no dead-letter queue")
+	_, err = parseKinesisOversizePolicy("dead-letter")
+	assert.Error(t, err)
+}
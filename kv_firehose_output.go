@@ -1,198 +1,480 @@
 package heka_clever_plugins
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Clever/heka-clever-plugins/aws"
 	"github.com/Clever/heka-clever-plugins/batcher"
+	"github.com/Clever/heka-clever-plugins/deadletter"
+	"github.com/Clever/heka-clever-plugins/serializer"
 
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
 type KVFirehoseOutput struct {
-	conf     *KVFirehoseOutputConfig
-	or       pipeline.OutputRunner
-	batchers map[string]batcher.Batcher
-
-	mockEndpoint string
-
-	reportLock         sync.Mutex
-	recvRecordCount    int64
-	sentRecordCount    int64
-	droppedRecordCount int64
+	conf       *KVFirehoseOutputConfig
+	or         pipeline.OutputRunner
+	series     *seriesRegistry
+	cursors    *cursorTracker
+	router     *seriesRouter
+	serializer *serializer.Serializer
+	encoder    serializer.Encoder
+	evictStop  chan struct{}
+	// Closed once the batchers have been flushed and closed on shutdown.  It
+	// stays open if they're still flushing after shutdown_timeout.
+	stopped chan struct{}
+
+	backend aws.Backend
+
+	deadLetters    *deadletter.Queue
+	replayStopChan chan struct{}
+	replayDone     chan struct{}
+
+	reportLock            sync.Mutex
+	recvRecordCount       int64
+	sentRecordCount       int64
+	droppedRecordCount    int64
+	deadLetterRecordCount int64
+	replayedRecordCount   int64
+	releasedCursorCount   int64
+	evictedSeriesCount    int64
+	overflowRecordCount   int64
+	unmatchedRecordCount  int64
 }
 
+// What to do with a message for a new series once max_series is reached
+const (
+	seriesOverflowDrop          = "drop"
+	seriesOverflowDefaultStream = "default-stream"
+	seriesOverflowError         = "error"
+)
+
 type KVFirehoseOutputConfig struct {
 	// The value of this field is used as the firehose `series` (or stream) name
 	SeriesField string `toml:"series_field"`
-	// AWS region the stream lives in
-	Region string `toml:"region"`
+	// AWS, backend, record format and dead-letter settings.  Without a
+	// dead_letter_dir, records Firehose rejects hold back the queue cursor
+	// until Heka is restarted.
+	FirehoseDeliveryConfig
 	// Interval at which accumulated messages should be bulk put to
 	// firehose, in milliseconds (default 1000, i.e. 1 second).
 	FlushInterval uint32 `toml:"flush_interval"`
-	// Number of messages that triggers a push to firehose
-	// (default to 1, maximum is 500)
+	// Number of messages that triggers a push to firehose (default to 500,
+	// the maximum).  Batchers used to ignore this setting, so the old default
+	// of 1 never took effect; set it to 1 to send every message on its own.
 	FlushCount int `toml:"flush_count"`
 	// Size of batch that triggers a push to firehose
 	// (default to 1024 * 1024 (1mb))
 	FlushSize int `toml:"flush_size"`
+	// Minimum age of a batch before it's sent, even when full, in
+	// milliseconds (default 0).  Caps how often each series is flushed.
+	FlushMinAge uint32 `toml:"flush_min_age"`
+	// Columns the message timestamp is written to (default ["timestamp",
+	// "time"], both kept for reverse compatibility)
+	TimestampColumns []string `toml:"timestamp_columns"`
+	// How the message timestamp is written: "rfc3339", "epoch_s", "epoch_ms",
+	// "epoch_ns", or a Go time layout (default "2006-01-02 15:04:05.000")
+	TimestampLayout string `toml:"timestamp_layout"`
+	// IANA time zone the message timestamp is written in, e.g.
+	// "America/Los_Angeles" or "Local" (default "UTC")
+	TimestampTimezone string `toml:"timestamp_timezone"`
+	// Include the base Heka fields (uuid, type, logger, severity, payload,
+	// envversion, pid and hostname) in records (default true)
+	IncludeBaseFields bool `toml:"include_base_fields"`
+	// Column names for fields, keyed by field name (base fields by their
+	// column name, e.g. "hostname")
+	RenameFields map[string]string `toml:"rename_fields"`
+	// Write every value of a field with several values as an array, instead
+	// of only its first value (default false)
+	MultiValueArrays bool `toml:"multi_value_arrays"`
+	// What to do with bytes fields: "skip" them (the default), or write them
+	// as "base64" strings
+	BytesFields string `toml:"bytes_fields"`
+	// Flush and close a series' batcher once it has gone this long without a
+	// message, in seconds (default 0, i.e. series are never closed)
+	SeriesIdleTimeout uint32 `toml:"series_idle_timeout"`
+	// Maximum number of series with a live batcher (default 0, i.e. unlimited)
+	MaxSeries int `toml:"max_series"`
+	// What to do with a message for a new series once max_series is reached:
+	// "drop" it, send it to default_stream ("default-stream"), or drop it and
+	// log an "error" (the default)
+	SeriesOverflowPolicy string `toml:"series_overflow_policy"`
+	// Series that may be written to.  If both this and allowed_series_pattern
+	// are empty, every series is allowed.
+	AllowedSeries []string `toml:"allowed_series"`
+	// Regular expression matching series that may be written to.  It must
+	// match the whole series name, e.g. "api" doesn't allow "evil-api-x".
+	AllowedSeriesPattern string `toml:"allowed_series_pattern"`
+	// Stream each series is written to, if not the stream named after it.
+	// Streams may use %{fieldname} to include message fields, e.g.
+	// "%{env}-api-requests".
+	SeriesStreams map[string]string `toml:"series_streams"`
+	// Stream that messages for series that aren't allowed (or whose stream
+	// can't be built) are sent to, as well as messages under the
+	// "default-stream" policy.  If empty, those messages are dropped.  It
+	// doesn't count towards max_series.
+	DefaultStream string `toml:"default_stream"`
+	// How long to wait on shutdown for buffered messages to be flushed, in
+	// milliseconds (default 30000, i.e. 30 seconds)
+	ShutdownTimeout uint32 `toml:"shutdown_timeout"`
+	// Number of batches per series that may be sent to firehose at once
+	// (default 1)
+	FlushConcurrency int `toml:"flush_concurrency"`
+	// If true, a batch only makes room for another once every earlier batch
+	// of its series has been sent (default true)
+	FlushOrdered bool `toml:"flush_ordered"`
 }
 
 type syncPutterAdapter struct {
+	stream string
 	client aws.RecordPutter
 	output *KVFirehoseOutput
 }
 
-func (s *syncPutterAdapter) Flush(batch [][]byte) {
-	count := int64(len(batch))
+func (s *syncPutterAdapter) Flush(batch [][]byte, cursors []string) {
+	res, err := s.client.PutRecordBatch(batch)
 
-	err := s.client.PutRecordBatch(batch)
+	atomic.AddInt64(&s.output.sentRecordCount, int64(res.SentCount()))
+	atomic.AddInt64(&s.output.droppedRecordCount, int64(res.FailedCount()))
 	if err != nil {
-		// TODO: PutRecordBatch should return the number of successful records
-		//       so that the correct amount can be set here
-		atomic.AddInt64(&s.output.droppedRecordCount, count)
 		s.output.or.LogError(err)
-	} else {
-		atomic.AddInt64(&s.output.sentRecordCount, count)
 	}
+
+	// The queue cursor only moves past the messages once every record has
+	// been sent or dead-lettered.  Otherwise it's held, so that the messages
+	// are read from Heka's queue again after a restart, up to a limit on how
+	// many messages are held.
+	if res.FailedCount() > 0 && !s.deadLetter(batch, res) {
+		s.output.or.LogError(fmt.Errorf(
+			"holding the queue cursor for %d records that weren't delivered to '%s'",
+			res.FailedCount(), s.stream,
+		))
+		if released := s.output.cursors.Hold(cursors); released > 0 {
+			atomic.AddInt64(&s.output.releasedCursorCount, int64(released))
+			s.output.or.LogError(fmt.Errorf(
+				"released the queue cursor for the %d oldest held messages, which won't be read again after a restart",
+				released,
+			))
+		}
+		return
+	}
+	s.output.cursors.Done(cursors)
+}
+
+// deadLetter spills the records Firehose gave up on so that they can be
+// replayed later, and returns whether they were written
+func (s *syncPutterAdapter) deadLetter(batch [][]byte, res *aws.BatchResult) bool {
+	deadLetters := s.output.deadLetters
+	if deadLetters == nil {
+		return false
+	}
+
+	if err := deadLetters.AppendFailed(s.stream, batch, res); err != nil {
+		s.output.or.LogError(fmt.Errorf("can't write dead-letter records: %s", err.Error()))
+		return false
+	}
+	atomic.AddInt64(&s.output.deadLetterRecordCount, int64(res.FailedCount()))
+	return true
 }
 
 func (f *KVFirehoseOutput) ConfigStruct() interface{} {
 	return &KVFirehoseOutputConfig{
-		FlushInterval: 1000,
-		FlushCount:    1,
-		FlushSize:     1024 * 1024,
+		FirehoseDeliveryConfig: defaultFirehoseDeliveryConfig(),
+		FlushInterval:          1000,
+		FlushCount:             500,
+		FlushSize:              1024 * 1024,
+		ShutdownTimeout:        30000,
+		FlushConcurrency:       1,
+		FlushOrdered:           true,
+		TimestampColumns:       []string{"timestamp", "time"},
+		TimestampLayout:        serializer.DefaultTimestampLayout,
+		TimestampTimezone:      "UTC",
+		IncludeBaseFields:      true,
+		BytesFields:            string(serializer.BytesSkip),
+		SeriesOverflowPolicy:   seriesOverflowError,
 	}
 }
 
 func (f *KVFirehoseOutput) Init(config interface{}) error {
 	f.conf = config.(*KVFirehoseOutputConfig)
 
-	if f.conf.FlushCount > 500 {
-		return fmt.Errorf("FlushCount cannot exceed 500 messages")
+	if f.conf.FlushConcurrency < 1 {
+		return fmt.Errorf("FlushConcurrency must be at least 1")
+	}
+	if f.conf.FlushCount < 1 || f.conf.FlushCount > 500 {
+		return fmt.Errorf("FlushCount must be between 1 and 500 messages")
+	}
+	if f.conf.FlushSize < 1 {
+		return fmt.Errorf("FlushSize must be at least 1 byte")
 	}
 
-	f.batchers = map[string]batcher.Batcher{}
-
-	if os.Getenv("HEKA_TESTING") != "" {
-		endpoint := os.Getenv("MOCK_FIREHOSE_ENDPOINT")
-		if endpoint == "" {
-			return fmt.Errorf("env-var MOCK_FIREHOSE_ENDPOINT not found for heka-testing")
+	switch f.conf.SeriesOverflowPolicy {
+	case seriesOverflowDrop, seriesOverflowError:
+	case seriesOverflowDefaultStream:
+		if f.conf.DefaultStream == "" {
+			return fmt.Errorf("series_overflow_policy 'default-stream' needs a default_stream")
 		}
-		fmt.Println("Mocking out firehose output: " + endpoint)
-		f.mockEndpoint = endpoint
+	default:
+		return fmt.Errorf("Unknown series_overflow_policy '%s'", f.conf.SeriesOverflowPolicy)
 	}
 
-	return nil
+	var err error
+	f.serializer, err = newSerializer(
+		f.conf.IncludeBaseFields, f.conf.RenameFields, f.conf.MultiValueArrays, f.conf.BytesFields,
+		f.conf.TimestampColumns, f.conf.TimestampLayout, f.conf.TimestampTimezone,
+		[]string{f.conf.SeriesField},
+	)
+	if err != nil {
+		return err
+	}
+
+	f.encoder, err = newEncoder(
+		f.conf.RecordFormat, f.conf.RecordColumns, f.conf.AvroSchemaFile, false,
+		f.conf.AggregateRecords, f.conf.OversizeRecordPolicy,
+	)
+	if err != nil {
+		return err
+	}
+
+	router, err := newSeriesRouter(
+		f.conf.AllowedSeries, f.conf.AllowedSeriesPattern, f.conf.SeriesStreams, f.conf.DefaultStream,
+	)
+	if err != nil {
+		return err
+	}
+	f.router = router
+
+	f.series = newSeriesRegistry(f.createBatcher, f.conf.MaxSeries, f.conf.DefaultStream)
+
+	firehoseConf, err := f.conf.firehoseConfig()
+	if err != nil {
+		return err
+	}
+
+	f.backend, err = aws.NewBackend(f.conf.Backend, f.conf.backendConfig(firehoseConf))
+	if err != nil {
+		return err
+	}
+
+	f.deadLetters, err = f.conf.deadLetterQueue(firehoseConf.Retry)
+	return err
 }
 
 func (f *KVFirehoseOutput) Prepare(or pipeline.OutputRunner, h pipeline.PluginHelper) error {
 	f.or = or
+	f.cursors = newCursorTracker(or.UpdateCursor)
+
+	if f.deadLetters != nil {
+		f.replayStopChan = make(chan struct{})
+		f.replayDone = make(chan struct{})
+		go replayDeadLetters(
+			f.deadLetters, f.createClient, f.conf.DeadLetterReplayOnStart,
+			f.conf.DeadLetterReplayInterval, &f.replayedRecordCount, or, f.replayStopChan,
+			f.replayDone,
+		)
+	}
+
+	if f.conf.SeriesIdleTimeout > 0 {
+		f.evictStop = make(chan struct{})
+		go f.evictIdleSeries(time.Duration(f.conf.SeriesIdleTimeout)*time.Second, f.evictStop)
+	}
 
-	go f.listenForStop(or.StopChan())
+	f.stopped = make(chan struct{})
+	go f.listenForStop(or.StopChan(), f.stopped)
 
 	return nil
 }
 
-func (f *KVFirehoseOutput) listenForStop(stopChan <-chan bool) {
+func (f *KVFirehoseOutput) listenForStop(stopChan <-chan bool, stopped chan<- struct{}) {
 	<-stopChan
 
-	for _, batch := range f.batchers {
-		batch.Flush()
+	if f.evictStop != nil {
+		close(f.evictStop)
 	}
-}
 
-func (f *KVFirehoseOutput) createBatcherSync(seriesName string) batcher.Sync {
-	var client aws.RecordPutter
+	timeout := time.Duration(f.conf.ShutdownTimeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	if f.mockEndpoint == "" {
-		client = aws.NewFirehose(f.conf.Region, seriesName)
-	} else {
-		fmt.Printf("Mocking out firehose output '%s' to %s\n", seriesName, f.mockEndpoint)
-		client = aws.NewMockRecordPutter(seriesName, f.mockEndpoint)
+	if err := f.series.CloseAll(ctx); err != nil {
+		// The last batches are still flushing in the background
+		f.or.LogError(fmt.Errorf("%s on shutdown", err.Error()))
+		return
 	}
-
-	return &syncPutterAdapter{client: client, output: f}
+	close(stopped)
 }
 
-func (f *KVFirehoseOutput) parseFields(pack *pipeline.PipelinePack) (
-	seriesName string, object map[string]interface{},
-) {
-	m := pack.Message
-	object = make(map[string]interface{})
+func (f *KVFirehoseOutput) createClient(seriesName string) (aws.RecordPutter, error) {
+	client, err := f.backend.NewRecordPutter(seriesName)
+	if err != nil {
+		return nil, err
+	}
 
-	// Adding the timestamp twice to maintain reverse compatibility
-	object["timestamp"] = time.Unix(0, m.GetTimestamp()).Format("2006-01-02 15:04:05.000")
-	object["time"] = time.Unix(0, m.GetTimestamp()).Format("2006-01-02 15:04:05.000")
+	return f.conf.wrapClient(client), nil
+}
 
-	// Handle standard heka fields
-	object["uuid"] = m.GetUuidString()
-	object["type"] = m.GetType()
-	object["logger"] = m.GetLogger()
-	object["severity"] = m.GetSeverity()
-	object["payload"] = m.GetPayload()
-	object["envversion"] = m.GetEnvVersion()
-	object["pid"] = m.GetPid()
-	object["hostname"] = m.GetHostname()
+func (f *KVFirehoseOutput) createBatcherSync(seriesName string) (batcher.Sync, error) {
+	client, err := f.createClient(seriesName)
+	if err != nil {
+		return nil, err
+	}
 
-	seriesName = ""
-	// store each dynamic field as a top level entry
-	for _, field := range m.Fields {
-		fieldType := field.GetValueType()
+	return &syncPutterAdapter{stream: seriesName, client: client, output: f}, nil
+}
 
-		if *field.Name == f.conf.SeriesField && fieldType == message.Field_STRING {
-			seriesName = field.GetValue().(string)
-		} else if field.Name != nil && fieldType != message.Field_BYTES {
-			// ignore byte fields and empty fields
-			object[*field.Name] = field.GetValue()
-		}
-	}
-	return seriesName, object
+// seriesName returns the value of the message's series field, or "" if it
+// doesn't have one
+func (f *KVFirehoseOutput) seriesName(m *message.Message) string {
+	value, _ := m.GetFieldValue(f.conf.SeriesField)
+	seriesName, _ := value.(string)
+	return seriesName
+}
+
+// drop counts a message that won't be sent, and lets the queue cursor move
+// past it
+func (f *KVFirehoseOutput) drop(cursor string) {
+	atomic.AddInt64(&f.droppedRecordCount, 1)
+	f.cursors.Drop(cursor)
 }
 
 func (f *KVFirehoseOutput) ProcessMessage(pack *pipeline.PipelinePack) error {
 	atomic.AddInt64(&f.recvRecordCount, 1)
-	seriesName, object := f.parseFields(pack)
+	seriesName := f.seriesName(pack.Message)
+	object := f.serializer.Object(pack.Message)
 
 	if seriesName == "" {
-		atomic.AddInt64(&f.droppedRecordCount, 1)
+		f.drop(pack.QueueCursor)
 		return errors.New("No series name found in message")
 	}
 
 	if len(object) == 0 {
-		atomic.AddInt64(&f.droppedRecordCount, 1)
+		f.drop(pack.QueueCursor)
 		return errors.New("No fields found in message")
 	}
 
-	record, err := json.Marshal(object)
+	stream, matched := f.router.route(seriesName, pack.Message)
+	if !matched {
+		atomic.AddInt64(&f.unmatchedRecordCount, 1)
+	}
+	if stream == "" {
+		f.drop(pack.QueueCursor)
+		return fmt.Errorf("Series '%s' isn't allowed", seriesName)
+	}
+
+	record, err := f.encoder.Encode(object)
 	if err != nil {
-		atomic.AddInt64(&f.droppedRecordCount, 1)
+		f.drop(pack.QueueCursor)
 		return err
 	}
 
-	batch, ok := f.batchers[seriesName]
-	if !ok {
-		sync := f.createBatcherSync(seriesName)
-		batch = batcher.New(sync)
-		f.batchers[seriesName] = batch
+	batch, err := f.series.Get(stream)
+	if err == errTooManySeries {
+		atomic.AddInt64(&f.overflowRecordCount, 1)
+		switch f.conf.SeriesOverflowPolicy {
+		case seriesOverflowDrop:
+			f.drop(pack.QueueCursor)
+			return nil
+		case seriesOverflowDefaultStream:
+			batch, err = f.series.Get(f.conf.DefaultStream)
+		default:
+			err = fmt.Errorf("Can't start series '%s', already at max_series (%d)", stream, f.conf.MaxSeries)
+		}
+	}
+	if err != nil {
+		f.drop(pack.QueueCursor)
+		return err
 	}
-	batch.Send(record)
 
-	// We're forgoing any benefits of disk buffering.  With or without it all the messages are
-	// lost if the container crashes.  Supporting would significantly complicate the code.
-	f.or.UpdateCursor(pack.QueueCursor)
+	// The queue cursor is only advanced once this message, and every message
+	// before it, has been flushed by its batcher
+	f.cursors.Track(pack.QueueCursor)
+	err = batch.SendWithCursor(record, pack.QueueCursor)
+	if err == batcher.ErrClosed {
+		// The series was evicted since we looked it up, so start it again
+		batch, err = f.series.Get(stream)
+		if err == nil {
+			err = batch.SendWithCursor(record, pack.QueueCursor)
+		}
+	}
+	if err != nil {
+		f.cursors.Done([]string{pack.QueueCursor})
+		atomic.AddInt64(&f.droppedRecordCount, 1)
+		return err
+	}
 
 	return nil
 }
 
+func (f *KVFirehoseOutput) batcherOptions() batcher.Options {
+	return batcher.Options{
+		FlushInterval:    time.Duration(f.conf.FlushInterval) * time.Millisecond,
+		FlushCount:       f.conf.FlushCount,
+		FlushSize:        f.conf.FlushSize,
+		FlushMinAge:      time.Duration(f.conf.FlushMinAge) * time.Millisecond,
+		FlushConcurrency: f.conf.FlushConcurrency,
+		FlushOrdered:     f.conf.FlushOrdered,
+	}
+}
+
+func (f *KVFirehoseOutput) createBatcher(seriesName string) (batcher.Batcher, error) {
+	sync, err := f.createBatcherSync(seriesName)
+	if err != nil {
+		return nil, err
+	}
+	return batcher.NewWithOptions(sync, f.batcherOptions()), nil
+}
+
+// evictIdleSeries flushes and closes the batchers of series that haven't had
+// a message in timeout, until stop is closed
+func (f *KVFirehoseOutput) evictIdleSeries(timeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			f.evictSeriesIdleSince(time.Now().Add(-timeout))
+		}
+	}
+}
+
+func (f *KVFirehoseOutput) evictSeriesIdleSince(cutoff time.Time) {
+	timeout := time.Duration(f.conf.ShutdownTimeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	evicted, err := f.series.CloseIdle(ctx, cutoff)
+	atomic.AddInt64(&f.evictedSeriesCount, int64(evicted))
+	if err != nil {
+		f.or.LogError(fmt.Errorf("%s while closing idle series", err.Error()))
+	}
+}
+
 func (f *KVFirehoseOutput) CleanUp() {
+	if f.replayStopChan != nil {
+		close(f.replayStopChan)
+	}
+
+	// The last batches may still be flushing, and a replay may still be
+	// running.  Both write to the backend and dead-letter queue, so those are
+	// left open if either outlasts the timeout.
+	timeout := time.Duration(f.conf.ShutdownTimeout) * time.Millisecond
+	if !waitAll(timeout, f.stopped, f.replayDone) {
+		f.or.LogError(fmt.Errorf(
+			"still flushing after %s on shutdown, leaving the backend and dead-letter queue open", timeout,
+		))
+		return
+	}
+	closeSinks(f.deadLetters, f.backend)
 }
 
 func (f *KVFirehoseOutput) ReportMsg(msg *message.Message) error {
@@ -205,6 +487,39 @@ func (f *KVFirehoseOutput) ReportMsg(msg *message.Message) error {
 		atomic.LoadInt64(&f.droppedRecordCount), "count")
 	message.NewInt64Field(msg, "recvRecordCount",
 		atomic.LoadInt64(&f.recvRecordCount), "count")
+	message.NewInt64Field(msg, "deadLetterRecordCount",
+		atomic.LoadInt64(&f.deadLetterRecordCount), "count")
+	message.NewInt64Field(msg, "replayedRecordCount",
+		atomic.LoadInt64(&f.replayedRecordCount), "count")
+	message.NewInt64Field(msg, "releasedCursorCount",
+		atomic.LoadInt64(&f.releasedCursorCount), "count")
+
+	// Back-pressure from slow flushes, summed over every series
+	var inFlight, flushWaits, blockedSends int64
+	var flushWaitTime time.Duration
+	batchers := f.series.Batchers()
+	for _, batch := range batchers {
+		stats := batch.Stats()
+		inFlight += int64(stats.InFlight)
+		flushWaits += stats.FlushWaits
+		flushWaitTime += stats.FlushWaitTime
+		blockedSends += stats.BlockedSends
+	}
+
+	message.NewInt64Field(msg, "inFlightFlushCount", inFlight, "count")
+	message.NewInt64Field(msg, "flushWaitCount", flushWaits, "count")
+	message.NewInt64Field(msg, "flushWaitTime",
+		int64(flushWaitTime/time.Millisecond), "ms")
+	message.NewInt64Field(msg, "blockedSendCount", blockedSends, "count")
+
+	message.NewInt64Field(msg, "activeSeriesCount", int64(len(batchers)), "count")
+	message.NewStringField(msg, "activeSeries", strings.Join(f.series.Names(), ","))
+	message.NewInt64Field(msg, "evictedSeriesCount",
+		atomic.LoadInt64(&f.evictedSeriesCount), "count")
+	message.NewInt64Field(msg, "overflowRecordCount",
+		atomic.LoadInt64(&f.overflowRecordCount), "count")
+	message.NewInt64Field(msg, "unmatchedRecordCount",
+		atomic.LoadInt64(&f.unmatchedRecordCount), "count")
 	return nil
 }
 
@@ -0,0 +1,195 @@
+package heka_clever_plugins
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/Clever/heka-clever-plugins/batcher"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVFirehoseBatcherOptions(t *testing.T) {
+	output := &KVFirehoseOutput{}
+	conf := output.ConfigStruct().(*KVFirehoseOutputConfig)
+	assert.Equal(t, 500, conf.FlushCount)
+	conf.FlushInterval = 250
+	conf.FlushCount = 100
+	conf.FlushMinAge = 50
+	conf.FlushConcurrency = 4
+	output.conf = conf
+
+	assert.Equal(t, batcher.Options{
+		FlushInterval:    250 * time.Millisecond,
+		FlushCount:       100,
+		FlushSize:        1024 * 1024,
+		FlushMinAge:      50 * time.Millisecond,
+		FlushConcurrency: 4,
+		FlushOrdered:     true,
+	}, output.batcherOptions())
+}
+
+func TestKVFirehoseRejectsFlushLimitsBelowOne(t *testing.T) {
+	for _, change := range []func(*KVFirehoseOutputConfig){
+		func(conf *KVFirehoseOutputConfig) { conf.FlushCount = 0 },
+		func(conf *KVFirehoseOutputConfig) { conf.FlushCount = 501 },
+		func(conf *KVFirehoseOutputConfig) { conf.FlushSize = 0 },
+	} {
+		output := &KVFirehoseOutput{}
+		conf := output.ConfigStruct().(*KVFirehoseOutputConfig)
+		conf.SeriesField = "series"
+		conf.Backend = "stdout"
+		change(conf)
+		assert.Error(t, output.Init(conf))
+	}
+}
+
+// recordingPutter collects every record sent to it
+type recordingPutter struct {
+	lock    sync.Mutex
+	records []string
+}
+
+func (p *recordingPutter) PutRecord(record []byte) error {
+	_, err := p.PutRecordBatch([][]byte{record})
+	return err
+}
+
+func (p *recordingPutter) PutRecordBatch(records [][]byte) (*aws.BatchResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, record := range records {
+		p.records = append(p.records, string(record))
+	}
+	return aws.NewBatchResult(len(records), nil), nil
+}
+
+func newTestKVFirehoseOutput(putter aws.RecordPutter) *KVFirehoseOutput {
+	output := &KVFirehoseOutput{}
+	output.conf = output.ConfigStruct().(*KVFirehoseOutputConfig)
+	output.conf.FlushInterval = 60 * 60 * 1000
+	output.conf.FlushCount = 500
+	output.series = newSeriesRegistry(output.createBatcher, 0, "")
+	output.cursors = newCursorTracker(func(string) {})
+	output.backend = aws.BackendFunc(func(stream string) (aws.RecordPutter, error) {
+		return putter, nil
+	})
+	return output
+}
+
+func TestKVFirehoseEvictsIdleSeries(t *testing.T) {
+	putter := &recordingPutter{}
+	output := newTestKVFirehoseOutput(putter)
+
+	output.series.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	idle, err := output.series.Get("idle")
+	assert.NoError(t, err)
+	assert.NoError(t, idle.Send([]byte(`{"a":1}`)))
+	output.series.now = time.Now
+	_, err = output.series.Get("busy")
+	assert.NoError(t, err)
+
+	output.evictSeriesIdleSince(time.Now().Add(-time.Minute))
+
+	t.Log("Idle series are flushed and closed")
+	assert.Equal(t, []string{`{"a":1}`}, putter.records)
+	assert.Equal(t, batcher.ErrClosed, idle.Send([]byte(`{"a":2}`)))
+	assert.Equal(t, int64(1), output.evictedSeriesCount)
+	assert.Equal(t, []string{"busy"}, output.series.Names())
+}
+
+// failingPutter rejects every record
+type failingPutter struct{}
+
+func (p *failingPutter) PutRecord(record []byte) error {
+	_, err := p.PutRecordBatch([][]byte{record})
+	return err
+}
+
+func (p *failingPutter) PutRecordBatch(records [][]byte) (*aws.BatchResult, error) {
+	err := errors.New("stream is down")
+	return aws.NewBatchResult(len(records), err), err
+}
+
+// errorLogRunner is an OutputRunner that only collects logged errors
+type errorLogRunner struct {
+	pipeline.OutputRunner
+	lock   sync.Mutex
+	errors []error
+}
+
+func (r *errorLogRunner) LogError(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.errors = append(r.errors, err)
+}
+
+func TestKVFirehoseHoldsCursorForUndeliveredRecords(t *testing.T) {
+	output := newTestKVFirehoseOutput(&failingPutter{})
+	or := &errorLogRunner{}
+	output.or = or
+	updates := []string{}
+	output.cursors = newCursorTracker(func(cursor string) {
+		updates = append(updates, cursor)
+	})
+
+	flusher, err := output.createBatcherSync("requests")
+	assert.NoError(t, err)
+
+	t.Log("Records that can't be sent or dead-lettered hold the cursor")
+	output.cursors.Track("0:1")
+	output.cursors.Track("0:2")
+	flusher.Flush([][]byte{[]byte(`{"a":1}`), []byte(`{"a":2}`)}, []string{"0:1", "0:2"})
+	assert.Empty(t, updates)
+	assert.Equal(t, 2, output.cursors.Len())
+	assert.Equal(t, int64(2), output.droppedRecordCount)
+	assert.NotEmpty(t, or.errors)
+
+	t.Log("Later messages don't move the cursor past them")
+	output.cursors.Drop("0:3")
+	assert.Empty(t, updates)
+
+	t.Log("Past the limit on held messages, the oldest are released")
+	output.cursors.maxHeld = 2
+	output.cursors.Track("0:4")
+	flusher.Flush([][]byte{[]byte(`{"a":4}`)}, []string{"0:4"})
+	assert.Equal(t, []string{"0:1"}, updates)
+	assert.Equal(t, int64(1), output.releasedCursorCount)
+	assert.Equal(t, 3, output.cursors.Len())
+}
+
+func TestKVFirehoseTimestampConfig(t *testing.T) {
+	m := &message.Message{}
+	m.SetTimestamp(time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC).UnixNano())
+	field, err := message.NewField("series", "requests", "")
+	assert.NoError(t, err)
+	m.AddField(field)
+
+	output := &KVFirehoseOutput{}
+	conf := output.ConfigStruct().(*KVFirehoseOutputConfig)
+	conf.SeriesField = "series"
+	conf.Backend = "stdout"
+	conf.IncludeBaseFields = false
+	assert.NoError(t, output.Init(conf))
+	assert.Equal(t, map[string]interface{}{
+		"timestamp": "2016-05-04 03:02:01.000", "time": "2016-05-04 03:02:01.000",
+	}, output.serializer.Object(m))
+
+	conf = output.ConfigStruct().(*KVFirehoseOutputConfig)
+	conf.SeriesField = "series"
+	conf.Backend = "stdout"
+	conf.IncludeBaseFields = false
+	conf.TimestampColumns = []string{"ts"}
+	conf.TimestampLayout = "epoch_s"
+	assert.NoError(t, output.Init(conf))
+	assert.Equal(t, map[string]interface{}{"ts": int64(1462330921)}, output.serializer.Object(m))
+
+	conf.TimestampTimezone = "Nowhere/Special"
+	assert.Error(t, output.Init(conf))
+}
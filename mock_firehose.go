@@ -4,6 +4,7 @@
 package heka_clever_plugins
 
 import (
+	aws "github.com/Clever/heka-clever-plugins/aws"
 	gomock "github.com/rafrombrc/gomock/gomock"
 )
 
@@ -38,10 +39,11 @@ func (_mr *_MockRecordPutterRecorder) PutRecord(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutRecord", arg0)
 }
 
-func (_m *MockRecordPutter) PutRecordBatch(records [][]byte) error {
+func (_m *MockRecordPutter) PutRecordBatch(records [][]byte) (*aws.BatchResult, error) {
 	ret := _m.ctrl.Call(_m, "PutRecordBatch", records)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret0, _ := ret[0].(*aws.BatchResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 func (_mr *_MockRecordPutterRecorder) PutRecordBatch(arg0 interface{}) *gomock.Call {
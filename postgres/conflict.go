@@ -0,0 +1,139 @@
+package postgres
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Conflict describes what happens to rows that conflict with existing rows on
+// a unique constraint, making writes idempotent
+type Conflict struct {
+	// Columns of the unique constraint.  May be empty to skip rows that
+	// conflict on any constraint, but is required to update rows and by
+	// Redshift, which has no unique constraints.
+	Target []string
+	// Columns overwritten with the new row's values.  If empty, conflicting
+	// rows are skipped (DO NOTHING).
+	Update []string
+}
+
+// Validate checks that c can be used when inserting columns
+func (c *Conflict) Validate(columns []string) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Update) > 0 && len(c.Target) == 0 {
+		return fmt.Errorf("updating conflicting rows requires conflict target columns")
+	}
+	for _, column := range append(append([]string{}, c.Target...), c.Update...) {
+		if columnIndex(columns, column) < 0 {
+			return fmt.Errorf("conflict column '%s' isn't one of the inserted columns", column)
+		}
+	}
+	return nil
+}
+
+// clause returns the ON CONFLICT clause for an INSERT, or "" if c is nil
+func (c *Conflict) clause(quote func(string) string) string {
+	if c == nil {
+		return ""
+	}
+
+	q := " ON CONFLICT"
+	if len(c.Target) > 0 {
+		q += " (" + joinColumns(c.Target, quote) + ")"
+	}
+	if len(c.Update) == 0 {
+		return q + " DO NOTHING"
+	}
+
+	sets := make([]string, len(c.Update))
+	for i, column := range c.Update {
+		sets[i] = fmt.Sprintf("%s = EXCLUDED.%s", quote(column), quote(column))
+	}
+	return q + " DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// dedupe returns values with only the last row for each target key, in the
+// order the keys were first seen.  A single INSERT ... ON CONFLICT DO UPDATE
+// can't touch a row twice, and Redshift merges would insert every duplicate.
+func (c *Conflict) dedupe(columns []string, values [][]interface{}) [][]interface{} {
+	if c == nil || len(c.Target) == 0 {
+		return values
+	}
+
+	keyIndexes := make([]int, len(c.Target))
+	for i, column := range c.Target {
+		keyIndexes[i] = columnIndex(columns, column)
+	}
+
+	positions := map[string]int{}
+	deduped := make([][]interface{}, 0, len(values))
+	for _, val := range values {
+		key := make([]interface{}, len(keyIndexes))
+		for i, idx := range keyIndexes {
+			if idx < len(val) {
+				key[i] = val[idx]
+			}
+		}
+		id := fmt.Sprintf("%#v", key)
+
+		if pos, ok := positions[id]; ok {
+			deduped[pos] = val
+			continue
+		}
+		positions[id] = len(deduped)
+		deduped = append(deduped, val)
+	}
+	return deduped
+}
+
+// mergeStatements returns the statements that merge the rows in stage into
+// target without ON CONFLICT, as Redshift needs: conflicting rows are updated
+// (or left alone), then deleted from stage, and what remains is inserted.
+func (c *Conflict) mergeStatements(target, stage string, columns []string, quote func(string) string) []string {
+	conditions := make([]string, len(c.Target))
+	for i, column := range c.Target {
+		conditions[i] = fmt.Sprintf("%s.%s = %s.%s", target, quote(column), stage, quote(column))
+	}
+	matches := strings.Join(conditions, " AND ")
+
+	statements := []string{}
+	if len(c.Update) > 0 {
+		sets := make([]string, len(c.Update))
+		for i, column := range c.Update {
+			sets[i] = fmt.Sprintf("%s = %s.%s", quote(column), stage, quote(column))
+		}
+		statements = append(statements, fmt.Sprintf(
+			"UPDATE %s SET %s FROM %s WHERE %s", target, strings.Join(sets, ", "), stage, matches,
+		))
+	}
+
+	cols := joinColumns(columns, quote)
+	return append(statements,
+		fmt.Sprintf("DELETE FROM %s USING %s WHERE %s", stage, target, matches),
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", target, cols, cols, stage),
+	)
+}
+
+func joinColumns(columns []string, quote func(string) string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quote(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func columnIndex(columns []string, column string) int {
+	for i, c := range columns {
+		if c == column {
+			return i
+		}
+	}
+	return -1
+}
+
+// unquoted leaves column names as they are, as buildInsertQuery does
+func unquoted(column string) string {
+	return column
+}
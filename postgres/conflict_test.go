@@ -0,0 +1,92 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_conflictClause(t *testing.T) {
+	var none *Conflict
+	assert.Equal(t, "", none.clause(unquoted))
+	assert.Equal(t, " ON CONFLICT DO NOTHING", (&Conflict{}).clause(unquoted))
+	assert.Equal(t, " ON CONFLICT (id) DO NOTHING", (&Conflict{Target: []string{"id"}}).clause(unquoted))
+	assert.Equal(t,
+		" ON CONFLICT (id, day) DO UPDATE SET n = EXCLUDED.n, s = EXCLUDED.s",
+		(&Conflict{Target: []string{"id", "day"}, Update: []string{"n", "s"}}).clause(unquoted),
+	)
+	assert.Equal(t,
+		` ON CONFLICT ("id") DO UPDATE SET "n" = EXCLUDED."n"`,
+		(&Conflict{Target: []string{"id"}, Update: []string{"n"}}).clause(pq.QuoteIdentifier),
+	)
+}
+
+func Test_conflictValidate(t *testing.T) {
+	columns := []string{"id", "n"}
+	var none *Conflict
+	assert.NoError(t, none.Validate(columns))
+	assert.NoError(t, (&Conflict{Target: []string{"id"}, Update: []string{"n"}}).Validate(columns))
+
+	assert.Error(t, (&Conflict{Update: []string{"n"}}).Validate(columns))
+	assert.Error(t, (&Conflict{Target: []string{"missing"}}).Validate(columns))
+	assert.Error(t, (&Conflict{Target: []string{"id"}, Update: []string{"missing"}}).Validate(columns))
+}
+
+func Test_conflictDedupe(t *testing.T) {
+	columns := []string{"id", "n"}
+	values := [][]interface{}{
+		{"a", 1},
+		{"b", 2},
+		{"a", 3},
+		{nil, 4},
+		{nil, 5},
+	}
+
+	var none *Conflict
+	assert.Equal(t, values, none.dedupe(columns, values))
+	assert.Equal(t, values, (&Conflict{}).dedupe(columns, values), "rows can't be matched without a target")
+	assert.Equal(t, [][]interface{}{
+		{"a", 3},
+		{"b", 2},
+		{nil, 5},
+	}, (&Conflict{Target: []string{"id"}}).dedupe(columns, values))
+}
+
+func Test_buildUpsertQueries(t *testing.T) {
+	conflict := &Conflict{Target: []string{"id"}, Update: []string{"n"}}
+
+	q, err := buildInsertQuery("s", "t", []string{"id", "n"}, [][]interface{}{{1, 2}})
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`INSERT INTO "s"."t" (id, n) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET n = EXCLUDED.n`,
+		q+conflict.clause(unquoted),
+	)
+
+	assert.Equal(t,
+		`CREATE TEMPORARY TABLE "heka_copy_stage" (LIKE "s"."t" INCLUDING DEFAULTS) ON COMMIT DROP`,
+		createStageQuery("s", "t"),
+	)
+	assert.Equal(t,
+		`INSERT INTO "s"."t" ("id", "n") SELECT "id", "n" FROM "heka_copy_stage" `+
+			`ON CONFLICT ("id") DO UPDATE SET "n" = EXCLUDED."n"`,
+		mergeStageQuery("s", "t", []string{"id", "n"}, conflict),
+	)
+}
+
+func Test_conflictMergeStatements(t *testing.T) {
+	columns := []string{"id", "day", "n"}
+
+	assert.Equal(t, []string{
+		`DELETE FROM stage USING target WHERE target."id" = stage."id" AND target."day" = stage."day"`,
+		`INSERT INTO target ("id", "day", "n") SELECT "id", "day", "n" FROM stage`,
+	}, (&Conflict{Target: []string{"id", "day"}}).mergeStatements("target", "stage", columns, pq.QuoteIdentifier))
+
+	assert.Equal(t, []string{
+		`UPDATE target SET "n" = stage."n" FROM stage WHERE target."id" = stage."id"`,
+		`DELETE FROM stage USING target WHERE target."id" = stage."id"`,
+		`INSERT INTO target ("id", "day", "n") SELECT "id", "day", "n" FROM stage`,
+	}, (&Conflict{Target: []string{"id"}, Update: []string{"n"}}).mergeStatements(
+		"target", "stage", columns, pq.QuoteIdentifier,
+	))
+}
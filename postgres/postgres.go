@@ -5,12 +5,25 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// MaxInsertParams is the most parameters a single INSERT may have.  Postgres
+// allows 65535, but Redshift only 32767.
+const MaxInsertParams = 32767
+
+// copyRetryInterval is how long Copy inserts values after a COPY fails
+// because the server doesn't support it, before trying COPY again
+const copyRetryInterval = 10 * time.Minute
+
 type PostgresDB struct {
 	*sql.DB
+
+	// Until this time, in Unix nanoseconds, Copy inserts values instead
+	copyUnsupportedUntil int64
 }
 
 type DBConnectionParams struct {
@@ -86,10 +99,22 @@ func buildInsertQuery(schema, table string, columns []string, values [][]interfa
 
 // Insert one or more values into DB
 func (pi *PostgresDB) Insert(schema, table string, columns []string, values [][]interface{}) error {
+	return pi.Upsert(schema, table, columns, values, nil)
+}
+
+// Upsert inserts one or more values into DB, resolving rows that conflict with
+// existing rows as conflict says.  A nil conflict is a plain Insert.
+func (pi *PostgresDB) Upsert(schema, table string, columns []string, values [][]interface{}, conflict *Conflict) error {
+	if err := conflict.Validate(columns); err != nil {
+		return err
+	}
+	values = conflict.dedupe(columns, values)
+
 	q, err := buildInsertQuery(schema, table, columns, values)
 	if err != nil {
 		return err
 	}
+	q += conflict.clause(unquoted)
 	flatValues := flatten(values)
 	rows, err := pi.DB.Query(q, flatValues...)
 	if err != nil {
@@ -100,6 +125,157 @@ func (pi *PostgresDB) Insert(schema, table string, columns []string, values [][]
 	return nil
 }
 
+// Copy loads one or more values into DB with COPY FROM STDIN, in a single
+// transaction.  With a conflict, values are copied into a temporary table and
+// merged with INSERT ... ON CONFLICT.  If the server doesn't support COPY
+// (e.g. Redshift), values are inserted with INSERTs instead, as are those of
+// later calls until copyRetryInterval has passed.
+func (pi *PostgresDB) Copy(schema, table string, columns []string, values [][]interface{}, conflict *Conflict) error {
+	if err := conflict.Validate(columns); err != nil {
+		return err
+	}
+	if time.Now().UnixNano() < atomic.LoadInt64(&pi.copyUnsupportedUntil) {
+		return pi.insertChunked(schema, table, columns, values, conflict)
+	}
+
+	err := pi.copyIn(schema, table, columns, conflict.dedupe(columns, values), conflict)
+	if isCopyUnsupported(err) {
+		log.Printf("COPY isn't supported (%s), using INSERT for %s", err.Error(), copyRetryInterval)
+		atomic.StoreInt64(&pi.copyUnsupportedUntil, time.Now().Add(copyRetryInterval).UnixNano())
+		return pi.insertChunked(schema, table, columns, values, conflict)
+	}
+	return err
+}
+
+func (pi *PostgresDB) copyIn(schema, table string, columns []string, values [][]interface{}, conflict *Conflict) error {
+	if schema == "" {
+		schema = "public"
+	}
+	if table == "" {
+		return fmt.Errorf("table name cannot be empty string")
+	}
+	if len(columns) <= 0 {
+		return fmt.Errorf("requires at least 1 column")
+	}
+	for _, val := range values {
+		if len(val) != len(columns) {
+			return fmt.Errorf("value has %d elements, so cannot insert into %d columns", len(val), len(columns))
+		}
+	}
+
+	tx, err := pi.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	copyQuery := pq.CopyInSchema(schema, table, columns...)
+	if conflict != nil {
+		if _, err := tx.Exec(createStageQuery(schema, table)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		copyQuery = pq.CopyIn(copyStageTable, columns...)
+	}
+
+	stmt, err := tx.Prepare(copyQuery)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, val := range values {
+		if _, err := stmt.Exec(val...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	// An Exec without values ends the COPY
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if conflict != nil {
+		if _, err := tx.Exec(mergeStageQuery(schema, table, columns, conflict)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// copyStageTable is the temporary table conflicting COPYs are merged from.
+// It's dropped when the COPY's transaction ends.
+const copyStageTable = "heka_copy_stage"
+
+func createStageQuery(schema, table string) string {
+	return fmt.Sprintf(
+		"CREATE TEMPORARY TABLE %s (LIKE %s.%s INCLUDING DEFAULTS) ON COMMIT DROP",
+		pq.QuoteIdentifier(copyStageTable), pq.QuoteIdentifier(schema), pq.QuoteIdentifier(table),
+	)
+}
+
+func mergeStageQuery(schema, table string, columns []string, conflict *Conflict) string {
+	cols := joinColumns(columns, pq.QuoteIdentifier)
+	return fmt.Sprintf(
+		"INSERT INTO %s.%s (%s) SELECT %s FROM %s%s",
+		pq.QuoteIdentifier(schema), pq.QuoteIdentifier(table), cols, cols,
+		pq.QuoteIdentifier(copyStageTable), conflict.clause(pq.QuoteIdentifier),
+	)
+}
+
+// insertChunked inserts values with as many INSERTs as MaxInsertParams needs
+func (pi *PostgresDB) insertChunked(
+	schema, table string, columns []string, values [][]interface{}, conflict *Conflict,
+) error {
+	for _, chunk := range chunkValues(values, len(columns)) {
+		if err := pi.Upsert(schema, table, columns, chunk, conflict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkValues splits values into chunks that each fit in a single INSERT
+func chunkValues(values [][]interface{}, columnCount int) [][][]interface{} {
+	size := len(values)
+	if columnCount > 0 && size*columnCount > MaxInsertParams {
+		size = MaxInsertParams / columnCount
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	chunks := [][][]interface{}{}
+	for len(values) > size {
+		chunks = append(chunks, values[:size])
+		values = values[size:]
+	}
+	return append(chunks, values)
+}
+
+// isCopyUnsupported reports whether err means the server can't COPY FROM
+// STDIN: either it rejects the statement as an unsupported feature, or (like
+// Redshift, whose COPY only reads from remote sources) fails to parse STDIN
+func isCopyUnsupported(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	message := strings.ToLower(pqErr.Message)
+	switch pqErr.Code {
+	case "0A000": // feature_not_supported
+		return strings.Contains(message, "copy") && strings.Contains(message, "stdin")
+	case "42601": // syntax_error
+		return strings.Contains(message, `at or near "stdin"`)
+	}
+	return false
+}
+
 func flatten(input [][]interface{}) []interface{} {
 	f := []interface{}{}
 	for _, i := range input {
@@ -1,8 +1,10 @@
 package postgres
 
 import (
+	"fmt"
 	"testing"
 
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -119,3 +121,43 @@ func Test_connectAndBulkInsert(t *testing.T) {
 	})
 	assert.NoError(t, err)
 }
+
+func Test_chunkValues(t *testing.T) {
+	values := make([][]interface{}, 10000)
+	for i := range values {
+		values[i] = []interface{}{i, i, i, i, i}
+	}
+
+	chunks := chunkValues(values, 5)
+	assert.Len(t, chunks, 2)
+	assert.Len(t, chunks[0], MaxInsertParams/5)
+	assert.Len(t, chunks[1], 10000-MaxInsertParams/5)
+
+	chunks = chunkValues(values[:10], 5)
+	assert.Len(t, chunks, 1)
+	assert.Len(t, chunks[0], 10)
+}
+
+func Test_isCopyUnsupported(t *testing.T) {
+	assert.True(t, isCopyUnsupported(&pq.Error{Code: "0A000", Message: "COPY from stdin is not supported"}))
+	assert.True(t, isCopyUnsupported(&pq.Error{Code: "42601", Message: "syntax error at or near \"STDIN\""}))
+	assert.False(t, isCopyUnsupported(&pq.Error{Code: "42P01", Message: "relation \"mock_table\" does not exist"}))
+	assert.False(t, isCopyUnsupported(&pq.Error{Code: "0A000", Message: "cannot alter type of a column used by a view"}),
+		"other unsupported features aren't COPY")
+	assert.False(t, isCopyUnsupported(&pq.Error{Code: "22P02", Message: "invalid input syntax for integer: \"stdin\""}),
+		"errors mentioning stdin aren't unsupported COPYs")
+	assert.False(t, isCopyUnsupported(&pq.Error{Code: "42601", Message: "syntax error at or near \"FROM\""}))
+	assert.False(t, isCopyUnsupported(fmt.Errorf("connection refused")))
+	assert.False(t, isCopyUnsupported(nil))
+}
+
+func Test_connectAndCopy(t *testing.T) {
+	p := getTestDBConnectionParams()
+	postgresInserter, err := New(&p)
+	assert.NoError(t, err)
+	err = postgresInserter.Copy("public", "mock_table", []string{"s", "i"}, [][]interface{}{
+		{"qux", 4},
+		{"quux", 5},
+	}, nil)
+	assert.NoError(t, err)
+}
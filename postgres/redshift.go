@@ -0,0 +1,320 @@
+package postgres
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ObjectStore is where batches are staged for Redshift to COPY.  aws.S3Store
+// implements it for S3 and S3-compatible servers.
+type ObjectStore interface {
+	Put(name string, body []byte) error
+	Delete(name string) error
+	// URL returns the address Redshift reads the object name from
+	URL(name string) string
+}
+
+// DirStore is an ObjectStore that writes objects to a local directory.  It
+// stands in for S3 when testing staging locally.
+type DirStore struct {
+	Dir string
+}
+
+func (s *DirStore) Put(name string, body []byte) error {
+	file := filepath.Join(s.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, body, 0644)
+}
+
+func (s *DirStore) Delete(name string) error {
+	return os.Remove(filepath.Join(s.Dir, filepath.FromSlash(name)))
+}
+
+func (s *DirStore) URL(name string) string {
+	return "file://" + filepath.ToSlash(filepath.Join(s.Dir, filepath.FromSlash(name)))
+}
+
+// Formats batches are staged in
+const (
+	RedshiftCSV  = "csv"
+	RedshiftJSON = "json"
+)
+
+// RedshiftConfig controls how batches are staged and loaded
+type RedshiftConfig struct {
+	// "csv" (default) or "json"
+	Format string
+	// IAM role Redshift assumes to read staged objects
+	IAMRole string
+	// Extra COPY options, e.g. "TRUNCATECOLUMNS MAXERROR 10"
+	CopyOptions string
+}
+
+// RedshiftLoader loads batches into Redshift by staging them as gzipped files
+// with a manifest, then running COPY ... FROM the manifest.  Staged objects
+// are deleted once the COPY succeeds, and kept for inspection if it fails.
+//
+// Redshift has no ON CONFLICT, so conflicts are resolved by copying into a
+// temporary table and merging it into the target in the same transaction.
+type RedshiftLoader struct {
+	exec  func(query string, args ...interface{}) (sql.Result, error)
+	begin func() (redshiftTx, error)
+	store ObjectStore
+	conf  RedshiftConfig
+	now   func() time.Time
+	seq   int64
+}
+
+// NewRedshiftLoader returns a RedshiftLoader that stages batches in store and
+// loads them into db
+func NewRedshiftLoader(db *PostgresDB, store ObjectStore, conf RedshiftConfig) (*RedshiftLoader, error) {
+	begin := func() (redshiftTx, error) { return db.DB.Begin() }
+	return newRedshiftLoader(db.DB.Exec, begin, store, conf)
+}
+
+// redshiftTx is the part of *sql.Tx a conflicting load runs in
+type redshiftTx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Commit() error
+	Rollback() error
+}
+
+func newRedshiftLoader(
+	exec func(query string, args ...interface{}) (sql.Result, error), begin func() (redshiftTx, error),
+	store ObjectStore, conf RedshiftConfig,
+) (*RedshiftLoader, error) {
+	switch conf.Format {
+	case "":
+		conf.Format = RedshiftCSV
+	case RedshiftCSV, RedshiftJSON:
+	default:
+		return nil, fmt.Errorf("Unknown Redshift staging format '%s' (expected 'csv' or 'json')", conf.Format)
+	}
+	if conf.IAMRole == "" {
+		return nil, fmt.Errorf("Redshift COPY needs an IAM role")
+	}
+	return &RedshiftLoader{exec: exec, begin: begin, store: store, conf: conf, now: time.Now}, nil
+}
+
+// Load stages values and copies them into table, resolving rows that conflict
+// with existing rows as conflict says (if not nil)
+func (l *RedshiftLoader) Load(
+	schema, table string, columns []string, values [][]interface{}, conflict *Conflict,
+) error {
+	if schema == "" {
+		schema = "public"
+	}
+	if table == "" {
+		return fmt.Errorf("table name cannot be empty string")
+	}
+	if len(columns) <= 0 {
+		return fmt.Errorf("requires at least 1 column")
+	}
+	if len(values) <= 0 {
+		return fmt.Errorf("requires at least 1 value")
+	}
+	if err := conflict.Validate(columns); err != nil {
+		return err
+	}
+	if conflict != nil && len(conflict.Target) == 0 {
+		return fmt.Errorf("Redshift needs conflict target columns to find conflicting rows")
+	}
+	values = conflict.dedupe(columns, values)
+
+	data, err := l.encode(columns, values)
+	if err != nil {
+		return err
+	}
+
+	base := fmt.Sprintf(
+		"%s.%s/%s-%d", schema, table, l.now().UTC().Format("2006-01-02-15-04-05"),
+		atomic.AddInt64(&l.seq, 1),
+	)
+	dataName := base + "." + l.conf.Format + ".gz"
+	manifestName := base + ".manifest"
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"entries": []map[string]interface{}{
+			{"url": l.store.URL(dataName), "mandatory": true},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := l.store.Put(dataName, data); err != nil {
+		return fmt.Errorf("can't stage batch: %s", err.Error())
+	}
+	if err := l.store.Put(manifestName, manifest); err != nil {
+		return fmt.Errorf("can't stage batch manifest: %s", err.Error())
+	}
+
+	if err := l.load(schema, table, columns, l.store.URL(manifestName), conflict); err != nil {
+		return fmt.Errorf("COPY from %s failed: %s", l.store.URL(manifestName), err.Error())
+	}
+
+	for _, name := range []string{dataName, manifestName} {
+		if err := l.store.Delete(name); err != nil {
+			log.Printf("Can't delete staged %s: %s", l.store.URL(name), err.Error())
+		}
+	}
+	return nil
+}
+
+// redshiftStageTable is the temporary table conflicting loads are merged from
+const redshiftStageTable = "heka_redshift_stage"
+
+// load runs the COPY, or with a conflict copies into a temporary table and
+// merges it into the target in a transaction.  The transaction is rolled back
+// if any statement fails, so the connection isn't left in an aborted
+// transaction and the temporary table doesn't outlive the load.
+func (l *RedshiftLoader) load(
+	schema, table string, columns []string, manifestURL string, conflict *Conflict,
+) error {
+	target := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+	if conflict == nil {
+		_, err := l.exec(l.copyQuery(target, columns, manifestURL))
+		return err
+	}
+
+	tx, err := l.begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range l.mergeStatements(target, columns, manifestURL, conflict) {
+		if _, err := tx.Exec(q); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// mergeStatements returns the statements that copy into a temporary table and
+// merge it into target
+func (l *RedshiftLoader) mergeStatements(
+	target string, columns []string, manifestURL string, conflict *Conflict,
+) []string {
+	stage := pq.QuoteIdentifier(redshiftStageTable)
+	statements := []string{
+		fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s)", stage, target),
+		l.copyQuery(stage, columns, manifestURL),
+	}
+	statements = append(statements, conflict.mergeStatements(target, stage, columns, pq.QuoteIdentifier)...)
+	return append(statements, "DROP TABLE "+stage)
+}
+
+func (l *RedshiftLoader) copyQuery(table string, columns []string, manifestURL string) string {
+	format := "CSV"
+	if l.conf.Format == RedshiftJSON {
+		format = "JSON 'auto'"
+	}
+
+	q := fmt.Sprintf(
+		"COPY %s (%s) FROM %s IAM_ROLE %s MANIFEST %s GZIP TIMEFORMAT 'auto'",
+		table, joinColumns(columns, pq.QuoteIdentifier),
+		quoteLiteral(manifestURL), quoteLiteral(l.conf.IAMRole), format,
+	)
+	if l.conf.CopyOptions != "" {
+		q += " " + l.conf.CopyOptions
+	}
+	return q
+}
+
+// encode returns values as a gzipped CSV file or newline-delimited JSON file
+func (l *RedshiftLoader) encode(columns []string, values [][]interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+
+	if l.conf.Format == RedshiftJSON {
+		encoder := json.NewEncoder(gz)
+		for _, val := range values {
+			if len(val) != len(columns) {
+				return nil, fmt.Errorf("value has %d elements, so cannot insert into %d columns", len(val), len(columns))
+			}
+			row := make(map[string]interface{}, len(columns))
+			for i, column := range columns {
+				row[column] = stagedValue(val[i])
+			}
+			if err := encoder.Encode(row); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		writer := csv.NewWriter(gz)
+		for _, val := range values {
+			if len(val) != len(columns) {
+				return nil, fmt.Errorf("value has %d elements, so cannot insert into %d columns", len(val), len(columns))
+			}
+			row := make([]string, len(val))
+			for i, v := range val {
+				row[i] = csvField(stagedValue(v))
+			}
+			if err := writer.Write(row); err != nil {
+				return nil, err
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stagedValue converts values that JSON or CSV can't write as Redshift reads
+// them.  Times are written in UTC.
+func stagedValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		return t.UTC().Format("2006-01-02 15:04:05.999999")
+	case []byte:
+		return string(t)
+	case driver.Valuer:
+		// e.g. pq.StringArray, written as its Postgres text form
+		if value, err := t.Value(); err == nil {
+			return stagedValue(value)
+		}
+	}
+	return v
+}
+
+// csvField formats a value for a CSV file.  NULL is written as \N, which
+// COPY reads as NULL by default.
+func csvField(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return `\N`
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// quoteLiteral quotes s as a SQL string literal
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
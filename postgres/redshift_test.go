@@ -0,0 +1,207 @@
+package postgres
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingExec records queries, failing them with err.  Transactions are
+// recorded as BEGIN, their statements and COMMIT or ROLLBACK.
+type recordingExec struct {
+	queries []string
+	err     error
+	// failOnce fails the next query containing it, then is cleared
+	failOnce string
+}
+
+func (r *recordingExec) exec(query string, args ...interface{}) (sql.Result, error) {
+	r.queries = append(r.queries, query)
+	if r.failOnce != "" && strings.Contains(query, r.failOnce) {
+		r.failOnce = ""
+		return nil, fmt.Errorf("failed: %s", query)
+	}
+	return nil, r.err
+}
+
+func (r *recordingExec) begin() (redshiftTx, error) {
+	r.queries = append(r.queries, "BEGIN")
+	return &recordingTx{r}, nil
+}
+
+type recordingTx struct {
+	*recordingExec
+}
+
+func (tx *recordingTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.exec(query, args...)
+}
+
+func (tx *recordingTx) Commit() error {
+	tx.queries = append(tx.queries, "COMMIT")
+	return nil
+}
+
+func (tx *recordingTx) Rollback() error {
+	tx.queries = append(tx.queries, "ROLLBACK")
+	return nil
+}
+
+func testRedshiftLoader(t *testing.T, conf RedshiftConfig) (*RedshiftLoader, *recordingExec, string) {
+	dir, err := ioutil.TempDir("", "redshift")
+	assert.NoError(t, err)
+
+	r := &recordingExec{}
+	loader, err := newRedshiftLoader(r.exec, r.begin, &DirStore{Dir: dir}, conf)
+	assert.NoError(t, err)
+	loader.now = func() time.Time { return time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC) }
+	return loader, r, dir
+}
+
+func stagedFiles(t *testing.T, dir string) []string {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	return files
+}
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+var testRows = [][]interface{}{
+	{"say \"hi\", bye", int64(1), time.Date(2016, 5, 4, 3, 2, 1, 500000000, time.UTC)},
+	{nil, int64(2), time.Date(2016, 5, 4, 3, 2, 2, 0, time.UTC)},
+}
+
+func Test_redshiftLoaderCopiesAndCleansUp(t *testing.T) {
+	loader, r, dir := testRedshiftLoader(t, RedshiftConfig{
+		IAMRole: "arn:aws:iam::123:role/redshift", CopyOptions: "TRUNCATECOLUMNS",
+	})
+	defer os.RemoveAll(dir)
+
+	// Check the staged files while the COPY runs
+	var staged []string
+	var data string
+	loader.exec = func(query string, args ...interface{}) (sql.Result, error) {
+		staged = stagedFiles(t, dir)
+		data = readGzip(t, filepath.Join(dir, "public.events", "2016-05-04-03-02-01-1.csv.gz"))
+		return r.exec(query, args...)
+	}
+
+	err := loader.Load("", "events", []string{"msg", "n", "ts"}, testRows, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"public.events/2016-05-04-03-02-01-1.csv.gz", "public.events/2016-05-04-03-02-01-1.manifest",
+	}, staged)
+	assert.Equal(t, "\"say \"\"hi\"\", bye\",1,2016-05-04 03:02:01.5\n\\N,2,2016-05-04 03:02:02\n", data)
+
+	manifestURL := "file://" + filepath.ToSlash(dir) + "/public.events/2016-05-04-03-02-01-1.manifest"
+	assert.Equal(t, []string{fmt.Sprintf(
+		`COPY "public"."events" ("msg", "n", "ts") FROM '%s' IAM_ROLE 'arn:aws:iam::123:role/redshift' `+
+			`MANIFEST CSV GZIP TIMEFORMAT 'auto' TRUNCATECOLUMNS`, manifestURL,
+	)}, r.queries)
+
+	assert.Empty(t, stagedFiles(t, dir), "staged files are deleted after the COPY")
+}
+
+func Test_redshiftLoaderStagesJSON(t *testing.T) {
+	loader, _, dir := testRedshiftLoader(t, RedshiftConfig{IAMRole: "role", Format: RedshiftJSON})
+	defer os.RemoveAll(dir)
+
+	data, err := loader.encode([]string{"msg", "n", "ts"}, testRows)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data.json.gz"), data, 0644))
+	assert.Equal(t,
+		"{\"msg\":\"say \\\"hi\\\", bye\",\"n\":1,\"ts\":\"2016-05-04 03:02:01.5\"}\n"+
+			"{\"msg\":null,\"n\":2,\"ts\":\"2016-05-04 03:02:02\"}\n",
+		readGzip(t, filepath.Join(dir, "data.json.gz")),
+	)
+	assert.Contains(t, loader.copyQuery(`"s"."t"`, []string{"a"}, "s3://b/m"), "MANIFEST JSON 'auto' GZIP")
+}
+
+func Test_redshiftLoaderKeepsFilesWhenCopyFails(t *testing.T) {
+	loader, r, dir := testRedshiftLoader(t, RedshiftConfig{IAMRole: "role"})
+	defer os.RemoveAll(dir)
+	r.err = fmt.Errorf("Load into table 'events' failed")
+
+	err := loader.Load("public", "events", []string{"msg", "n", "ts"}, testRows, nil)
+	assert.Error(t, err)
+	assert.Len(t, stagedFiles(t, dir), 2)
+}
+
+func Test_newRedshiftLoaderValidatesConfig(t *testing.T) {
+	r := &recordingExec{}
+	_, err := newRedshiftLoader(r.exec, r.begin, &DirStore{}, RedshiftConfig{})
+	assert.Error(t, err, "an IAM role is required")
+	_, err = newRedshiftLoader(r.exec, r.begin, &DirStore{}, RedshiftConfig{IAMRole: "role", Format: "parquet"})
+	assert.Error(t, err)
+}
+
+func Test_redshiftLoaderMergesConflicts(t *testing.T) {
+	loader, r, dir := testRedshiftLoader(t, RedshiftConfig{IAMRole: "role"})
+	defer os.RemoveAll(dir)
+
+	values := [][]interface{}{{"a", int64(1)}, {"a", int64(2)}}
+	err := loader.Load("public", "events", []string{"id", "n"}, values, &Conflict{Target: []string{"id"}})
+	assert.NoError(t, err)
+
+	manifestURL := "file://" + filepath.ToSlash(dir) + "/public.events/2016-05-04-03-02-01-1.manifest"
+	assert.Equal(t, []string{
+		"BEGIN",
+		`CREATE TEMPORARY TABLE "heka_redshift_stage" (LIKE "public"."events")`,
+		`COPY "heka_redshift_stage" ("id", "n") FROM '` + manifestURL + `' IAM_ROLE 'role' ` +
+			`MANIFEST CSV GZIP TIMEFORMAT 'auto'`,
+		`DELETE FROM "heka_redshift_stage" USING "public"."events" ` +
+			`WHERE "public"."events"."id" = "heka_redshift_stage"."id"`,
+		`INSERT INTO "public"."events" ("id", "n") SELECT "id", "n" FROM "heka_redshift_stage"`,
+		`DROP TABLE "heka_redshift_stage"`,
+		"COMMIT",
+	}, r.queries)
+
+	// Without a target, conflicting rows can't be found
+	err = loader.Load("public", "events", []string{"id", "n"}, values, &Conflict{})
+	assert.Error(t, err)
+}
+
+func Test_redshiftLoaderRollsBackFailedMerge(t *testing.T) {
+	loader, r, dir := testRedshiftLoader(t, RedshiftConfig{IAMRole: "role"})
+	defer os.RemoveAll(dir)
+	r.failOnce = "INSERT INTO"
+
+	values := [][]interface{}{{"a", int64(1)}}
+	conflict := &Conflict{Target: []string{"id"}}
+	err := loader.Load("public", "events", []string{"id", "n"}, values, conflict)
+	assert.Error(t, err)
+	assert.Equal(t, "ROLLBACK", r.queries[len(r.queries)-1], "the failed merge is rolled back")
+	assert.NotContains(t, r.queries, "COMMIT")
+
+	// The next load starts a new transaction and succeeds
+	r.queries = nil
+	err = loader.Load("public", "events", []string{"id", "n"}, values, conflict)
+	assert.NoError(t, err)
+	assert.Equal(t, "BEGIN", r.queries[0])
+	assert.Equal(t, "COMMIT", r.queries[len(r.queries)-1])
+}
@@ -0,0 +1,368 @@
+package heka_clever_plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Column types a PostgresOutput column can be declared as
+const (
+	columnInt         = "int"
+	columnFloat       = "float"
+	columnBool        = "bool"
+	columnText        = "text"
+	columnTimestamptz = "timestamptz"
+	columnJSONB       = "jsonb"
+	columnTextArray   = "text[]"
+
+	// timestamptz, reading numbers as Unix milliseconds or nanoseconds
+	columnTimestamptzMs = "timestamptz_ms"
+	columnTimestamptzNs = "timestamptz_ns"
+)
+
+// Timestamp strings that timestamptz columns parse, after RFC 3339
+var columnTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// Units per second of the numbers each timestamptz type reads as Unix
+// timestamps
+var columnTimeUnits = map[string]int64{
+	columnTimestamptz:   1,
+	columnTimestamptzMs: int64(time.Second / time.Millisecond),
+	columnTimestamptzNs: int64(time.Second),
+}
+
+// Unix seconds that timestamptz columns accept, years 1 through 9999.
+// Milliseconds or nanoseconds written to a "timestamptz" column are outside
+// it, rather than read as a date thousands of years away.
+const (
+	minColumnUnix = -62135596800
+	maxColumnUnix = 253402300799
+)
+
+// headerSourcePrefix marks sources read from a base message header rather
+// than a field, e.g. "header:Hostname"
+const headerSourcePrefix = "header:"
+
+// Base message headers a column can be read from
+var messageHeaders = []string{
+	"Timestamp", "Hostname", "Type", "Logger", "Severity", "Uuid", "Payload", "EnvVersion", "Pid",
+}
+
+// columnSpec describes how a table column is filled from a message
+type columnSpec struct {
+	column string
+	// Message field, "Timestamp" for the message's timestamp, or
+	// headerSourcePrefix followed by one of messageHeaders
+	source string
+	// Column type values are converted to.  If empty, the source's first
+	// value is written as it is.
+	kind string
+	// Written when the source is missing, if hasDefault
+	def        interface{}
+	hasDefault bool
+}
+
+// newColumnSpecs pairs each column with the message field it's read from.
+// types and defaults are keyed by column; defaults are converted to the
+// column's type.
+func newColumnSpecs(
+	columns, sources []string, types map[string]string, defaults map[string]string,
+) ([]columnSpec, error) {
+	if len(columns) != len(sources) {
+		return nil, fmt.Errorf(
+			"%d insert_table_columns but %d insert_message_fields", len(columns), len(sources),
+		)
+	}
+
+	for column := range types {
+		if !stringInSlice(columns, column) {
+			return nil, fmt.Errorf("column_types has unknown column '%s'", column)
+		}
+	}
+	for column := range defaults {
+		if !stringInSlice(columns, column) {
+			return nil, fmt.Errorf("column_defaults has unknown column '%s'", column)
+		}
+	}
+
+	specs := make([]columnSpec, len(columns))
+	for i, column := range columns {
+		spec := columnSpec{column: column, source: sources[i], kind: types[column]}
+		if strings.HasPrefix(spec.source, headerSourcePrefix) &&
+			!stringInSlice(messageHeaders, strings.TrimPrefix(spec.source, headerSourcePrefix)) {
+			return nil, fmt.Errorf(
+				"column '%s' reads unknown header '%s' (expected one of %s)",
+				column, spec.source, strings.Join(messageHeaders, ", "),
+			)
+		}
+		switch spec.kind {
+		case "", columnInt, columnFloat, columnBool, columnText, columnTimestamptz, columnTimestamptzMs,
+			columnTimestamptzNs, columnJSONB, columnTextArray:
+		default:
+			return nil, fmt.Errorf("column '%s' has unknown type '%s'", column, spec.kind)
+		}
+
+		if def, ok := defaults[column]; ok {
+			value, err := convertColumn(spec.kind, []interface{}{def})
+			if err != nil {
+				return nil, fmt.Errorf("column '%s' has an invalid default: %s", column, err.Error())
+			}
+			spec.def, spec.hasDefault = value, true
+		}
+		specs[i] = spec
+	}
+	return specs, nil
+}
+
+// sourceValues returns every value of the source in m, and false if it's
+// missing.  Headers are only read with headerSourcePrefix, so fields named
+// like a header are still read as fields; "Timestamp" has always been the
+// message's timestamp.
+func sourceValues(m *message.Message, source string) ([]interface{}, bool) {
+	if source == "Timestamp" {
+		return headerValues(m, source)
+	}
+	if strings.HasPrefix(source, headerSourcePrefix) {
+		return headerValues(m, strings.TrimPrefix(source, headerSourcePrefix))
+	}
+
+	// Repeated fields, and fields with several values, contribute every value
+	values := []interface{}{}
+	for _, field := range m.FindAllFields(source) {
+		switch field.GetValueType() {
+		case message.Field_STRING:
+			for _, v := range field.GetValueString() {
+				values = append(values, v)
+			}
+		case message.Field_BYTES:
+			for _, v := range field.GetValueBytes() {
+				values = append(values, v)
+			}
+		case message.Field_INTEGER:
+			for _, v := range field.GetValueInteger() {
+				values = append(values, v)
+			}
+		case message.Field_DOUBLE:
+			for _, v := range field.GetValueDouble() {
+				values = append(values, v)
+			}
+		case message.Field_BOOL:
+			for _, v := range field.GetValueBool() {
+				values = append(values, v)
+			}
+		}
+	}
+	return values, len(values) > 0
+}
+
+// headerValues returns the value of one of messageHeaders in m
+func headerValues(m *message.Message, header string) ([]interface{}, bool) {
+	switch header {
+	case "Timestamp":
+		// Convert Heka time (Unix timestamp in nanoseconds) to Golang time
+		return []interface{}{time.Unix(0, m.GetTimestamp())}, true
+	case "Hostname":
+		return []interface{}{m.GetHostname()}, true
+	case "Type":
+		return []interface{}{m.GetType()}, true
+	case "Logger":
+		return []interface{}{m.GetLogger()}, true
+	case "Severity":
+		return []interface{}{int64(m.GetSeverity())}, true
+	case "Uuid":
+		return []interface{}{m.GetUuidString()}, true
+	case "Payload":
+		return []interface{}{m.GetPayload()}, true
+	case "EnvVersion":
+		return []interface{}{m.GetEnvVersion()}, true
+	case "Pid":
+		return []interface{}{int64(m.GetPid())}, true
+	}
+	return nil, false
+}
+
+// convertColumn converts a source's values to the column type kind.  Every
+// type but text[] and jsonb uses only the first value.
+func convertColumn(kind string, values []interface{}) (interface{}, error) {
+	switch kind {
+	case "":
+		return values[0], nil
+
+	case columnInt:
+		switch v := values[0].(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if n, ok := floatInt(v); ok {
+				return n, nil
+			}
+		case string:
+			s := strings.TrimSpace(v)
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n, nil
+			}
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				if n, ok := floatInt(f); ok {
+					return n, nil
+				}
+			}
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+
+	case columnFloat:
+		switch v := values[0].(type) {
+		case float64:
+			return v, nil
+		case int64:
+			return float64(v), nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, nil
+			}
+		}
+
+	case columnBool:
+		switch v := values[0].(type) {
+		case bool:
+			return v, nil
+		case int64:
+			return v != 0, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b, nil
+			}
+		}
+
+	case columnText:
+		return columnString(values[0]), nil
+
+	case columnTimestamptz, columnTimestamptzMs, columnTimestamptzNs:
+		switch v := values[0].(type) {
+		case time.Time:
+			return v, nil
+		case int64, float64:
+			if t, ok := columnUnixTime(v, columnTimeUnits[kind]); ok {
+				return t, nil
+			}
+			return nil, fmt.Errorf(
+				"%v is outside the Unix timestamps %s reads (years 1 to 9999); "+
+					"use %s or %s for milliseconds or nanoseconds",
+				v, kind, columnTimestamptzMs, columnTimestamptzNs,
+			)
+		case string:
+			for _, layout := range columnTimeLayouts {
+				if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+					return t, nil
+				}
+			}
+		}
+
+	case columnJSONB:
+		if len(values) == 1 {
+			// Strings that already hold a JSON object or array are written as
+			// they are.  Anything else, e.g. "123", is a JSON string.
+			if s, ok := values[0].(string); ok && isJSONContainer(s) {
+				return s, nil
+			}
+			encoded, err := json.Marshal(jsonValue(values[0]))
+			return string(encoded), err
+		}
+		converted := make([]interface{}, len(values))
+		for i, v := range values {
+			converted[i] = jsonValue(v)
+		}
+		encoded, err := json.Marshal(converted)
+		return string(encoded), err
+
+	case columnTextArray:
+		strs := make([]string, len(values))
+		for i, v := range values {
+			strs[i] = columnString(v)
+		}
+		return pq.StringArray(strs), nil
+	}
+
+	return nil, fmt.Errorf("can't convert %v (%T) to %s", values[0], values[0], kind)
+}
+
+// floatInt returns f as an int64, if it's a whole number in range
+func floatInt(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// columnUnixTime converts v, a Unix timestamp in perSecond units per second,
+// to a time, if it's between minColumnUnix and maxColumnUnix
+func columnUnixTime(v interface{}, perSecond int64) (time.Time, bool) {
+	var sec, nsec int64
+	switch n := v.(type) {
+	case int64:
+		sec, nsec = n/perSecond, n%perSecond*(int64(time.Second)/perSecond)
+	case float64:
+		s, frac := math.Modf(n / float64(perSecond))
+		// Also false for NaN
+		if !(s >= minColumnUnix && s <= maxColumnUnix) {
+			return time.Time{}, false
+		}
+		sec, nsec = int64(s), int64(frac*1e9)
+	default:
+		return time.Time{}, false
+	}
+	if sec < minColumnUnix || sec > maxColumnUnix {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, nsec), true
+}
+
+func columnString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// isJSONContainer returns whether s is a JSON object or array
+func isJSONContainer(s string) bool {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return false
+	}
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+// jsonValue writes bytes as strings, rather than as base64
+func jsonValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
@@ -0,0 +1,150 @@
+package heka_clever_plugins
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mozilla-services/heka/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertColumn(t *testing.T) {
+	tests := []struct {
+		kind     string
+		values   []interface{}
+		expected interface{}
+		err      bool
+	}{
+		{kind: "", values: []interface{}{"a", "b"}, expected: "a"},
+		{kind: columnInt, values: []interface{}{int64(3)}, expected: int64(3)},
+		{kind: columnInt, values: []interface{}{" 42 "}, expected: int64(42)},
+		{kind: columnInt, values: []interface{}{"1e3"}, expected: int64(1000)},
+		{kind: columnInt, values: []interface{}{2.0}, expected: int64(2)},
+		{kind: columnInt, values: []interface{}{2.5}, err: true},
+		{kind: columnInt, values: []interface{}{"many"}, err: true},
+		{kind: columnInt, values: []interface{}{1e19}, err: true},
+		{kind: columnInt, values: []interface{}{"-1e19"}, err: true},
+		{kind: columnInt, values: []interface{}{math.Inf(1)}, err: true},
+		{kind: columnFloat, values: []interface{}{"2.5"}, expected: 2.5},
+		{kind: columnFloat, values: []interface{}{int64(2)}, expected: 2.0},
+		{kind: columnFloat, values: []interface{}{true}, err: true},
+		{kind: columnBool, values: []interface{}{"true"}, expected: true},
+		{kind: columnBool, values: []interface{}{int64(0)}, expected: false},
+		{kind: columnBool, values: []interface{}{"maybe"}, err: true},
+		{kind: columnText, values: []interface{}{int64(7)}, expected: "7"},
+		{kind: columnText, values: []interface{}{[]byte("raw")}, expected: "raw"},
+		{kind: columnText, values: []interface{}{0.25}, expected: "0.25"},
+		{
+			kind: columnTimestamptz, values: []interface{}{"2016-05-04T03:02:01.5Z"},
+			expected: time.Date(2016, 5, 4, 3, 2, 1, 500000000, time.UTC),
+		},
+		{
+			kind: columnTimestamptz, values: []interface{}{"2016-05-04 03:02:01"},
+			expected: time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC),
+		},
+		{kind: columnTimestamptz, values: []interface{}{int64(1462330921)}, expected: time.Unix(1462330921, 0)},
+		{kind: columnTimestamptz, values: []interface{}{"yesterday"}, err: true},
+		{kind: columnTimestamptz, values: []interface{}{1462330921.5}, expected: time.Unix(1462330921, 5e8)},
+		// Milliseconds aren't read as seconds
+		{kind: columnTimestamptz, values: []interface{}{int64(1462330921000)}, err: true},
+		{kind: columnTimestamptz, values: []interface{}{1e300}, err: true},
+		{kind: columnTimestamptzMs, values: []interface{}{int64(1462330921500)}, expected: time.Unix(1462330921, 5e8)},
+		{kind: columnTimestamptzMs, values: []interface{}{1462330921500.0}, expected: time.Unix(1462330921, 5e8)},
+		{
+			kind: columnTimestamptzNs, values: []interface{}{int64(1462330921000000001)},
+			expected: time.Unix(1462330921, 1),
+		},
+		{kind: columnTimestamptzNs, values: []interface{}{int64(-1)}, expected: time.Unix(0, -1)},
+		{kind: columnJSONB, values: []interface{}{`{"a": 1}`}, expected: `{"a": 1}`},
+		{kind: columnJSONB, values: []interface{}{`[1, 2]`}, expected: `[1, 2]`},
+		{kind: columnJSONB, values: []interface{}{"hello"}, expected: `"hello"`},
+		{kind: columnJSONB, values: []interface{}{"123"}, expected: `"123"`},
+		{kind: columnJSONB, values: []interface{}{"true"}, expected: `"true"`},
+		{kind: columnJSONB, values: []interface{}{int64(1), int64(2)}, expected: `[1,2]`},
+		{kind: columnTextArray, values: []interface{}{"a", int64(2)}, expected: pq.StringArray{"a", "2"}},
+	}
+
+	for _, test := range tests {
+		actual, err := convertColumn(test.kind, test.values)
+		if test.err {
+			assert.Error(t, err, "%s %v", test.kind, test.values)
+		} else {
+			assert.NoError(t, err, "%s %v", test.kind, test.values)
+			assert.Equal(t, test.expected, actual, "%s %v", test.kind, test.values)
+		}
+	}
+}
+
+func TestNewColumnSpecs(t *testing.T) {
+	columns := []string{"ts", "n"}
+	sources := []string{"Timestamp", "count"}
+
+	specs, err := newColumnSpecs(columns, sources, map[string]string{"n": "int"}, map[string]string{"n": "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, []columnSpec{
+		{column: "ts", source: "Timestamp"},
+		{column: "n", source: "count", kind: "int", def: int64(0), hasDefault: true},
+	}, specs)
+
+	_, err = newColumnSpecs(columns, sources[:1], nil, nil)
+	assert.Error(t, err, "every column needs a field")
+	_, err = newColumnSpecs(columns, sources, map[string]string{"n": "money"}, nil)
+	assert.Error(t, err, "unknown type")
+	_, err = newColumnSpecs(columns, sources, map[string]string{"other": "int"}, nil)
+	assert.Error(t, err, "unknown column")
+	_, err = newColumnSpecs(columns, sources, map[string]string{"n": "int"}, map[string]string{"n": "none"})
+	assert.Error(t, err, "invalid default")
+	_, err = newColumnSpecs(columns, []string{"Timestamp", "header:Color"}, nil, nil)
+	assert.Error(t, err, "unknown header")
+	assert.Error(t, err, "invalid default")
+}
+
+func TestConvertMessageToValues(t *testing.T) {
+	m := &message.Message{}
+	m.SetTimestamp(time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC).UnixNano())
+	m.SetHostname("web-1")
+	m.SetSeverity(6)
+	m.SetUuid([]byte("0123456789abcdef"))
+
+	count, err := message.NewField("count", "12", "")
+	assert.NoError(t, err)
+	tags, err := message.NewField("tag", "a", "")
+	assert.NoError(t, err)
+	assert.NoError(t, tags.AddValue("b"))
+	moreTags, err := message.NewField("tag", "c", "")
+	assert.NoError(t, err)
+	// Fields named like a header are still read as fields
+	hostname, err := message.NewField("Hostname", "field-host", "")
+	assert.NoError(t, err)
+	m.AddField(count)
+	m.AddField(tags)
+	m.AddField(moreTags)
+	m.AddField(hostname)
+
+	columns := []string{
+		"ts", "host", "host_field", "severity", "id", "n", "tags", "first_tag", "region", "missing",
+	}
+	sources := []string{
+		"Timestamp", "header:Hostname", "Hostname", "header:Severity", "header:Uuid",
+		"count", "tag", "tag", "region", "missing",
+	}
+	specs, err := newColumnSpecs(columns, sources,
+		map[string]string{"n": "int", "tags": "text[]", "ts": "timestamptz"},
+		map[string]string{"region": "us-west-2"},
+	)
+	assert.NoError(t, err)
+
+	po := &PostgresOutput{columns: specs, allowMissingMessageFields: true}
+	values, err := po.convertMessageToValues(m)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		time.Unix(0, m.GetTimestamp()), "web-1", "field-host", int64(6), "30313233-3435-3637-3839-616263646566",
+		int64(12), pq.StringArray{"a", "b", "c"}, "a", "us-west-2", nil,
+	}, values)
+
+	po.allowMissingMessageFields = false
+	_, err = po.convertMessageToValues(m)
+	assert.EqualError(t, err, "message is missing expected fields: missing")
+}
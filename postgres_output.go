@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Clever/heka-clever-plugins/aws"
 	"github.com/Clever/heka-clever-plugins/postgres"
 	_ "github.com/lib/pq"
 	"github.com/mozilla-services/heka/message"
@@ -14,17 +15,26 @@ import (
 
 // Redshift does not allow more than 32767 params in a query, so queries of type INSERT...VALUES($1, $2, ...)
 // will not work if the number of params crosses 32767
-const redshiftParamsLimit = 32767
+const redshiftParamsLimit = postgres.MaxInsertParams
+
+// How batches are written
+const (
+	insertMethodInsert   = "insert"
+	insertMethodCopy     = "copy"
+	insertMethodRedshift = "redshift"
+)
 
 type PostgresOutput struct {
 	db                        *postgres.PostgresDB
+	redshift                  *postgres.RedshiftLoader
 	helper                    PluginHelper
 	runner                    OutputRunner
 	lastMsgLoopCount          uint
-	insertSchema              string
-	insertTable               string
-	insertMessageFields       []string
+	tables                    *tableRouter
+	columns                   []columnSpec
 	insertTableColumns        []string
+	insertMethod              string
+	conflict                  *postgres.Conflict
 	flushInterval             uint32
 	flushCount                int // Max messages before flush
 	allowMissingMessageFields bool
@@ -32,13 +42,72 @@ type PostgresOutput struct {
 }
 
 type PostgresOutputConfig struct {
-	// Table name and colums. Message fields to write.
+	// Table name and colums. Message fields to write.  The schema and table
+	// may be templates, with %{fieldname} filled in from each message.
 	InsertSchema        string `toml:"insert_schema"`
 	InsertTable         string `toml:"insert_table"`
 	InsertTableColumns  string `toml:"insert_table_columns"`
 	InsertMessageFields string `toml:"insert_message_fields"`
+	// Templated tables that may be written to, as "schema.table" (or "table"
+	// when the schema isn't templated), or a regular expression matching the
+	// whole of "schema.table".  At least one is required when the schema or
+	// table is templated.
+	AllowedTables        []string `toml:"allowed_tables"`
+	AllowedTablesPattern string   `toml:"allowed_tables_pattern"`
 	// If a field is missing in the Heka message, allow writing NULL
 	AllowMissingMessageFields bool `toml:"allow_missing_message_fields"`
+	// Types values are converted to, keyed by column: "int", "float", "bool",
+	// "text", "timestamptz", "timestamptz_ms", "timestamptz_ns", "jsonb" or
+	// "text[]".  Other columns get the field's first value as it is.
+	ColumnTypes map[string]string `toml:"column_types"`
+	// Values written when a column's field is missing, keyed by column
+	ColumnDefaults map[string]string `toml:"column_defaults"`
+	// How batches are written: multi-row "insert" statements (default),
+	// "copy" (COPY FROM STDIN), which falls back to INSERT for 10 minutes at a
+	// time if the server doesn't support it, or "redshift" (staged in S3,
+	// then COPY ... FROM S3)
+	InsertMethod string `toml:"insert_method"`
+
+	// What to do with rows that conflict with existing rows: "" (fail, the
+	// default), "nothing" (skip them) or "update" (overwrite
+	// conflict_update_columns).  Makes replayed messages idempotent.
+	ConflictAction string `toml:"conflict_action"`
+	// Space delimited columns of the unique constraint rows conflict on.
+	// Required for "update", and by insert_method "redshift".
+	ConflictColumns string `toml:"conflict_columns"`
+	// Space delimited columns "update" overwrites (default: every inserted
+	// column not in conflict_columns)
+	ConflictUpdateColumns string `toml:"conflict_update_columns"`
+
+	// Redshift staging.  Batches are written to redshift_staging_bucket, or
+	// to redshift_staging_dir as a local stand-in for S3.
+	RedshiftStagingBucket      string `toml:"redshift_staging_bucket"`
+	RedshiftStagingPrefix      string `toml:"redshift_staging_prefix"`
+	RedshiftStagingDir         string `toml:"redshift_staging_dir"`
+	RedshiftStagingRegion      string `toml:"redshift_staging_region"`
+	RedshiftStagingEndpointURL string `toml:"redshift_staging_endpoint_url"`
+	// Address the bucket by path, as most S3-compatible servers expect
+	RedshiftStagingPathStyle bool `toml:"redshift_staging_path_style"`
+	// Static AWS credentials for the staging bucket.  If unset, credentials
+	// come from redshift_staging_profile or the default chain (env vars,
+	// shared credentials file, instance role).
+	RedshiftStagingAccessKeyID     string `toml:"redshift_staging_access_key_id"`
+	RedshiftStagingSecretAccessKey string `toml:"redshift_staging_secret_access_key"`
+	RedshiftStagingSessionToken    string `toml:"redshift_staging_session_token"`
+	// Named profile from the shared AWS credentials and config files
+	RedshiftStagingProfile string `toml:"redshift_staging_profile"`
+	// IAM role to assume for staging, e.g. for a bucket in another account
+	RedshiftStagingAssumeRoleARN string `toml:"redshift_staging_assume_role_arn"`
+	// Session name used when assuming the role (default "heka")
+	RedshiftStagingAssumeRoleSessionName string `toml:"redshift_staging_assume_role_session_name"`
+	// External ID required by the role's trust policy, if any
+	RedshiftStagingAssumeRoleExternalID string `toml:"redshift_staging_assume_role_external_id"`
+	// Staged file format: "csv" (default) or "json"
+	RedshiftStagingFormat string `toml:"redshift_staging_format"`
+	// IAM role Redshift assumes to read the staged files
+	RedshiftIAMRole string `toml:"redshift_iam_role"`
+	// Extra COPY options, e.g. "TRUNCATECOLUMNS MAXERROR 10"
+	RedshiftCopyOptions string `toml:"redshift_copy_options"`
 
 	// Database Connection
 	DBHost               string `toml:"db_host"`
@@ -69,7 +138,23 @@ func (po *PostgresOutput) ConfigStruct() interface{} {
 		FlushInterval:             uint32(1000),
 		FlushCount:                5000,
 		InsertSchema:              "public",
+		InsertMethod:              insertMethodInsert,
 		QueryTimeout:              uint32(300000),
+
+		RedshiftStagingAssumeRoleSessionName: "heka",
+	}
+}
+
+func (c *PostgresOutputConfig) stagingSessionConfig() aws.SessionConfig {
+	return aws.SessionConfig{
+		Region:                c.RedshiftStagingRegion,
+		AccessKeyID:           c.RedshiftStagingAccessKeyID,
+		SecretAccessKey:       c.RedshiftStagingSecretAccessKey,
+		SessionToken:          c.RedshiftStagingSessionToken,
+		Profile:               c.RedshiftStagingProfile,
+		AssumeRoleARN:         c.RedshiftStagingAssumeRoleARN,
+		AssumeRoleSessionName: c.RedshiftStagingAssumeRoleSessionName,
+		AssumeRoleExternalID:  c.RedshiftStagingAssumeRoleExternalID,
 	}
 }
 
@@ -78,17 +163,46 @@ func (po *PostgresOutput) Init(rawConf interface{}) error {
 	po.flushInterval = config.FlushInterval
 	po.flushCount = config.FlushCount
 	po.queryTimeout = config.QueryTimeout
-	po.insertSchema = config.InsertSchema
-	po.insertTable = config.InsertTable
+	tables, err := newTableRouter(
+		config.InsertSchema, config.InsertTable, config.AllowedTables, config.AllowedTablesPattern,
+	)
+	if err != nil {
+		return err
+	}
+	po.tables = tables
 	if config.InsertMessageFields == "" {
 		return fmt.Errorf("config item 'insert_message_fields' cannot be empty string")
 	}
-	po.insertMessageFields = strings.Split(config.InsertMessageFields, " ")
 	if config.InsertTableColumns == "" {
 		return fmt.Errorf("config item 'insert_table_columns' cannot be empty string")
 	}
 	po.insertTableColumns = strings.Split(config.InsertTableColumns, " ")
+	po.columns, err = newColumnSpecs(
+		po.insertTableColumns, strings.Split(config.InsertMessageFields, " "),
+		config.ColumnTypes, config.ColumnDefaults,
+	)
+	if err != nil {
+		return err
+	}
 	po.allowMissingMessageFields = config.AllowMissingMessageFields
+	switch config.InsertMethod {
+	case insertMethodInsert, insertMethodCopy, insertMethodRedshift:
+		po.insertMethod = config.InsertMethod
+	default:
+		return fmt.Errorf("Unknown insert_method '%s' (expected 'insert', 'copy' or 'redshift')", config.InsertMethod)
+	}
+	conflict, err := newConflict(config, po.insertTableColumns)
+	if err != nil {
+		return err
+	}
+	if err := conflict.Validate(po.insertTableColumns); err != nil {
+		return err
+	}
+	if conflict != nil && po.insertMethod == insertMethodRedshift && len(conflict.Target) == 0 {
+		return fmt.Errorf("insert_method 'redshift' needs conflict_columns to find conflicting rows")
+	}
+	po.conflict = conflict
+
 	p := postgres.DBConnectionParams{
 		Host:           config.DBHost,
 		Port:           config.DBPort,
@@ -100,8 +214,8 @@ func (po *PostgresOutput) Init(rawConf interface{}) error {
 	}
 
 	// since Redshift does not allow more than `redshiftParamsLimit` params, the query should be flushed
-	// before the number of params crosses that amount
-	if po.flushCount*len(po.insertTableColumns) > redshiftParamsLimit {
+	// before the number of params crosses that amount.  COPY has no parameters.
+	if po.insertMethod == insertMethodInsert && po.flushCount*len(po.insertTableColumns) > redshiftParamsLimit {
 		po.flushCount = int(redshiftParamsLimit / len(po.insertTableColumns))
 	}
 
@@ -111,9 +225,76 @@ func (po *PostgresOutput) Init(rawConf interface{}) error {
 	}
 	db.SetMaxOpenConns(config.DBMaxOpenConnections)
 	po.db = db
+
+	if po.insertMethod == insertMethodRedshift {
+		store, err := redshiftStagingStore(config)
+		if err != nil {
+			return err
+		}
+		po.redshift, err = postgres.NewRedshiftLoader(db, store, postgres.RedshiftConfig{
+			Format:      config.RedshiftStagingFormat,
+			IAMRole:     config.RedshiftIAMRole,
+			CopyOptions: config.RedshiftCopyOptions,
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// newConflict returns how conflicting rows are handled, or nil if they
+// aren't
+func newConflict(config *PostgresOutputConfig, columns []string) (*postgres.Conflict, error) {
+	target := strings.Fields(config.ConflictColumns)
+
+	switch config.ConflictAction {
+	case "":
+		return nil, nil
+	case "nothing":
+		return &postgres.Conflict{Target: target}, nil
+	case "update":
+		update := strings.Fields(config.ConflictUpdateColumns)
+		if len(update) == 0 {
+			for _, column := range columns {
+				if !stringInSlice(target, column) {
+					update = append(update, column)
+				}
+			}
+		}
+		return &postgres.Conflict{Target: target, Update: update}, nil
+	default:
+		return nil, fmt.Errorf("Unknown conflict_action '%s' (expected 'nothing' or 'update')", config.ConflictAction)
+	}
+}
+
+func stringInSlice(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// redshiftStagingStore returns where batches are staged for Redshift
+func redshiftStagingStore(config *PostgresOutputConfig) (postgres.ObjectStore, error) {
+	if config.RedshiftStagingDir != "" {
+		return &postgres.DirStore{Dir: config.RedshiftStagingDir}, nil
+	}
+
+	sess, err := aws.NewSession(config.stagingSessionConfig())
+	if err != nil {
+		return nil, err
+	}
+	return aws.NewS3Store(sess, aws.S3Config{
+		Bucket:         config.RedshiftStagingBucket,
+		Prefix:         config.RedshiftStagingPrefix,
+		Endpoint:       config.RedshiftStagingEndpointURL,
+		ForcePathStyle: config.RedshiftStagingPathStyle,
+	})
+}
+
 func (o *PostgresOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	defer o.db.Close()
 
@@ -130,27 +311,43 @@ func (o *PostgresOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	return
 }
 
+// tableBatch is buffered rows for a single table
+type tableBatch struct {
+	dest tableDestination
+	rows [][]interface{}
+}
+
 // Runs in a separate goroutine, accepting incoming messages, buffering output
-// data until the ticker triggers the buffered data should be put onto the
-// committer channel.
-func (o *PostgresOutput) receiver(committers chan<- [][]interface{}, wg *sync.WaitGroup) {
+// data per table until the ticker triggers the buffered data should be put
+// onto the committer channel.
+func (o *PostgresOutput) receiver(committers chan<- tableBatch, wg *sync.WaitGroup) {
 	var pack *PipelinePack
 
 	ticker := time.Tick(time.Duration(o.flushInterval) * time.Millisecond)
-	batch := [][]interface{}{}
+	batches := map[tableDestination][][]interface{}{}
+	flushAll := func() {
+		for dest, rows := range batches {
+			committers <- tableBatch{dest: dest, rows: rows}
+		}
+		batches = map[tableDestination][][]interface{}{}
+	}
 
 	for ok := true; ok; {
 		select {
 		case pack, ok = <-o.runner.InChan():
 			if !ok {
 				// Closed inChan => we're shutting down, flush data
-				committers <- batch
+				flushAll()
 				close(committers)
 				break
 			}
 
 			// Read values from message fields
-			vals, err := o.convertMessageToValues(pack.Message, o.insertMessageFields)
+			dest, err := o.tables.route(pack.Message)
+			var vals []interface{}
+			if err == nil {
+				vals, err = o.convertMessageToValues(pack.Message)
+			}
 
 			o.lastMsgLoopCount = pack.MsgLoopCount // here to help prevent infinite error loops
 			pack.Recycle(err)
@@ -158,15 +355,14 @@ func (o *PostgresOutput) receiver(committers chan<- [][]interface{}, wg *sync.Wa
 			if err != nil {
 				o.logError(err)
 			} else {
-				batch = append(batch, vals)
-				if len(batch) >= o.flushCount {
-					committers <- batch
-					batch = [][]interface{}{}
+				batches[dest] = append(batches[dest], vals)
+				if len(batches[dest]) >= o.flushCount {
+					committers <- tableBatch{dest: dest, rows: batches[dest]}
+					delete(batches, dest)
 				}
 			}
 		case <-ticker:
-			committers <- batch
-			batch = [][]interface{}{}
+			flushAll()
 		}
 	}
 	wg.Done()
@@ -175,14 +371,14 @@ func (o *PostgresOutput) receiver(committers chan<- [][]interface{}, wg *sync.Wa
 // Runs in a separate goroutine, waits for buffered data on the committer
 // channel, bulk inserts it into Postgres, and puts the now empty buffer on the
 // return channel for reuse.
-func (o *PostgresOutput) makeCommitters(count int, wg *sync.WaitGroup) chan<- [][]interface{} {
-	batches := make(chan [][]interface{})
+func (o *PostgresOutput) makeCommitters(count int, wg *sync.WaitGroup) chan<- tableBatch {
+	batches := make(chan tableBatch)
 
 	for i := 0; i < count; i++ {
 		wg.Add(1)
 		go func(i int) {
 			for batch := range batches {
-				if len(batch) <= 0 {
+				if len(batch.rows) <= 0 {
 					continue
 				}
 
@@ -203,11 +399,21 @@ func (o *PostgresOutput) makeCommitters(count int, wg *sync.WaitGroup) chan<- []
 	return batches
 }
 
-func (o *PostgresOutput) commit(batch [][]interface{}) <-chan struct{} {
+func (o *PostgresOutput) commit(batch tableBatch) <-chan struct{} {
 	done := make(chan struct{})
 
 	go func() {
-		err := o.db.Insert(o.insertSchema, o.insertTable, o.insertTableColumns, batch)
+		schema, table, rows := batch.dest.schema, batch.dest.table, batch.rows
+
+		var err error
+		switch o.insertMethod {
+		case insertMethodCopy:
+			err = o.db.Copy(schema, table, o.insertTableColumns, rows, o.conflict)
+		case insertMethodRedshift:
+			err = o.redshift.Load(schema, table, o.insertTableColumns, rows, o.conflict)
+		default:
+			err = o.db.Upsert(schema, table, o.insertTableColumns, rows, o.conflict)
+		}
 		if err != nil {
 			o.logError(err)
 		}
@@ -217,29 +423,30 @@ func (o *PostgresOutput) commit(batch [][]interface{}) <-chan struct{} {
 	return done
 }
 
-// convertMessageToValue reads a Heka Message and returns a slice of field values
-func (po *PostgresOutput) convertMessageToValues(m *message.Message, insertFields []string) (fieldValues []interface{}, err error) {
+// convertMessageToValue reads a Heka Message and returns a slice of column
+// values
+func (po *PostgresOutput) convertMessageToValues(m *message.Message) (fieldValues []interface{}, err error) {
 	fieldValues = []interface{}{}
 	missingFields := []string{}
-	for _, field := range insertFields {
-		// Special case: get "Timestamp" from Heka message
-		if field == "Timestamp" {
-			// Convert Heka time (Unix timestamp in nanoseconds) to Golang time
-			v := time.Unix(0, m.GetTimestamp())
-			fieldValues = append(fieldValues, v)
-		} else {
-			v, ok := m.GetFieldValue(field)
-			if !ok {
+	for _, spec := range po.columns {
+		values, ok := sourceValues(m, spec.source)
+		if !ok {
+			if spec.hasDefault {
+				fieldValues = append(fieldValues, spec.def)
+			} else if po.allowMissingMessageFields {
 				// If configured to do so, write NULL when a FieldValue isn't found in the Heka message
-				if po.allowMissingMessageFields {
-					v = nil
-				} else {
-					missingFields = append(missingFields, field)
-					continue
-				}
+				fieldValues = append(fieldValues, nil)
+			} else {
+				missingFields = append(missingFields, spec.source)
 			}
-			fieldValues = append(fieldValues, v)
+			continue
+		}
+
+		v, err := convertColumn(spec.kind, values)
+		if err != nil {
+			return []interface{}{}, fmt.Errorf("can't write field '%s' to column '%s': %s", spec.source, spec.column, err.Error())
 		}
+		fieldValues = append(fieldValues, v)
 	}
 
 	if len(missingFields) > 0 {
@@ -0,0 +1,72 @@
+package heka_clever_plugins
+
+import (
+	"time"
+)
+
+// MsgPack is a record on its way to be batched, with the queue cursor of the
+// message it was built from
+type MsgPack struct {
+	record []byte
+	// Kinesis partition key, if any
+	partitionKey string
+	queueCursor  string
+}
+
+// recordBatch holds the records batched since the last send
+type recordBatch struct {
+	records [][]byte
+	// keys[i] is the partition key of records[i]
+	keys []string
+	// Cursor of the last message batched
+	queueCursor string
+}
+
+// runBatchSender is the go routine of outputs that send records in batches.
+// It gets sent:
+//   - messages to be batched
+//   - a stop signal
+//   - a flush signal
+//
+// send is called with the batch every time it holds flushCount records, the
+// ticker fires or the output stops, unless the batch is empty.  The batch is
+// reset once send returns.  done is closed once the final send on stop has
+// returned.
+func runBatchSender(
+	packs <-chan MsgPack, stop <-chan bool, ticker <-chan time.Time, flushCount int,
+	send func(batch *recordBatch), done chan<- struct{},
+) {
+	defer close(done)
+
+	batch := &recordBatch{
+		records: make([][]byte, 0, flushCount),
+		keys:    make([]string, 0, flushCount),
+	}
+	flush := func() {
+		if len(batch.records) <= 0 {
+			return
+		}
+		send(batch)
+		batch.records = batch.records[0:0]
+		batch.keys = batch.keys[0:0]
+	}
+
+	for {
+		select {
+		case <-stop:
+			flush()
+			return
+		case <-ticker:
+			flush()
+		case pack := <-packs:
+			if len(pack.record) > 0 {
+				batch.records = append(batch.records, pack.record)
+				batch.keys = append(batch.keys, pack.partitionKey)
+				batch.queueCursor = pack.queueCursor
+			}
+			if len(batch.records) >= flushCount {
+				flush()
+			}
+		}
+	}
+}
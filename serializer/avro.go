@@ -0,0 +1,433 @@
+package serializer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro"
+)
+
+// AvroEncoder writes each object in Avro's single-object encoding: a two byte
+// marker and the 8 byte fingerprint of the schema, then the binary encoding of
+// the object as the schema's top-level record.  Binary encodings are
+// self-delimiting given the schema, so records written back to back (e.g. the
+// S3 objects Firehose delivers) are read by decoding one record after another
+// until the data runs out, and the fingerprint identifies the schema each was
+// written with.
+//
+// Records are encoded by goavro; objects are first put in the form it
+// expects.  A field missing from an object is written as its default, or as
+// null if its type allows it, and a value of a union type is written as the
+// first branch that can hold it.
+type AvroEncoder struct {
+	codec  *goavro.Codec
+	schema interface{}
+	// Named types, by full name
+	named map[string]avroNamed
+}
+
+type avroNamed struct {
+	schema map[string]interface{}
+	// Namespace of the types nested in it
+	namespace string
+}
+
+// NewAvroEncoder parses a JSON Avro schema, whose top level must be a record
+func NewAvroEncoder(schemaJSON []byte) (*AvroEncoder, error) {
+	codec, err := goavro.NewCodec(string(schemaJSON))
+	if err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %s", err.Error())
+	}
+
+	var schema interface{}
+	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %s", err.Error())
+	}
+	if top, ok := schema.(map[string]interface{}); !ok || top["type"] != "record" {
+		return nil, fmt.Errorf("invalid avro schema: top level type must be a record")
+	}
+
+	e := &AvroEncoder{codec: codec, schema: schema, named: map[string]avroNamed{}}
+	if err := e.index(schema, ""); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %s", err.Error())
+	}
+	return e, nil
+}
+
+// avroFullName returns the full name of the named type t declared in
+// namespace, and the namespace of the types nested in it
+func avroFullName(t map[string]interface{}, namespace string) (string, string) {
+	name, _ := t["name"].(string)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name, name[:i]
+	}
+	if ns, ok := t["namespace"].(string); ok {
+		namespace = ns
+	}
+	if namespace == "" {
+		return name, ""
+	}
+	return namespace + "." + name, namespace
+}
+
+// index records every named type declared in schema
+func (e *AvroEncoder) index(schema interface{}, namespace string) error {
+	switch t := schema.(type) {
+	case []interface{}:
+		for _, branch := range t {
+			if err := e.index(branch, namespace); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		switch t["type"] {
+		case "record", "enum", "fixed":
+			name, ns := avroFullName(t, namespace)
+			if _, ok := e.named[name]; ok {
+				return fmt.Errorf("type '%s' is defined twice", name)
+			}
+			e.named[name] = avroNamed{schema: t, namespace: ns}
+
+			fields, _ := t["fields"].([]interface{})
+			for _, field := range fields {
+				fieldDef, _ := field.(map[string]interface{})
+				if err := e.index(fieldDef["type"], ns); err != nil {
+					return err
+				}
+			}
+		case "array":
+			return e.index(t["items"], namespace)
+		case "map":
+			return e.index(t["values"], namespace)
+		}
+	}
+	return nil
+}
+
+// resolve returns the definition of the type schema names, if it's a named
+// type, and the namespace its nested types are in
+func (e *AvroEncoder) resolve(schema interface{}, namespace string) (interface{}, string) {
+	name, ok := schema.(string)
+	if !ok {
+		return schema, namespace
+	}
+	// Names without a dot are relative to the enclosing namespace
+	if namespace != "" && !strings.Contains(name, ".") {
+		if named, ok := e.named[namespace+"."+name]; ok {
+			return named.schema, named.namespace
+		}
+	}
+	if named, ok := e.named[name]; ok {
+		return named.schema, named.namespace
+	}
+	return schema, namespace
+}
+
+// branchName returns the name goavro gives a union branch
+func (e *AvroEncoder) branchName(schema interface{}, namespace string) string {
+	schema, namespace = e.resolve(schema, namespace)
+	switch t := schema.(type) {
+	case string:
+		return t
+	case map[string]interface{}:
+		kind, _ := t["type"].(string)
+		switch kind {
+		case "record", "enum", "fixed":
+			name, _ := avroFullName(t, namespace)
+			return name
+		case "array", "map":
+			return kind
+		}
+		if logical, ok := t["logicalType"].(string); ok {
+			return kind + "." + logical
+		}
+		return kind
+	}
+	return ""
+}
+
+// nullable reports whether schema allows null
+func (e *AvroEncoder) nullable(schema interface{}) bool {
+	if schema == "null" {
+		return true
+	}
+	branches, _ := schema.([]interface{})
+	for _, branch := range branches {
+		if branch == "null" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *AvroEncoder) Encode(object map[string]interface{}) ([]byte, error) {
+	native, err := e.native(e.schema, "", object)
+	if err != nil {
+		return nil, err
+	}
+	return e.codec.SingleFromNative(nil, native)
+}
+
+// native returns value in the form goavro encodes as schema
+func (e *AvroEncoder) native(schema interface{}, namespace string, value interface{}) (interface{}, error) {
+	schema, namespace = e.resolve(schema, namespace)
+
+	switch t := schema.(type) {
+	case string:
+		return avroPrimitive(t, value)
+
+	case []interface{}:
+		// Use the first branch that can hold the value
+		for _, branch := range t {
+			native, err := e.native(branch, namespace, value)
+			if err != nil {
+				continue
+			}
+			if native == nil {
+				return nil, nil
+			}
+			return map[string]interface{}{e.branchName(branch, namespace): native}, nil
+		}
+		return nil, fmt.Errorf("no union branch can hold %v", value)
+
+	case map[string]interface{}:
+		kind, _ := t["type"].(string)
+		switch kind {
+		case "record":
+			_, ns := avroFullName(t, namespace)
+			return e.nativeRecord(t, ns, value)
+
+		case "enum":
+			symbol, _ := value.(string)
+			symbols, _ := t["symbols"].([]interface{})
+			for _, s := range symbols {
+				if s == symbol {
+					return symbol, nil
+				}
+			}
+			return nil, fmt.Errorf("'%v' isn't an enum symbol", value)
+
+		case "fixed":
+			var b []byte
+			switch v := value.(type) {
+			case string:
+				b = []byte(v)
+			case []byte:
+				b = v
+			}
+			size, _ := t["size"].(float64)
+			if b == nil || float64(len(b)) != size {
+				return nil, fmt.Errorf("expected fixed of %v bytes, got %v", size, value)
+			}
+			return b, nil
+
+		case "array":
+			items := reflect.ValueOf(value)
+			if value == nil || items.Kind() != reflect.Slice {
+				return nil, fmt.Errorf("expected array, got %v", value)
+			}
+			native := make([]interface{}, items.Len())
+			for i := range native {
+				item, err := e.native(t["items"], namespace, items.Index(i).Interface())
+				if err != nil {
+					return nil, err
+				}
+				native[i] = item
+			}
+			return native, nil
+
+		case "map":
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected map, got %v", value)
+			}
+			native := make(map[string]interface{}, len(m))
+			for key, v := range m {
+				item, err := e.native(t["values"], namespace, v)
+				if err != nil {
+					return nil, err
+				}
+				native[key] = item
+			}
+			return native, nil
+
+		default:
+			// e.g. {"type": "long", "logicalType": "timestamp-millis"}
+			if unit, ok := avroTimeUnits[e.branchName(t, namespace)]; ok {
+				return avroTime(t["logicalType"].(string), unit, value)
+			}
+			return e.native(t["type"], namespace, value)
+		}
+	}
+
+	return nil, fmt.Errorf("invalid type %v", schema)
+}
+
+func (e *AvroEncoder) nativeRecord(schema map[string]interface{}, namespace string, value interface{}) (interface{}, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected record, got %v", value)
+	}
+
+	fields, _ := schema["fields"].([]interface{})
+	native := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		fieldDef, _ := field.(map[string]interface{})
+		name, _ := fieldDef["name"].(string)
+
+		fieldValue, present := object[name]
+		if !present {
+			if def, ok := fieldDef["default"]; ok {
+				fieldValue = def
+			} else if !e.nullable(fieldDef["type"]) {
+				return nil, fmt.Errorf("field '%s' is missing", name)
+			}
+		}
+
+		fieldNative, err := e.native(fieldDef["type"], namespace, fieldValue)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %s", name, err.Error())
+		}
+		native[name] = fieldNative
+	}
+	return native, nil
+}
+
+// avroPrimitive returns value as the primitive type kind
+func avroPrimitive(kind string, value interface{}) (interface{}, error) {
+	switch kind {
+	case "null":
+		if value == nil {
+			return nil, nil
+		}
+
+	case "boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+
+	case "int":
+		if n, ok := avroInteger(value); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+			return int32(n), nil
+		}
+
+	case "long":
+		if n, ok := avroInteger(value); ok {
+			return n, nil
+		}
+
+	case "float":
+		if f, ok := avroFloat(value); ok {
+			return float32(f), nil
+		}
+
+	case "double":
+		if f, ok := avroFloat(value); ok {
+			return f, nil
+		}
+
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case []byte:
+			return string(v), nil
+		}
+
+	case "bytes":
+		switch v := value.(type) {
+		case string:
+			return []byte(v), nil
+		case []byte:
+			return v, nil
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown type '%s'", kind)
+	}
+
+	return nil, fmt.Errorf("expected %s, got %v", kind, value)
+}
+
+// Units of the logical types goavro reads as a time.Time, or for time-millis
+// and time-micros, a time.Duration since midnight
+var avroTimeUnits = map[string]time.Duration{
+	"long.timestamp-millis": time.Millisecond,
+	"long.timestamp-micros": time.Microsecond,
+	"int.date":              24 * time.Hour,
+	"int.time-millis":       time.Millisecond,
+	"long.time-micros":      time.Microsecond,
+}
+
+// avroTime returns value as the logical type logical.  Numbers are counts of
+// unit since the Unix epoch (or midnight), and strings are RFC 3339
+// timestamps, or for dates, e.g. "2006-01-02".
+func avroTime(logical string, unit time.Duration, value interface{}) (interface{}, error) {
+	if logical == "time-millis" || logical == "time-micros" {
+		if d, ok := value.(time.Duration); ok {
+			return d, nil
+		}
+		if n, ok := avroInteger(value); ok {
+			return time.Duration(n) * unit, nil
+		}
+		return nil, fmt.Errorf("expected %s, got %v", logical, value)
+	}
+
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+	default:
+		if n, ok := avroInteger(value); ok {
+			if unit >= time.Second {
+				return time.Unix(n*int64(unit/time.Second), 0).UTC(), nil
+			}
+			perSecond := int64(time.Second / unit)
+			return time.Unix(n/perSecond, n%perSecond*int64(unit)).UTC(), nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s, got %v", logical, value)
+}
+
+func avroInteger(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		// JSON numbers, e.g. schema defaults
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+func avroFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,74 @@
+package serializer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// CSVEncoder writes each object as one delimited line, with a value for each
+// configured column.  Values containing the delimiter, quotes or newlines are
+// quoted, with quotes doubled, as Redshift's COPY ... CSV expects.
+type CSVEncoder struct {
+	columns   []string
+	delimiter rune
+}
+
+// NewCSVEncoder returns a CSVEncoder writing columns separated by delimiter
+// (e.g. ',' or '\t')
+func NewCSVEncoder(columns []string, delimiter rune) (*CSVEncoder, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("delimited records need a list of columns")
+	}
+	return &CSVEncoder{columns: columns, delimiter: delimiter}, nil
+}
+
+func (e *CSVEncoder) Encode(object map[string]interface{}) ([]byte, error) {
+	row := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		value, err := csvValue(object[column])
+		if err != nil {
+			return nil, fmt.Errorf("can't encode column '%s': %s", column, err.Error())
+		}
+		row[i] = value
+	}
+
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+	writer.Comma = e.delimiter
+	if err := writer.Write(row); err != nil {
+		return nil, err
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// csvValue formats a single value.  Missing values are empty, and arrays are
+// written as JSON.
+func csvValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	}
+}
@@ -0,0 +1,96 @@
+package serializer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// Encoder turns the objects built by a Serializer into records
+type Encoder interface {
+	Encode(object map[string]interface{}) ([]byte, error)
+}
+
+// EncoderConfig selects and configures an Encoder
+type EncoderConfig struct {
+	// "json" (the default), "csv", "tsv" or "avro"
+	Format string
+	// Columns, in order.  Required for "csv" and "tsv".  For "json", limits
+	// records to these keys, written in this order.
+	Columns []string
+	// Avro schema file, required for "avro"
+	AvroSchemaFile string
+	// End each JSON record with a newline
+	Newline bool
+}
+
+// NewEncoder returns the Encoder described by conf
+func NewEncoder(conf EncoderConfig) (Encoder, error) {
+	switch conf.Format {
+	case "", "json":
+		return &JSONEncoder{Columns: conf.Columns, Newline: conf.Newline}, nil
+	case "csv":
+		return NewCSVEncoder(conf.Columns, ',')
+	case "tsv":
+		return NewCSVEncoder(conf.Columns, '\t')
+	case "avro":
+		if conf.AvroSchemaFile == "" {
+			return nil, fmt.Errorf("avro records need a schema file")
+		}
+		schema, err := ioutil.ReadFile(conf.AvroSchemaFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewAvroEncoder(schema)
+	default:
+		return nil, fmt.Errorf("Unknown record format '%s' (expected json, csv, tsv or avro)", conf.Format)
+	}
+}
+
+// JSONEncoder writes each object as a JSON object
+type JSONEncoder struct {
+	// If set, only these keys are written, in this order.  Otherwise every
+	// key is written, sorted.
+	Columns []string
+	Newline bool
+}
+
+func (e *JSONEncoder) Encode(object map[string]interface{}) ([]byte, error) {
+	columns := e.Columns
+	if len(columns) == 0 {
+		columns = make([]string, 0, len(object))
+		for column := range object {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, column := range columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(column)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(object[column])
+		if err != nil {
+			return nil, fmt.Errorf("can't encode column '%s': %s", column, err.Error())
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	if e.Newline {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
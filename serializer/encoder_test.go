@@ -0,0 +1,301 @@
+package serializer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONEncoder(t *testing.T) {
+	object := map[string]interface{}{"b": int64(2), "a": "x", "c": nil}
+
+	record, err := (&JSONEncoder{}).Encode(object)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":"x","b":2,"c":null}`, string(record))
+
+	record, err = (&JSONEncoder{Columns: []string{"b", "a", "missing"}, Newline: true}).Encode(object)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"b\":2,\"a\":\"x\",\"missing\":null}\n", string(record))
+}
+
+func TestCSVEncoder(t *testing.T) {
+	object := map[string]interface{}{
+		"name":   `say "hi", bye`,
+		"status": int64(200),
+		"ratio":  0.5,
+		"ok":     true,
+		"tags":   []string{"a", "b"},
+		"tab":    "a\tb",
+	}
+	columns := []string{"name", "status", "ratio", "ok", "tags", "missing", "tab"}
+
+	csvEncoder, err := NewCSVEncoder(columns, ',')
+	assert.NoError(t, err)
+	record, err := csvEncoder.Encode(object)
+	assert.NoError(t, err)
+	assert.Equal(t, "\"say \"\"hi\"\", bye\",200,0.5,true,\"[\"\"a\"\",\"\"b\"\"]\",,a\tb\n", string(record))
+
+	tsvEncoder, err := NewCSVEncoder(columns, '\t')
+	assert.NoError(t, err)
+	record, err = tsvEncoder.Encode(object)
+	assert.NoError(t, err)
+	assert.Equal(t, "\"say \"\"hi\"\", bye\"\t200\t0.5\ttrue\t\"[\"\"a\"\",\"\"b\"\"]\"\t\t\"a\tb\"\n", string(record))
+
+	_, err = NewCSVEncoder(nil, ',')
+	assert.Error(t, err)
+}
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "Event",
+	"fields": [
+		{"name": "series", "type": "string"},
+		{"name": "status", "type": "long"},
+		{"name": "ok", "type": "boolean"},
+		{"name": "ratio", "type": "double"},
+		{"name": "note", "type": ["null", "string"]},
+		{"name": "level", "type": {"type": "enum", "name": "Level", "symbols": ["low", "high"]}, "default": "high"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}}
+	]
+}`
+
+// avroHeader returns the single-object encoding header of codec's records
+func avroHeader(codec *goavro.Codec) []byte {
+	header := []byte{0xc3, 0x01}
+	for i := uint(0); i < 8; i++ {
+		header = append(header, byte(codec.Rabin>>(8*i)))
+	}
+	return header
+}
+
+func TestAvroEncoder(t *testing.T) {
+	encoder, err := NewAvroEncoder([]byte(testAvroSchema))
+	assert.NoError(t, err)
+	codec, err := goavro.NewCodec(testAvroSchema)
+	assert.NoError(t, err)
+
+	record, err := encoder.Encode(map[string]interface{}{
+		"series": "hi",
+		"status": int64(-2),
+		"ok":     true,
+		"ratio":  1.0,
+		"tags":   []string{"a", "b"},
+		"extra":  "ignored",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, append(avroHeader(codec),
+		0x04, 'h', 'i', // string: zigzag length 2
+		0x03,                                           // long: zigzag -2
+		0x01,                                           // boolean
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f, // double 1.0, little-endian
+		0x00,                             // union branch 0: null
+		0x02,                             // enum default "high"
+		0x04, 0x02, 'a', 0x02, 'b', 0x00, // array block of 2, then end
+	), record)
+
+	record, err = encoder.Encode(map[string]interface{}{
+		"series": "", "status": int64(0), "ok": false, "ratio": 0.0,
+		"note": "x", "level": "low", "tags": []string{},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, append(avroHeader(codec),
+		0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x02, 'x', // union branch 1: string
+		0x00,
+		0x00,
+	), record)
+
+	_, err = encoder.Encode(map[string]interface{}{"series": "hi"})
+	assert.Error(t, err, "required fields are missing")
+
+	_, err = NewAvroEncoder([]byte(`"string"`))
+	assert.Error(t, err)
+	_, err = NewAvroEncoder([]byte(`{"type": "record", "name": "R", "fields": [{"name": "a", "type": "Unknown"}]}`))
+	assert.Error(t, err)
+}
+
+func TestAvroEncoderRecordsDecodeBackToBack(t *testing.T) {
+	encoder, err := NewAvroEncoder([]byte(testAvroSchema))
+	assert.NoError(t, err)
+	codec, err := goavro.NewCodec(testAvroSchema)
+	assert.NoError(t, err)
+
+	objects := []map[string]interface{}{
+		{"series": "hi", "status": int64(-2), "ok": true, "ratio": 1.5, "tags": []string{"a", "b"}},
+		{"series": "", "status": int64(300), "ok": false, "ratio": 0.0, "note": "x", "level": "low", "tags": []string{}},
+	}
+
+	t.Log("Records concatenated into one object, as Firehose writes them to S3, decode one after another")
+	data := []byte{}
+	for _, object := range objects {
+		record, err := encoder.Encode(object)
+		assert.NoError(t, err)
+		data = append(data, record...)
+	}
+
+	decoded := []interface{}{}
+	for len(data) > 0 {
+		native, rest, err := codec.NativeFromSingle(data)
+		if !assert.NoError(t, err) {
+			return
+		}
+		decoded = append(decoded, native)
+		data = rest
+	}
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"series": "hi", "status": int64(-2), "ok": true, "ratio": 1.5, "note": nil,
+			"level": "high", "tags": []interface{}{"a", "b"},
+		},
+		map[string]interface{}{
+			"series": "", "status": int64(300), "ok": false, "ratio": 0.0,
+			"note": map[string]interface{}{"string": "x"}, "level": "low", "tags": []interface{}{},
+		},
+	}, decoded)
+
+	t.Log("Readers can tell records of another schema apart by their fingerprint")
+	other, err := goavro.NewCodec(`{"type": "record", "name": "Other", "fields": [{"name": "a", "type": "string"}]}`)
+	assert.NoError(t, err)
+	record, err := encoder.Encode(objects[0])
+	assert.NoError(t, err)
+	_, _, err = other.NativeFromSingle(record)
+	assert.Error(t, err)
+}
+
+func TestAvroEncoderNamedTypes(t *testing.T) {
+	schema := `{
+		"type": "record",
+		"name": "Event",
+		"namespace": "com.example",
+		"fields": [
+			{"name": "id", "type": {"type": "fixed", "name": "Id", "size": 2}},
+			{"name": "parent", "type": ["null", "Id"]},
+			{"name": "source", "type": {
+				"type": "record",
+				"name": "other.Source",
+				"fields": [{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["a", "b"]}}]
+			}},
+			{"name": "kind", "type": "other.Kind"}
+		]
+	}`
+	encoder, err := NewAvroEncoder([]byte(schema))
+	assert.NoError(t, err)
+	codec, err := goavro.NewCodec(schema)
+	assert.NoError(t, err)
+
+	record, err := encoder.Encode(map[string]interface{}{
+		"id":     "ab",
+		"parent": []byte("cd"),
+		"source": map[string]interface{}{"kind": "b"},
+		"kind":   "a",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, append(avroHeader(codec), 'a', 'b', 0x02, 'c', 'd', 0x02, 0x00), record)
+
+	_, err = encoder.Encode(map[string]interface{}{
+		"id": "abc", "source": map[string]interface{}{"kind": "b"}, "kind": "a",
+	})
+	assert.Error(t, err, "fixed values must have the fixed size")
+
+	_, err = NewAvroEncoder([]byte(`{"type": "record", "name": "R", "fields": [
+		{"name": "a", "type": {"type": "record", "fields": []}}
+	]}`))
+	assert.Error(t, err, "named types must have a name")
+	_, err = NewAvroEncoder([]byte(`{"type": "record", "name": "R", "fields": [
+		{"name": "a", "type": {"type": "enum", "name": "R", "symbols": ["x"]}}
+	]}`))
+	assert.Error(t, err, "names must be unique")
+	_, err = NewAvroEncoder([]byte(`{"type": "record", "name": "R", "fields": [
+		{"name": "a", "type": {"type": "fixed", "name": "F"}}
+	]}`))
+	assert.Error(t, err, "fixed types need a size")
+}
+
+func TestAvroEncoderLogicalTypes(t *testing.T) {
+	schema := `{
+		"type": "record",
+		"name": "Event",
+		"fields": [
+			{"name": "at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+			{"name": "at_micros", "type": ["null", {"type": "long", "logicalType": "timestamp-micros"}]},
+			{"name": "day", "type": {"type": "int", "logicalType": "date"}},
+			{"name": "time", "type": {"type": "int", "logicalType": "time-millis"}}
+		]
+	}`
+	encoder, err := NewAvroEncoder([]byte(schema))
+	assert.NoError(t, err)
+	codec, err := goavro.NewCodec(schema)
+	assert.NoError(t, err)
+
+	at := time.Date(2017, 1, 18, 14, 34, 40, 433000000, time.UTC)
+	decode := func(object map[string]interface{}) map[string]interface{} {
+		record, err := encoder.Encode(object)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		native, _, err := codec.NativeFromSingle(record)
+		assert.NoError(t, err)
+		return native.(map[string]interface{})
+	}
+
+	t.Log("Epoch numbers are read in the logical type's unit")
+	native := decode(map[string]interface{}{
+		"at":        at.UnixNano() / int64(time.Millisecond),
+		"at_micros": at.UnixNano() / int64(time.Microsecond),
+		"day":       int64(17184),
+		"time":      int64(1500),
+	})
+	assert.True(t, at.Equal(native["at"].(time.Time)))
+	assert.True(t, at.Equal(native["at_micros"].(map[string]interface{})["long.timestamp-micros"].(time.Time)))
+	assert.True(t, at.Truncate(24*time.Hour).Equal(native["day"].(time.Time)))
+	assert.Equal(t, 1500*time.Millisecond, native["time"])
+
+	t.Log("Timestamp strings and times are read as they are")
+	native = decode(map[string]interface{}{
+		"at":        at.Format(time.RFC3339Nano),
+		"at_micros": nil,
+		"day":       "2017-01-18",
+		"time":      1500 * time.Millisecond,
+	})
+	assert.True(t, at.Equal(native["at"].(time.Time)))
+	assert.Nil(t, native["at_micros"])
+	assert.True(t, at.Truncate(24*time.Hour).Equal(native["day"].(time.Time)))
+	native = decode(map[string]interface{}{"at": at, "day": at, "time": int64(0)})
+	assert.True(t, at.Equal(native["at"].(time.Time)))
+
+	_, err = encoder.Encode(map[string]interface{}{"at": "yesterday", "day": "2017-01-18", "time": int64(0)})
+	assert.Error(t, err)
+}
+
+func TestNewEncoder(t *testing.T) {
+	encoder, err := NewEncoder(EncoderConfig{})
+	assert.NoError(t, err)
+	assert.IsType(t, &JSONEncoder{}, encoder)
+
+	encoder, err = NewEncoder(EncoderConfig{Format: "tsv", Columns: []string{"a"}})
+	assert.NoError(t, err)
+	assert.Equal(t, '\t', encoder.(*CSVEncoder).delimiter)
+
+	_, err = NewEncoder(EncoderConfig{Format: "csv"})
+	assert.Error(t, err)
+	_, err = NewEncoder(EncoderConfig{Format: "parquet"})
+	assert.Error(t, err)
+	_, err = NewEncoder(EncoderConfig{Format: "avro"})
+	assert.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "serializer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	schemaFile := filepath.Join(dir, "event.avsc")
+	assert.NoError(t, ioutil.WriteFile(schemaFile, []byte(testAvroSchema), 0644))
+	encoder, err = NewEncoder(EncoderConfig{Format: "avro", AvroSchemaFile: schemaFile})
+	assert.NoError(t, err)
+	assert.IsType(t, &AvroEncoder{}, encoder)
+}
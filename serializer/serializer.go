@@ -0,0 +1,208 @@
+package serializer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// DefaultTimestampLayout is how message timestamps have always been written
+const DefaultTimestampLayout = "2006-01-02 15:04:05.000"
+
+// Timestamp layouts with special meaning.  Any other layout is a Go time
+// layout.
+const (
+	// TimestampRFC3339 writes timestamps as RFC 3339 strings, with as many
+	// fractional digits as needed
+	TimestampRFC3339 = "rfc3339"
+	// TimestampEpochSeconds, TimestampEpochMillis and TimestampEpochNanos
+	// write timestamps as integers since the Unix epoch
+	TimestampEpochSeconds = "epoch_s"
+	TimestampEpochMillis  = "epoch_ms"
+	TimestampEpochNanos   = "epoch_ns"
+)
+
+// BytesPolicy is what to do with bytes fields, which can't be written as JSON
+// text
+type BytesPolicy string
+
+const (
+	// BytesSkip leaves bytes fields out of records
+	BytesSkip BytesPolicy = "skip"
+	// BytesBase64 writes bytes fields as base64 strings
+	BytesBase64 BytesPolicy = "base64"
+)
+
+// ParseBytesPolicy returns the BytesPolicy named by policy
+func ParseBytesPolicy(policy string) (BytesPolicy, error) {
+	switch BytesPolicy(policy) {
+	case BytesSkip, BytesBase64:
+		return BytesPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("Unknown bytes policy '%s' (expected 'skip' or 'base64')", policy)
+	}
+}
+
+// Options controls how messages are turned into records
+type Options struct {
+	// Include the base Heka fields: uuid, type, logger, severity, payload,
+	// envversion, pid and hostname
+	BaseFields bool
+	// Columns the message timestamp is written to, formatted with
+	// TimestampLayout (default DefaultTimestampLayout) in TimestampLocation
+	// (default UTC)
+	TimestampColumns  []string
+	TimestampLayout   string
+	TimestampLocation *time.Location
+	// Column names for fields, keyed by field name.  Base fields are keyed by
+	// their lower-case column name, e.g. "hostname".
+	Rename map[string]string
+	// Dynamic fields left out of records
+	Exclude []string
+	// Write every value of a field with several values as an array, instead
+	// of only its first value
+	MultiValueArrays bool
+	// What to do with bytes fields (default BytesSkip)
+	Bytes BytesPolicy
+}
+
+// Serializer turns Heka messages into flat records of column to value
+type Serializer struct {
+	opts    Options
+	exclude map[string]bool
+}
+
+func New(opts Options) *Serializer {
+	if opts.TimestampLayout == "" {
+		opts.TimestampLayout = DefaultTimestampLayout
+	}
+	if opts.TimestampLocation == nil {
+		opts.TimestampLocation = time.UTC
+	}
+	if opts.Bytes == "" {
+		opts.Bytes = BytesSkip
+	}
+
+	exclude := map[string]bool{}
+	for _, name := range opts.Exclude {
+		exclude[name] = true
+	}
+
+	return &Serializer{opts: opts, exclude: exclude}
+}
+
+func (s *Serializer) column(name string) string {
+	if renamed, ok := s.opts.Rename[name]; ok {
+		return renamed
+	}
+	return name
+}
+
+// Object returns m as a flat map of column to value.  Dynamic fields are
+// written after base fields and timestamps, so they win when names collide.
+func (s *Serializer) Object(m *message.Message) map[string]interface{} {
+	object := make(map[string]interface{})
+
+	if len(s.opts.TimestampColumns) > 0 {
+		timestamp := s.timestamp(time.Unix(0, m.GetTimestamp()))
+		for _, column := range s.opts.TimestampColumns {
+			object[column] = timestamp
+		}
+	}
+
+	if s.opts.BaseFields {
+		object[s.column("uuid")] = m.GetUuidString()
+		object[s.column("type")] = m.GetType()
+		object[s.column("logger")] = m.GetLogger()
+		object[s.column("severity")] = m.GetSeverity()
+		object[s.column("payload")] = m.GetPayload()
+		object[s.column("envversion")] = m.GetEnvVersion()
+		object[s.column("pid")] = m.GetPid()
+		object[s.column("hostname")] = m.GetHostname()
+	}
+
+	for _, field := range m.Fields {
+		if field.Name == nil || s.exclude[*field.Name] {
+			continue
+		}
+
+		if value, ok := s.fieldValue(field); ok {
+			object[s.column(*field.Name)] = value
+		}
+	}
+	return object
+}
+
+// timestamp formats t with the configured layout and location
+func (s *Serializer) timestamp(t time.Time) interface{} {
+	switch s.opts.TimestampLayout {
+	case TimestampRFC3339:
+		return t.In(s.opts.TimestampLocation).Format(time.RFC3339Nano)
+	case TimestampEpochSeconds:
+		return t.Unix()
+	case TimestampEpochMillis:
+		return t.UnixNano() / int64(time.Millisecond)
+	case TimestampEpochNanos:
+		return t.UnixNano()
+	default:
+		return t.In(s.opts.TimestampLocation).Format(s.opts.TimestampLayout)
+	}
+}
+
+// fieldValue returns the value written for field, and false if it should be
+// left out
+func (s *Serializer) fieldValue(field *message.Field) (interface{}, bool) {
+	if field.GetValueType() == message.Field_BYTES {
+		if s.opts.Bytes != BytesBase64 {
+			return nil, false
+		}
+
+		values := field.GetValueBytes()
+		if len(values) == 0 {
+			return nil, false
+		}
+		if !s.opts.MultiValueArrays || len(values) == 1 {
+			return base64.StdEncoding.EncodeToString(values[0]), true
+		}
+
+		encoded := make([]string, len(values))
+		for i, value := range values {
+			encoded[i] = base64.StdEncoding.EncodeToString(value)
+		}
+		return encoded, true
+	}
+
+	if s.opts.MultiValueArrays && valueCount(field) > 1 {
+		switch field.GetValueType() {
+		case message.Field_STRING:
+			return field.GetValueString(), true
+		case message.Field_INTEGER:
+			return field.GetValueInteger(), true
+		case message.Field_DOUBLE:
+			return field.GetValueDouble(), true
+		case message.Field_BOOL:
+			return field.GetValueBool(), true
+		}
+	}
+
+	value := field.GetValue()
+	return value, value != nil
+}
+
+func valueCount(field *message.Field) int {
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		return len(field.GetValueString())
+	case message.Field_BYTES:
+		return len(field.GetValueBytes())
+	case message.Field_INTEGER:
+		return len(field.GetValueInteger())
+	case message.Field_DOUBLE:
+		return len(field.GetValueDouble())
+	case message.Field_BOOL:
+		return len(field.GetValueBool())
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+package serializer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMessage(t *testing.T) *message.Message {
+	m := &message.Message{}
+	m.SetUuid([]byte("0123456789abcdef"))
+	m.SetTimestamp(time.Date(2016, 5, 4, 3, 2, 1, 500000000, time.UTC).UnixNano())
+	m.SetType("app-log")
+	m.SetLogger("api")
+	m.SetSeverity(6)
+	m.SetPayload("hello")
+	m.SetEnvVersion("1")
+	m.SetPid(42)
+	m.SetHostname("web-1")
+
+	fields := []struct {
+		name   string
+		values []interface{}
+	}{
+		{"series", []interface{}{"requests"}},
+		{"status", []interface{}{int64(200)}},
+		{"tags", []interface{}{"a", "b"}},
+		{"raw", []interface{}{[]byte("hi"), []byte("yo")}},
+	}
+	for _, f := range fields {
+		field, err := message.NewField(f.name, f.values[0], "")
+		assert.NoError(t, err)
+		for _, value := range f.values[1:] {
+			assert.NoError(t, field.AddValue(value))
+		}
+		m.AddField(field)
+	}
+
+	// Fields without a name are skipped
+	m.AddField(&message.Field{})
+	return m
+}
+
+func TestObject(t *testing.T) {
+	baseFields := map[string]interface{}{
+		"uuid":       "30313233-3435-3637-3839-616263646566",
+		"type":       "app-log",
+		"logger":     "api",
+		"severity":   int32(6),
+		"payload":    "hello",
+		"envversion": "1",
+		"pid":        int32(42),
+		"hostname":   "web-1",
+	}
+	withBase := func(extra map[string]interface{}) map[string]interface{} {
+		object := map[string]interface{}{}
+		for k, v := range baseFields {
+			object[k] = v
+		}
+		for k, v := range extra {
+			object[k] = v
+		}
+		return object
+	}
+	without := func(object map[string]interface{}, key string) map[string]interface{} {
+		delete(object, key)
+		return object
+	}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		expected map[string]interface{}
+	}{
+		{
+			name: "fields only",
+			opts: Options{},
+			expected: map[string]interface{}{
+				"series": "requests", "status": int64(200), "tags": "a",
+			},
+		},
+		{
+			name: "base fields and timestamps",
+			opts: Options{BaseFields: true, TimestampColumns: []string{"timestamp", "time"}},
+			expected: withBase(map[string]interface{}{
+				"timestamp": "2016-05-04 03:02:01.500", "time": "2016-05-04 03:02:01.500",
+				"series": "requests", "status": int64(200), "tags": "a",
+			}),
+		},
+		{
+			name: "custom timestamp layout",
+			opts: Options{TimestampColumns: []string{"ts"}, TimestampLayout: "2006-01-02"},
+			expected: map[string]interface{}{
+				"ts": "2016-05-04", "series": "requests", "status": int64(200), "tags": "a",
+			},
+		},
+		{
+			name: "timestamp time zone",
+			opts: Options{TimestampColumns: []string{"ts"}, TimestampLocation: time.FixedZone("PDT", -7*60*60)},
+			expected: map[string]interface{}{
+				"ts": "2016-05-03 20:02:01.500", "series": "requests", "status": int64(200), "tags": "a",
+			},
+		},
+		{
+			name: "rfc3339 timestamps",
+			opts: Options{TimestampColumns: []string{"ts"}, TimestampLayout: TimestampRFC3339},
+			expected: map[string]interface{}{
+				"ts": "2016-05-04T03:02:01.5Z", "series": "requests", "status": int64(200), "tags": "a",
+			},
+		},
+		{
+			name: "epoch timestamps",
+			opts: Options{TimestampColumns: []string{"ts"}, TimestampLayout: TimestampEpochMillis},
+			expected: map[string]interface{}{
+				"ts": int64(1462330921500), "series": "requests", "status": int64(200), "tags": "a",
+			},
+		},
+		{
+			name: "renamed and excluded",
+			opts: Options{
+				BaseFields: true,
+				Rename:     map[string]string{"hostname": "host", "status": "http_status"},
+				Exclude:    []string{"series"},
+			},
+			expected: without(withBase(map[string]interface{}{
+				"host": "web-1", "http_status": int64(200), "tags": "a",
+			}), "hostname"),
+		},
+		{
+			name: "multi-value arrays",
+			opts: Options{MultiValueArrays: true},
+			expected: map[string]interface{}{
+				"series": "requests", "status": int64(200), "tags": []string{"a", "b"},
+			},
+		},
+		{
+			name: "bytes as base64",
+			opts: Options{Bytes: BytesBase64},
+			expected: map[string]interface{}{
+				"series": "requests", "status": int64(200), "tags": "a", "raw": "aGk=",
+			},
+		},
+		{
+			name: "bytes as base64 arrays",
+			opts: Options{Bytes: BytesBase64, MultiValueArrays: true, Exclude: []string{"series", "status"}},
+			expected: map[string]interface{}{
+				"tags": []string{"a", "b"}, "raw": []string{"aGk=", "eW8="},
+			},
+		},
+	}
+
+	m := testMessage(t)
+	for _, test := range tests {
+		assert.Equal(t, test.expected, New(test.opts).Object(m), test.name)
+	}
+}
+
+func TestParseBytesPolicy(t *testing.T) {
+	policy, err := ParseBytesPolicy("base64")
+	assert.NoError(t, err)
+	assert.Equal(t, BytesBase64, policy)
+
+	_, err = ParseBytesPolicy("hex")
+	assert.Error(t, err)
+}
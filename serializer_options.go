@@ -0,0 +1,73 @@
+package heka_clever_plugins
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/aws"
+	"github.com/Clever/heka-clever-plugins/serializer"
+)
+
+// newSerializer builds a serializer.Serializer from output config values.
+// The message timestamp is written to every column in timestampColumns that
+// isn't empty, in the IANA time zone timezone (e.g. "America/Los_Angeles",
+// or "Local"; default UTC).
+func newSerializer(
+	baseFields bool, rename map[string]string, multiValueArrays bool, bytes string,
+	timestampColumns []string, timestampLayout string, timezone string, exclude []string,
+) (*serializer.Serializer, error) {
+	bytesPolicy, err := serializer.ParseBytesPolicy(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	location := time.UTC
+	if timezone != "" {
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown timestamp time zone '%s': %s", timezone, err.Error())
+		}
+	}
+
+	columns := []string{}
+	for _, column := range timestampColumns {
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+
+	return serializer.New(serializer.Options{
+		BaseFields:        baseFields,
+		TimestampColumns:  columns,
+		TimestampLayout:   timestampLayout,
+		TimestampLocation: location,
+		Rename:            rename,
+		Exclude:           exclude,
+		MultiValueArrays:  multiValueArrays,
+		Bytes:             bytesPolicy,
+	}), nil
+}
+
+// newEncoder builds the serializer.Encoder for a Firehose output's
+// record_format.  Avro records are single-object encodings, so they can't be
+// aggregated, split or truncated.
+func newEncoder(
+	format string, columns []string, avroSchemaFile string, newline bool,
+	aggregate bool, oversizePolicy string,
+) (serializer.Encoder, error) {
+	if format == "avro" {
+		if aggregate {
+			return nil, fmt.Errorf("avro records can't be aggregated")
+		}
+		if oversizePolicy == string(aws.OversizeSplit) || oversizePolicy == string(aws.OversizeTruncate) {
+			return nil, fmt.Errorf("avro records can't use oversize_record_policy '%s'", oversizePolicy)
+		}
+	}
+
+	return serializer.NewEncoder(serializer.EncoderConfig{
+		Format:         format,
+		Columns:        columns,
+		AvroSchemaFile: avroSchemaFile,
+		Newline:        newline,
+	})
+}
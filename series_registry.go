@@ -0,0 +1,197 @@
+package heka_clever_plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/batcher"
+)
+
+var errTooManySeries = errors.New("too many series")
+
+// kvSeries is a live series' batcher, and when it was last sent a message
+type kvSeries struct {
+	batch    batcher.Batcher
+	lastUsed int64 // in unix nanoseconds, updated atomically
+}
+
+// seriesRegistry holds the batcher of every live series.  It is safe for
+// concurrent use.
+type seriesRegistry struct {
+	lock   sync.RWMutex
+	series map[string]*kvSeries
+	closed bool
+
+	create func(name string) (batcher.Batcher, error)
+	// Maximum number of live series (0 is unlimited), not counting exempt
+	max    int
+	exempt string
+	now    func() time.Time
+}
+
+// newSeriesRegistry returns a registry that creates batchers with create,
+// holding at most max series (0 is unlimited) besides the exempt series
+func newSeriesRegistry(
+	create func(name string) (batcher.Batcher, error), max int, exempt string,
+) *seriesRegistry {
+	return &seriesRegistry{
+		series: map[string]*kvSeries{},
+		create: create,
+		max:    max,
+		exempt: exempt,
+		now:    time.Now,
+	}
+}
+
+// Get returns the batcher for name, creating it on first use.  It returns
+// errTooManySeries if that would go over the maximum, and batcher.ErrClosed
+// once the registry is closed.
+func (r *seriesRegistry) Get(name string) (batcher.Batcher, error) {
+	now := r.now().UnixNano()
+
+	r.lock.RLock()
+	series, ok := r.series[name]
+	r.lock.RUnlock()
+	if ok {
+		atomic.StoreInt64(&series.lastUsed, now)
+		return series.batch, nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil, batcher.ErrClosed
+	}
+	if series, ok := r.series[name]; ok {
+		atomic.StoreInt64(&series.lastUsed, now)
+		return series.batch, nil
+	}
+
+	if r.max > 0 && name != r.exempt && r.cappedLen() >= r.max {
+		return nil, errTooManySeries
+	}
+
+	batch, err := r.create(name)
+	if err != nil {
+		return nil, err
+	}
+	r.series[name] = &kvSeries{batch: batch, lastUsed: now}
+	return batch, nil
+}
+
+// cappedLen is the number of live series counted against the maximum.  The
+// lock must be held.
+func (r *seriesRegistry) cappedLen() int {
+	count := len(r.series)
+	if _, ok := r.series[r.exempt]; ok {
+		count--
+	}
+	return count
+}
+
+// Len returns the number of live series
+func (r *seriesRegistry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.series)
+}
+
+// Names returns the names of every live series, sorted
+func (r *seriesRegistry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.series))
+	for name := range r.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Batchers returns a snapshot of every live series' batcher
+func (r *seriesRegistry) Batchers() map[string]batcher.Batcher {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	batchers := make(map[string]batcher.Batcher, len(r.series))
+	for name, series := range r.series {
+		batchers[name] = series.batch
+	}
+	return batchers
+}
+
+// FlushAll asks every live series to send what it has buffered
+func (r *seriesRegistry) FlushAll() {
+	for _, batch := range r.Batchers() {
+		batch.Flush()
+	}
+}
+
+// CloseIdle closes and removes every series that hasn't been used since
+// cutoff, returning how many were closed
+func (r *seriesRegistry) CloseIdle(ctx context.Context, cutoff time.Time) (int, error) {
+	idle := map[string]batcher.Batcher{}
+
+	r.lock.Lock()
+	for name, series := range r.series {
+		if atomic.LoadInt64(&series.lastUsed) < cutoff.UnixNano() {
+			idle[name] = series.batch
+			delete(r.series, name)
+		}
+	}
+	r.lock.Unlock()
+
+	return len(idle), closeBatchers(ctx, idle)
+}
+
+// CloseAll closes every series, and stops new ones from being created
+func (r *seriesRegistry) CloseAll(ctx context.Context) error {
+	r.lock.Lock()
+	r.closed = true
+	all := make(map[string]batcher.Batcher, len(r.series))
+	for name, series := range r.series {
+		all[name] = series.batch
+	}
+	r.series = map[string]*kvSeries{}
+	r.lock.Unlock()
+
+	return closeBatchers(ctx, all)
+}
+
+// closeBatchers closes every batcher at once, returning an error naming any
+// that couldn't be closed before ctx expired
+func closeBatchers(ctx context.Context, batchers map[string]batcher.Batcher) error {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	failed := []string{}
+	var lastErr error
+
+	for name, batch := range batchers {
+		wg.Add(1)
+		go func(name string, batch batcher.Batcher) {
+			defer wg.Done()
+
+			if err := batch.Close(ctx); err != nil {
+				lock.Lock()
+				failed = append(failed, name)
+				lastErr = err
+				lock.Unlock()
+			}
+		}(name, batch)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("can't flush series %v: %s", failed, lastErr.Error())
+}
@@ -0,0 +1,132 @@
+package heka_clever_plugins
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/heka-clever-plugins/batcher"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingSync counts every message flushed through it
+type countingSync struct {
+	flushed *int64
+}
+
+func (s countingSync) Flush(batch [][]byte, cursors []string) {
+	atomic.AddInt64(s.flushed, int64(len(batch)))
+}
+
+func newTestRegistry(max int, exempt string) (*seriesRegistry, *int64, *int64) {
+	var created, flushed int64
+	registry := newSeriesRegistry(func(name string) (batcher.Batcher, error) {
+		atomic.AddInt64(&created, 1)
+		opts := batcher.DefaultOptions()
+		opts.FlushInterval = time.Hour
+		opts.FlushCount = 1000
+		return batcher.NewWithOptions(countingSync{&flushed}, opts), nil
+	}, max, exempt)
+	return registry, &created, &flushed
+}
+
+func TestSeriesRegistryCreatesOnFirstUse(t *testing.T) {
+	registry, created, _ := newTestRegistry(0, "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			batch, err := registry.Get(fmt.Sprintf("series-%d", i%4))
+			assert.NoError(t, err)
+			assert.NoError(t, batch.Send([]byte("hihi")))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(4), atomic.LoadInt64(created))
+	assert.Equal(t, 4, registry.Len())
+	assert.Equal(t, []string{"series-0", "series-1", "series-2", "series-3"}, registry.Names())
+	assert.NoError(t, registry.CloseAll(context.Background()))
+}
+
+func TestSeriesRegistryMax(t *testing.T) {
+	registry, _, _ := newTestRegistry(2, "overflow")
+
+	_, err := registry.Get("a")
+	assert.NoError(t, err)
+	_, err = registry.Get("b")
+	assert.NoError(t, err)
+
+	t.Log("A third series is refused")
+	_, err = registry.Get("c")
+	assert.Equal(t, errTooManySeries, err)
+
+	t.Log("Existing series and the exempt series are still available")
+	_, err = registry.Get("a")
+	assert.NoError(t, err)
+	_, err = registry.Get("overflow")
+	assert.NoError(t, err)
+	_, err = registry.Get("c")
+	assert.Equal(t, errTooManySeries, err)
+	assert.Equal(t, []string{"a", "b", "overflow"}, registry.Names())
+
+	assert.NoError(t, registry.CloseAll(context.Background()))
+}
+
+func TestSeriesRegistryFlushAndCloseAll(t *testing.T) {
+	registry, _, flushed := newTestRegistry(0, "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				batch, err := registry.Get(fmt.Sprintf("series-%d", i))
+				assert.NoError(t, err)
+				assert.NoError(t, batch.Send([]byte("hihi")))
+			}
+		}(i)
+		go registry.FlushAll()
+		go registry.Names()
+	}
+	wg.Wait()
+
+	t.Log("Closing flushes every series, and no new series can start")
+	assert.NoError(t, registry.CloseAll(context.Background()))
+	assert.Equal(t, int64(80), atomic.LoadInt64(flushed))
+	assert.Equal(t, 0, registry.Len())
+
+	_, err := registry.Get("series-0")
+	assert.Equal(t, batcher.ErrClosed, err)
+}
+
+func TestSeriesRegistryCloseIdle(t *testing.T) {
+	registry, _, flushed := newTestRegistry(0, "")
+
+	registry.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	idle, err := registry.Get("idle")
+	assert.NoError(t, err)
+	assert.NoError(t, idle.Send([]byte("hihi")))
+	registry.now = time.Now
+	_, err = registry.Get("busy")
+	assert.NoError(t, err)
+
+	closed, err := registry.CloseIdle(context.Background(), time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, closed)
+	assert.Equal(t, int64(1), atomic.LoadInt64(flushed))
+	assert.Equal(t, []string{"busy"}, registry.Names())
+
+	t.Log("A closed idle series starts again on its next message")
+	again, err := registry.Get("idle")
+	assert.NoError(t, err)
+	assert.False(t, idle == again)
+
+	assert.NoError(t, registry.CloseAll(context.Background()))
+}
@@ -0,0 +1,122 @@
+package heka_clever_plugins
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Firehose delivery stream names are 1-64 of these characters
+var validStreamName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// Matches %{fieldname} in stream templates
+var templateField = regexp.MustCompile(`%{([^}]+)}`)
+
+// seriesRouter decides which stream each KV series is written to, so
+// untrusted messages can only reach the streams they are allowed to
+type seriesRouter struct {
+	allowed       map[string]bool
+	pattern       *regexp.Regexp
+	streams       map[string]string
+	defaultStream string
+}
+
+// newSeriesRouter allows series that are in allowed or match pattern in full
+// (or any series, if both are empty).  Allowed series are written to the stream
+// template they map to in streams, or to a stream named after the series.
+// Anything else goes to defaultStream, or nowhere if it's empty.
+func newSeriesRouter(
+	allowed []string, pattern string, streams map[string]string, defaultStream string,
+) (*seriesRouter, error) {
+	r := &seriesRouter{streams: streams, defaultStream: defaultStream}
+
+	if len(allowed) > 0 {
+		r.allowed = map[string]bool{}
+		for _, series := range allowed {
+			r.allowed[series] = true
+		}
+	}
+
+	if pattern != "" {
+		var err error
+		// Anchored, so "api" doesn't also allow "evil-api-x"
+		r.pattern, err = regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid series pattern '%s': %s", pattern, err.Error())
+		}
+	}
+
+	if defaultStream != "" && !validStreamName.MatchString(defaultStream) {
+		return nil, fmt.Errorf("Invalid default stream name '%s'", defaultStream)
+	}
+
+	return r, nil
+}
+
+func (r *seriesRouter) isAllowed(seriesName string) bool {
+	if r.allowed == nil && r.pattern == nil {
+		return true
+	}
+	if r.allowed[seriesName] {
+		return true
+	}
+	return r.pattern != nil && r.pattern.MatchString(seriesName)
+}
+
+// route returns the stream m, from seriesName, should be written to, and
+// whether seriesName was matched.  The stream is empty if m should be dropped.
+func (r *seriesRouter) route(seriesName string, m *message.Message) (stream string, matched bool) {
+	if !r.isAllowed(seriesName) {
+		return r.defaultStream, false
+	}
+
+	stream = seriesName
+	if template, ok := r.streams[seriesName]; ok {
+		stream, ok = interpolateFields(template, m)
+		if !ok {
+			return r.defaultStream, false
+		}
+	}
+
+	if !validStreamName.MatchString(stream) {
+		return r.defaultStream, false
+	}
+	return stream, true
+}
+
+// interpolateFields replaces each %{fieldname} in template with the message's
+// value for it.  "Type", "Logger", "Hostname", "Payload", "EnvVersion", "Pid"
+// and "Severity" come from the base message, any other name from the first
+// value of a dynamic field.  It returns false if a field is missing.
+func interpolateFields(template string, m *message.Message) (string, bool) {
+	ok := true
+	result := templateField.ReplaceAllStringFunc(template, func(match string) string {
+		name := templateField.FindStringSubmatch(match)[1]
+
+		switch name {
+		case "Type":
+			return m.GetType()
+		case "Logger":
+			return m.GetLogger()
+		case "Hostname":
+			return m.GetHostname()
+		case "Payload":
+			return m.GetPayload()
+		case "EnvVersion":
+			return m.GetEnvVersion()
+		case "Pid":
+			return fmt.Sprint(m.GetPid())
+		case "Severity":
+			return fmt.Sprint(m.GetSeverity())
+		}
+
+		value, found := m.GetFieldValue(name)
+		if !found {
+			ok = false
+			return match
+		}
+		return fmt.Sprint(value)
+	})
+	return result, ok
+}
@@ -0,0 +1,71 @@
+package heka_clever_plugins
+
+import (
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesRouter(t *testing.T) {
+	m := &message.Message{}
+	m.SetType("app-log")
+	m.SetHostname("web-1")
+	env, err := message.NewField("env", "prod", "")
+	assert.NoError(t, err)
+	m.AddField(env)
+
+	streams := map[string]string{
+		"api-requests": "%{env}-api-requests",
+		"by-type":      "%{Type}-%{Hostname}",
+		"missing":      "%{region}-missing",
+		"invalid":      "no spaces allowed",
+	}
+
+	tests := []struct {
+		name          string
+		allowed       []string
+		pattern       string
+		defaultStream string
+		series        string
+		stream        string
+		matched       bool
+	}{
+		{name: "everything allowed by default", series: "jobs", stream: "jobs", matched: true},
+		{name: "allowlisted", allowed: []string{"jobs"}, series: "jobs", stream: "jobs", matched: true},
+		{name: "not allowlisted", allowed: []string{"jobs"}, series: "other", stream: "", matched: false},
+		{name: "matches pattern", pattern: "app-.*", series: "app-web", stream: "app-web", matched: true},
+		{name: "pattern must match in full", pattern: "api", series: "evil-api-x", stream: "", matched: false},
+		{name: "anchored alternatives", pattern: "api|jobs", series: "api-x", stream: "", matched: false},
+		{name: "already anchored", pattern: "^api$", series: "api", stream: "api", matched: true},
+		{
+			name: "not allowlisted, to default", allowed: []string{"jobs"}, pattern: "app-.*",
+			defaultStream: "unmatched", series: "other", stream: "unmatched", matched: false,
+		},
+		{name: "renamed with field", series: "api-requests", stream: "prod-api-requests", matched: true},
+		{name: "renamed with base fields", series: "by-type", stream: "app-log-web-1", matched: true},
+		{
+			name: "template field missing", defaultStream: "unmatched",
+			series: "missing", stream: "unmatched", matched: false,
+		},
+		{name: "invalid stream name", series: "invalid", stream: "", matched: false},
+		{name: "path in series", series: "../etc/passwd", stream: "", matched: false},
+	}
+
+	for _, test := range tests {
+		router, err := newSeriesRouter(test.allowed, test.pattern, streams, test.defaultStream)
+		assert.NoError(t, err, test.name)
+
+		stream, matched := router.route(test.series, m)
+		assert.Equal(t, test.stream, stream, test.name)
+		assert.Equal(t, test.matched, matched, test.name)
+	}
+}
+
+func TestSeriesRouterInvalidConfig(t *testing.T) {
+	_, err := newSeriesRouter(nil, "(", nil, "")
+	assert.Error(t, err)
+
+	_, err = newSeriesRouter(nil, "", nil, "not a stream")
+	assert.Error(t, err)
+}
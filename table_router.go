@@ -0,0 +1,116 @@
+package heka_clever_plugins
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Schema and table names built from message fields are limited to these
+// characters (and Postgres' 63 byte identifier limit), so messages can't
+// inject SQL or reach tables that need quoting
+var validTableName = regexp.MustCompile(`^[a-zA-Z0-9_]{1,63}$`)
+
+// tableDestination is a table batches are written to
+type tableDestination struct {
+	schema string
+	table  string
+}
+
+func (d tableDestination) String() string {
+	return d.schema + "." + d.table
+}
+
+// tableRouter decides which table each message is written to, so untrusted
+// messages can only reach the tables they are allowed to
+type tableRouter struct {
+	schemaTemplate string
+	tableTemplate  string
+	allowed        map[string]bool
+	pattern        *regexp.Regexp
+}
+
+// newTableRouter writes messages to the schema and table templates, with
+// %{fieldname} filled in from the message.  Templated destinations must be in
+// allowed or match pattern against the whole of "schema.table", so templates
+// need at least one of them.  allowed holds "schema.table" names, or bare
+// table names in the schema when it isn't templated.
+func newTableRouter(schema, table string, allowed []string, pattern string) (*tableRouter, error) {
+	if table == "" {
+		return nil, fmt.Errorf("config item 'insert_table' cannot be empty string")
+	}
+	r := &tableRouter{schemaTemplate: schema, tableTemplate: table}
+	if r.isTemplated() && len(allowed) == 0 && pattern == "" {
+		return nil, fmt.Errorf(
+			"templated tables need 'allowed_tables' or 'allowed_tables_pattern', so messages can't pick any table",
+		)
+	}
+
+	if len(allowed) > 0 {
+		r.allowed = map[string]bool{}
+		for _, name := range allowed {
+			// Otherwise "logs" would allow "logs" in every schema a message
+			// can name
+			if r.isSchemaTemplated() && !strings.Contains(name, ".") {
+				return nil, fmt.Errorf(
+					"allowed_tables entry '%s' needs a schema, e.g. 'public.%s', when the schema is templated",
+					name, name,
+				)
+			}
+			r.allowed[name] = true
+		}
+	}
+
+	if pattern != "" {
+		var err error
+		// Anchored, so "public\.logs" doesn't also allow "public.logs_secret"
+		r.pattern, err = regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid table pattern '%s': %s", pattern, err.Error())
+		}
+	}
+
+	return r, nil
+}
+
+func (r *tableRouter) isTemplated() bool {
+	return r.isSchemaTemplated() || strings.Contains(r.tableTemplate, "%{")
+}
+
+func (r *tableRouter) isSchemaTemplated() bool {
+	return strings.Contains(r.schemaTemplate, "%{")
+}
+
+func (r *tableRouter) isAllowed(dest tableDestination) bool {
+	if (!r.isSchemaTemplated() && r.allowed[dest.table]) || r.allowed[dest.String()] {
+		return true
+	}
+	return r.pattern != nil && r.pattern.MatchString(dest.String())
+}
+
+// route returns the table m should be written to
+func (r *tableRouter) route(m *message.Message) (tableDestination, error) {
+	if !r.isTemplated() {
+		return tableDestination{schema: r.schemaTemplate, table: r.tableTemplate}, nil
+	}
+
+	schema, ok := interpolateFields(r.schemaTemplate, m)
+	if !ok {
+		return tableDestination{}, fmt.Errorf("message is missing a field of schema '%s'", r.schemaTemplate)
+	}
+	table, ok := interpolateFields(r.tableTemplate, m)
+	if !ok {
+		return tableDestination{}, fmt.Errorf("message is missing a field of table '%s'", r.tableTemplate)
+	}
+
+	dest := tableDestination{schema: schema, table: table}
+	if (schema != "" && !validTableName.MatchString(schema)) || !validTableName.MatchString(table) {
+		return tableDestination{}, fmt.Errorf("invalid table name '%s'", dest)
+	}
+	if !r.isAllowed(dest) {
+		return tableDestination{}, fmt.Errorf("table '%s' isn't allowed", dest)
+	}
+	return dest, nil
+}
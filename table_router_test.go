@@ -0,0 +1,95 @@
+package heka_clever_plugins
+
+import (
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableRouter(t *testing.T) {
+	m := &message.Message{}
+	m.SetType("app-log")
+	for name, value := range map[string]string{"route": "api_requests", "team": "web", "bad": "x; DROP TABLE y"} {
+		field, err := message.NewField(name, value, "")
+		assert.NoError(t, err)
+		m.AddField(field)
+	}
+
+	tests := []struct {
+		name    string
+		schema  string
+		table   string
+		allowed []string
+		pattern string
+		dest    tableDestination
+		err     bool
+	}{
+		{name: "static", schema: "public", table: "Static-Table", dest: tableDestination{"public", "Static-Table"}},
+		{
+			name: "templated table", schema: "public", table: "%{route}", pattern: `public\..*`,
+			dest: tableDestination{"public", "api_requests"},
+		},
+		{
+			name: "templated schema", schema: "%{team}", table: "log_%{route}", pattern: `.*`,
+			dest: tableDestination{"web", "log_api_requests"},
+		},
+		{
+			name: "allowlisted table", schema: "public", table: "%{route}", allowed: []string{"api_requests"},
+			dest: tableDestination{"public", "api_requests"},
+		},
+		{
+			name: "allowlisted schema and table", schema: "%{team}", table: "%{route}", allowed: []string{"web.api_requests"},
+			dest: tableDestination{"web", "api_requests"},
+		},
+		{name: "not allowlisted", schema: "public", table: "%{route}", allowed: []string{"jobs"}, err: true},
+		{
+			name: "allowlisted table in another schema", schema: "%{team}", table: "%{route}",
+			allowed: []string{"otherschema.api_requests"}, err: true,
+		},
+		{
+			name: "matches pattern", schema: "%{team}", table: "%{route}", pattern: `web\..*`,
+			dest: tableDestination{"web", "api_requests"},
+		},
+		{name: "doesn't match pattern", schema: "%{team}", table: "%{route}", pattern: `ops\..*`, err: true},
+		{
+			name: "pattern must match in full", schema: "%{team}", table: "%{route}", pattern: `web\.api`,
+			err: true,
+		},
+		{name: "missing field", schema: "public", table: "%{region}", pattern: `.*`, err: true},
+		{name: "invalid name", schema: "public", table: "%{bad}", pattern: `.*`, err: true},
+		{name: "invalid base field", schema: "public", table: "%{Type}", pattern: `.*`, err: true},
+	}
+
+	for _, test := range tests {
+		router, err := newTableRouter(test.schema, test.table, test.allowed, test.pattern)
+		assert.NoError(t, err, test.name)
+
+		dest, err := router.route(m)
+		if test.err {
+			assert.Error(t, err, test.name)
+		} else {
+			assert.NoError(t, err, test.name)
+			assert.Equal(t, test.dest, dest, test.name)
+		}
+	}
+
+	_, err := newTableRouter("public", "", nil, "")
+	assert.Error(t, err)
+	_, err = newTableRouter("public", "%{route}", nil, "(")
+	assert.Error(t, err)
+
+	t.Log("Templated tables must be limited to an allowlist or pattern")
+	_, err = newTableRouter("public", "%{route}", nil, "")
+	assert.Error(t, err)
+	_, err = newTableRouter("%{team}", "logs", nil, "")
+	assert.Error(t, err)
+
+	t.Log("Bare table names can't be allowed in templated schemas")
+	_, err = newTableRouter("%{team}", "logs", []string{"logs"}, "")
+	assert.Error(t, err)
+	router, err := newTableRouter("%{team}", "logs", []string{"public.logs"}, "")
+	assert.NoError(t, err)
+	assert.False(t, router.isAllowed(tableDestination{"otherschema", "logs"}))
+	assert.True(t, router.isAllowed(tableDestination{"public", "logs"}))
+}